@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Aggregation pools samples of the same metric from several databases, e.g.
+// repeated runs of a benchmark. Runs are aligned by elapsed time: timestamps
+// of every run start at zero.
+
+var (
+	errNoRuns    = errors.New("no database has the metric")
+	errNoSamples = errors.New("metric has no samples")
+)
+
+// RunStats describes how a summary value differs from run to run.
+type RunStats struct {
+	Mean     float64 `json:"mean"`
+	StdDev   float64 `json:"stddev"`
+	Variance float64 `json:"variance"`
+	CV       float64 `json:"cv"` // Relative standard deviation
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+}
+
+type Aggregate struct {
+	Metric    string                            `json:"metric"`
+	Databases []string                          `json:"databases"` // Pooled runs
+	Summary   map[string]interface{}            `json:"summary"`
+	Runs      map[string]map[string]interface{} `json:"runs"`
+	Variance  map[string]*RunStats              `json:"variance"`
+}
+
+// newRunStats returns statistics of the values, the variance is the sample
+// variance.
+func newRunStats(values []float64) *RunStats {
+	stats := RunStats{Min: values[0], Max: values[0]}
+	for _, v := range values {
+		stats.Mean += v
+		stats.Min = math.Min(stats.Min, v)
+		stats.Max = math.Max(stats.Max, v)
+	}
+	stats.Mean /= float64(len(values))
+
+	if len(values) > 1 {
+		for _, v := range values {
+			stats.Variance += (v - stats.Mean) * (v - stats.Mean)
+		}
+		stats.Variance /= float64(len(values) - 1)
+	}
+	stats.StdDev = math.Sqrt(stats.Variance)
+	if stats.Mean != 0 {
+		stats.CV = stats.StdDev / math.Abs(stats.Mean)
+	}
+	return &stats
+}
+
+// readRuns reads the metric from every database. Timestamps are converted
+// to the finest precision of the databases, which is returned as well, and
+// made relative to the first sample of the run. Runs that cannot be read are
+// returned as errors.
+func (c *Controller) readRuns(databases []string, metric string) (map[string][]Sample, map[string]error, time.Duration) {
+	runs := map[string][]Sample{}
+	errs := map[string]error{}
+
+	unit := time.Millisecond
+	for _, dbname := range databases {
+		if err := c.storage.checkMetricExists(dbname, metric); err != nil {
+			errs[dbname] = err
+			continue
+		}
+		settings, err := c.storage.getSettings(dbname)
+		if err != nil {
+			errs[dbname] = err
+			continue
+		}
+		if settings.unit() < unit {
+			unit = settings.unit()
+		}
+	}
+
+	for _, dbname := range databases {
+		if errs[dbname] != nil {
+			continue
+		}
+		samples := []Sample{}
+		err := c.storage.streamRawValues(dbname, metric, unit, func(sample Sample) error {
+			samples = append(samples, sample)
+			return nil
+		})
+		if err != nil {
+			errs[dbname] = err
+			continue
+		}
+		if len(samples) == 0 {
+			errs[dbname] = errNoSamples
+			continue
+		}
+
+		start := int64(math.MaxInt64)
+		for _, sample := range samples {
+			if sample.ts < start {
+				start = sample.ts
+			}
+		}
+		for i := range samples {
+			samples[i].ts -= start
+		}
+		runs[dbname] = samples
+	}
+	return runs, errs, unit
+}
+
+// aggregate summarizes the metric in every database and all samples
+// together.
+func (c *Controller) aggregate(databases []string, metric string) (*Aggregate, error) {
+	runs, errs, _ := c.readRuns(databases, metric)
+	if len(runs) == 0 {
+		return nil, errNoRuns
+	}
+
+	result := Aggregate{
+		Metric:    metric,
+		Databases: []string{},
+		Runs:      map[string]map[string]interface{}{},
+		Variance:  map[string]*RunStats{},
+	}
+
+	pooled := []float64{}
+	byKey := map[string][]float64{}
+	for _, dbname := range databases {
+		if err := errs[dbname]; os.IsNotExist(err) {
+			result.Runs[dbname] = map[string]interface{}{"error": "metric not found"}
+			continue
+		} else if err != nil {
+			result.Runs[dbname] = map[string]interface{}{"error": err.Error()}
+			continue
+		}
+
+		values := make([]float64, 0, len(runs[dbname]))
+		for _, sample := range runs[dbname] {
+			values = append(values, sample.v)
+		}
+		pooled = append(pooled, values...)
+
+		summary := summarize(values)
+		for key, value := range summary {
+			if v, ok := value.(float64); ok {
+				byKey[key] = append(byKey[key], v)
+			} else if n, ok := value.(int); ok {
+				byKey[key] = append(byKey[key], float64(n))
+			}
+		}
+		result.Databases = append(result.Databases, dbname)
+		result.Runs[dbname] = summary
+	}
+
+	result.Summary = summarize(pooled)
+	for key, values := range byKey {
+		result.Variance[key] = newRunStats(values)
+	}
+	return &result, nil
+}
+
+// selectRuns returns databases listed in "databases" parameter, or all
+// databases, filtered the same way as the list of databases.
+func (c *Controller) selectRuns(context *gin.Context) ([]string, error) {
+	var databases []string
+	if param := context.Query("databases"); param != "" {
+		for _, dbname := range strings.Split(param, ",") {
+			if err := validateDbName(dbname); err != nil {
+				return nil, fmt.Errorf("invalid db name %q: %s", dbname, err)
+			}
+			databases = append(databases, dbname)
+		}
+	} else {
+		var err error
+		if databases, err = c.storage.listDatabases(); err != nil {
+			return nil, err
+		}
+	}
+	databases, err := c.filterDatabases(context, databases)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(databases)
+	return databases, nil
+}
+
+// aggregateParams validates parameters of aggregation requests. It aborts
+// the request and returns false if they are invalid.
+func (c *Controller) aggregateParams(context *gin.Context) ([]string, string, bool) {
+	metric := context.Query("metric")
+	if err := validateName(metric); err != nil {
+		abortWithMessage(context, http.StatusBadRequest, fmt.Errorf("invalid metric name %q: %s", metric, err))
+		return nil, "", false
+	}
+
+	databases, err := c.selectRuns(context)
+	if err != nil {
+		abortWithMessage(context, http.StatusBadRequest, err)
+		return nil, "", false
+	}
+	if len(databases) == 0 {
+		abortWithMessage(context, http.StatusNotFound, errors.New("no databases match"))
+		return nil, "", false
+	}
+	return databases, metric, true
+}
+
+func (c *Controller) getAggregate(context *gin.Context) {
+	databases, metric, ok := c.aggregateParams(context)
+	if !ok {
+		return
+	}
+
+	result, err := c.aggregate(databases, metric)
+	if err == errNoRuns {
+		abortWithMessage(context, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	context.JSON(http.StatusOK, result)
+}
+
+func (c *Controller) getAggregateHeatMapSVG(context *gin.Context) {
+	databases, metric, ok := c.aggregateParams(context)
+	if !ok {
+		return
+	}
+
+	runs, _, unit := c.readRuns(databases, metric)
+	if len(runs) == 0 {
+		abortWithMessage(context, http.StatusNotFound, errNoRuns)
+		return
+	}
+	pooled := []Sample{}
+	for _, samples := range runs {
+		pooled = append(pooled, samples...)
+	}
+	hm := buildHeatMap(pooled, unit)
+	hm.runs = true
+
+	title := fmt.Sprintf("%s, %d runs", metric, len(runs))
+	if label := context.Query("label"); label != "" {
+		title = label
+	}
+
+	context.Writer.Header().Set("Content-Type", "image/svg+xml")
+	generateSVG(context.Writer, hm, title)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestAggregate(controller *Controller, query string) (*Aggregate, *httptest.ResponseRecorder) {
+	req, _ := http.NewRequest("GET", "/_aggregate"+query, nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	var result Aggregate
+	json.Unmarshal(rw.Body.Bytes(), &result)
+	return &result, rw
+}
+
+func TestAggregate(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+	controller := newController(storage)
+
+	// Runs start at different times and have different precision
+	addTestSample(controller, "run-1", "?ts=1411940881000", "{\"cpu\":1}")
+	addTestSample(controller, "run-1", "?ts=1411940882000", "{\"cpu\":3}")
+	setTestSettings(controller, "run-2", "{\"precision\":\"us\"}")
+	addTestSample(controller, "run-2", "?ts=1411950881000000", "{\"cpu\":2}")
+	addTestSample(controller, "run-2", "?ts=1411950882000000", "{\"cpu\":6}")
+	addTestSample(controller, "run-3", "", "{\"mem\":1}")
+	addTestSample(controller, "other", "", "{\"cpu\":100}")
+
+	result, rw := getTestAggregate(controller, "?metric=cpu&match=run-*")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, []string{"run-1", "run-2"}, result.Databases)
+	assert.Equal(t, 4.0, result.Summary["count"])
+	assert.Equal(t, 3.0, result.Summary["avg"])
+	assert.Equal(t, 2.0, result.Runs["run-1"]["avg"])
+	assert.Equal(t, 4.0, result.Runs["run-2"]["avg"])
+	assert.Equal(t, map[string]interface{}{"error": "metric not found"}, result.Runs["run-3"])
+	assert.Equal(t, &RunStats{Mean: 3, StdDev: 1.4142135623730951, Variance: 2, CV: 0.47140452079103173, Min: 2, Max: 4},
+		result.Variance["avg"])
+	assert.Equal(t, 0.0, result.Variance["count"].StdDev)
+
+	result, rw = getTestAggregate(controller, "?metric=cpu&databases=other,run-1,missing")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, []string{"other", "run-1"}, result.Databases)
+	assert.Equal(t, 51.5, result.Variance["max"].Mean)
+	assert.Equal(t, map[string]interface{}{"error": "metric not found"}, result.Runs["missing"])
+
+	req, _ := http.NewRequest("GET", "/_aggregate/heatmap?metric=cpu&prefix=run-", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "image/svg+xml", rw.Header().Get("Content-Type"))
+	assert.Contains(t, rw.Body.String(), "cpu, 2 runs")
+}
+
+func TestAggregateErrors(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+	controller := newController(storage)
+	addTestSample(controller, "run-1", "", "{\"cpu\":1}")
+
+	for query, code := range map[string]int{
+		"?match=run-*":                       http.StatusBadRequest,
+		"?metric=cpu&databases=run-1,_local": http.StatusBadRequest,
+		"?metric=cpu&match=[":                http.StatusBadRequest,
+		"?metric=cpu&match=other-*":          http.StatusNotFound,
+		"?metric=mem&match=run-*":            http.StatusNotFound,
+	} {
+		_, rw := getTestAggregate(controller, query)
+		assert.Equal(t, code, rw.Code, query)
+		assert.Contains(t, rw.Body.String(), "\"error\"", query)
+	}
+}
+
+func TestAggregateHeatMapSingleSamples(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+	controller := newController(storage)
+	addTestSample(controller, "run-1", "?ts=1411940881000", "{\"cpu\":1}")
+	addTestSample(controller, "run-2", "?ts=1411950881000", "{\"cpu\":-2}")
+
+	req, _ := http.NewRequest("GET", "/_aggregate/heatmap?metric=cpu&match=run-*", nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), "cpu, 2 runs")
+
+	// Runs are aligned at zero, the axis shows time since the start of a run
+	assert.Contains(t, rw.Body.String(), "Time since start of run, s")
+	assert.NotContains(t, rw.Body.String(), "1970")
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Archives are gzipped tarballs. The first entry is the manifest, it's
+// followed by database files exactly as they are stored on disk.
+
+const (
+	archiveVersion  = 3 // Older versions have no compressed or legacy data files
+	archiveManifest = "manifest.json"
+)
+
+var errDatabaseExists = errors.New("database already exists")
+
+type archiveError string
+
+func (e archiveError) Error() string {
+	return "invalid archive: " + string(e)
+}
+
+type ArchiveFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type Manifest struct {
+	Version  int                    `json:"version"`
+	Name     string                 `json:"name"`
+	Exported int64                  `json:"exported"`
+	Metadata map[string]interface{} `json:"meta"`
+	Files    []ArchiveFile          `json:"files"`
+}
+
+// copyFile copies the file and returns its checksum.
+func copyFile(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// stageDatabase copies files of the database into a temporary directory, so
+// that the archive is consistent while writers are not blocked by slow
+// clients.
+func (pdb *perfDB) stageDatabase(dbname string) (string, *Manifest, error) {
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+
+	if err := pdb.flushDatabase(dbname); err != nil {
+		return "", nil, err
+	}
+
+	dataDir := pdb.getDirPath(dbname)
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	meta, err := pdb.getMeta(dbname)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Names starting with "_" are never listed as databases
+	stageDir, err := ioutil.TempDir(pdb.baseDir, "_export")
+	if err != nil {
+		return "", nil, err
+	}
+
+	manifest := Manifest{
+		Version:  archiveVersion,
+		Name:     dbname,
+		Exported: time.Now().UnixNano() / 1e6,
+		Metadata: meta,
+		Files:    []ArchiveFile{},
+	}
+	for _, f := range files {
+		if !f.Mode().IsRegular() || filepath.Ext(f.Name()) == ".tmp" {
+			continue
+		}
+		checksum, err := copyFile(filepath.Join(dataDir, f.Name()), filepath.Join(stageDir, f.Name()))
+		if err != nil {
+			os.RemoveAll(stageDir)
+			return "", nil, err
+		}
+		manifest.Files = append(manifest.Files, ArchiveFile{f.Name(), f.Size(), checksum})
+	}
+	return stageDir, &manifest, nil
+}
+
+func writeArchiveEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	header := tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(&header); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tw, r, size)
+	return err
+}
+
+func (pdb *perfDB) exportDatabase(dbname string, w io.Writer) error {
+	stageDir, manifest, err := pdb.stageDatabase(dbname)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stageDir)
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveEntry(tw, archiveManifest, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	for _, f := range manifest.Files {
+		file, err := os.Open(filepath.Join(stageDir, f.Name))
+		if err != nil {
+			return err
+		}
+		err = writeArchiveEntry(tw, f.Name, f.Size, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func readManifest(tr *tar.Reader) (*Manifest, error) {
+	header, err := tr.Next()
+	if err != nil || header.Name != archiveManifest {
+		return nil, archiveError("the first entry must be " + archiveManifest)
+	}
+
+	var manifest Manifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, archiveError("malformed manifest: " + err.Error())
+	}
+	if manifest.Version < 1 || manifest.Version > archiveVersion {
+		return nil, archiveError(fmt.Sprintf("unsupported version %d", manifest.Version))
+	}
+	return &manifest, nil
+}
+
+// validateArchiveFiles checks that file names are safe and that every legacy
+// metric has all of its files.
+func validateArchiveFiles(files []ArchiveFile) (map[string]ArchiveFile, error) {
+	expected := map[string]ArchiveFile{}
+	for _, f := range files {
+		if f.Name != filepath.Base(f.Name) || f.Name == "." || f.Name == ".." || strings.HasPrefix(f.Name, ".") {
+			return nil, archiveError(fmt.Sprintf("bad file name %q", f.Name))
+		}
+		expected[f.Name] = f
+	}
+	for name := range expected {
+		if filepath.Ext(name) != dataFileExt {
+			continue
+		}
+		_, first := expected[name+".1"]
+		_, last := expected[name+".n"]
+		if first != last {
+			return nil, archiveError(fmt.Sprintf("%s must have both .1 and .n files or none", name))
+		}
+	}
+	return expected, nil
+}
+
+// unpackArchive extracts files into the directory and verifies their sizes
+// and checksums.
+func unpackArchive(tr *tar.Reader, dir string, expected map[string]ArchiveFile) error {
+	seen := map[string]bool{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return archiveError(err.Error())
+		}
+
+		f, ok := expected[header.Name]
+		if !ok || seen[header.Name] {
+			return archiveError(fmt.Sprintf("unexpected file %q", header.Name))
+		}
+		seen[header.Name] = true
+
+		out, err := os.Create(filepath.Join(dir, f.Name))
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(out, hash), tr)
+		out.Close()
+		if err != nil {
+			return archiveError(err.Error())
+		}
+		if size != f.Size || hex.EncodeToString(hash.Sum(nil)) != f.SHA256 {
+			return archiveError(fmt.Sprintf("checksum mismatch in %q", f.Name))
+		}
+	}
+
+	for name := range expected {
+		if !seen[name] {
+			return archiveError(fmt.Sprintf("missing file %q", name))
+		}
+	}
+	return nil
+}
+
+// importDatabase recreates a database from the archive. The database is
+// renamed to the first free "name-N" if rename is set and the name is taken.
+// It returns the name of the new database.
+func (pdb *perfDB) importDatabase(r io.Reader, name string, rename bool) (string, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return "", archiveError(err.Error())
+	}
+	tr := tar.NewReader(gr)
+
+	manifest, err := readManifest(tr)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		name = manifest.Name
+	}
+	if err := validateDbName(name); err != nil {
+		return "", archiveError(fmt.Sprintf("invalid db name %q: %s", name, err))
+	}
+
+	expected, err := validateArchiveFiles(manifest.Files)
+	if err != nil {
+		return "", err
+	}
+
+	// Files are unpacked next to the databases, so that the final rename is
+	// atomic.
+	stageDir, err := ioutil.TempDir(pdb.baseDir, "_import")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(stageDir)
+
+	if err := unpackArchive(tr, stageDir, expected); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(stageDir, 0775); err != nil {
+		return "", err
+	}
+
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+
+	target := name
+	for i := 1; ; i++ {
+		_, err := os.Stat(pdb.getDirPath(target))
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if !rename {
+			return "", errDatabaseExists
+		}
+		target = fmt.Sprintf("%s-%d", name, i)
+	}
+	if err := validateDbName(target); err != nil {
+		return "", archiveError(fmt.Sprintf("invalid db name %q: %s", target, err))
+	}
+
+	dataDir := pdb.getDirPath(target)
+	if err := os.Rename(stageDir, dataDir); err != nil {
+		return "", err
+	}
+
+	// Forget anything cached for a database that used to have this name
+	settingsCache.Delete(filepath.Join(dataDir, settingsFile))
+	for fileName := range expected {
+		timestampCache.Delete(filepath.Join(dataDir, fileName))
+	}
+	return target, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// resultCache keeps recently computed summaries and heat maps, so that
+// finished databases are not rescanned on every request. Entries are keyed by
+// the data version of the metric: the controller bumps the version whenever
+// it changes the data (new samples, settings, imports and repairs), entries
+// of older versions are never found again and eventually evicted.
+type resultCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[cacheKey]*list.Element
+	lru      *list.List // Most recently used first
+	epoch    uint64     // Last assigned version
+	all      uint64     // Version of everything
+	dbs      map[string]uint64
+	metrics  map[[2]string]uint64
+	hits     int64
+	misses   int64
+}
+
+type cacheKey struct {
+	query   string // summary, heatmap, etc.
+	dbname  string
+	metric  string
+	params  string // Query parameters that affect the result
+	version [3]uint64
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	value interface{}
+}
+
+type CacheStats struct {
+	Capacity int   `json:"capacity"`
+	Entries  int   `json:"entries"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+}
+
+const defaultCacheSize = 1000
+
+// newResultCache returns a cache for up to capacity results, a zero capacity
+// disables caching.
+func newResultCache(capacity int) *resultCache {
+	return &resultCache{
+		capacity: capacity,
+		entries:  map[cacheKey]*list.Element{},
+		lru:      list.New(),
+		dbs:      map[string]uint64{},
+		metrics:  map[[2]string]uint64{},
+	}
+}
+
+// version returns the data version of the metric, which changes when all
+// databases, the database or the metric is invalidated.
+func (rc *resultCache) version(dbname, metric string) [3]uint64 {
+	return [3]uint64{rc.all, rc.dbs[dbname], rc.metrics[[2]string{dbname, metric}]}
+}
+
+// invalidate changes the data version of the metric. An empty metric
+// invalidates the whole database, an empty database name everything.
+func (rc *resultCache) invalidate(dbname, metric string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.epoch++
+	switch {
+	case dbname == "":
+		rc.all = rc.epoch
+	case metric == "":
+		rc.dbs[dbname] = rc.epoch
+	default:
+		rc.metrics[[2]string{dbname, metric}] = rc.epoch
+	}
+}
+
+// get returns the cached result of the query or computes and caches it.
+// Results must not be modified by callers.
+func (rc *resultCache) get(query, dbname, metric, params string, compute func() (interface{}, error)) (interface{}, error) {
+	rc.mu.Lock()
+	key := cacheKey{query, dbname, metric, params, rc.version(dbname, metric)}
+	if element, ok := rc.entries[key]; ok {
+		rc.hits++
+		rc.lru.MoveToFront(element)
+		rc.mu.Unlock()
+		return element.Value.(*cacheEntry).value, nil
+	}
+	rc.misses++
+	rc.mu.Unlock()
+
+	// The data may change while the result is computed, then it's stored
+	// with the old version and never used
+	value, err := compute()
+	if err != nil || rc.capacity <= 0 {
+		return value, err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if _, ok := rc.entries[key]; !ok {
+		rc.entries[key] = rc.lru.PushFront(&cacheEntry{key, value})
+	}
+	for rc.lru.Len() > rc.capacity {
+		oldest := rc.lru.Back()
+		rc.lru.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*cacheEntry).key)
+	}
+	return value, nil
+}
+
+func (rc *resultCache) stats() *CacheStats {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return &CacheStats{
+		Capacity: rc.capacity,
+		Entries:  rc.lru.Len(),
+		Hits:     rc.hits,
+		Misses:   rc.misses,
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultCacheEviction(t *testing.T) {
+	rc := newResultCache(2)
+	computed := 0
+	get := func(metric string) interface{} {
+		value, _ := rc.get("summary", "database", metric, "", func() (interface{}, error) {
+			computed++
+			return metric, nil
+		})
+		return value
+	}
+
+	assert.Equal(t, "cpu", get("cpu"))
+	get("mem")
+	get("cpu")
+	get("disk") // Evicts mem, the least recently used
+	get("cpu")
+	get("mem")
+	assert.Equal(t, 4, computed)
+	assert.Equal(t, CacheStats{Capacity: 2, Entries: 2, Hits: 2, Misses: 4}, *rc.stats())
+}
+
+func TestResultCacheInvalidation(t *testing.T) {
+	rc := newResultCache(10)
+	computed := 0
+	get := func(dbname, metric string) {
+		rc.get("summary", dbname, metric, "", func() (interface{}, error) {
+			computed++
+			return nil, nil
+		})
+	}
+
+	get("database", "cpu")
+	get("database", "mem")
+	get("other", "cpu")
+
+	rc.invalidate("database", "cpu")
+	get("database", "cpu")
+	get("database", "mem")
+	assert.Equal(t, 4, computed)
+
+	rc.invalidate("database", "")
+	get("database", "mem")
+	get("other", "cpu")
+	assert.Equal(t, 5, computed)
+
+	rc.invalidate("", "")
+	get("other", "cpu")
+	assert.Equal(t, 6, computed)
+}
+
+func TestResultCacheDisabled(t *testing.T) {
+	rc := newResultCache(0)
+	for i := 0; i < 2; i++ {
+		rc.get("summary", "database", "cpu", "", func() (interface{}, error) {
+			return nil, nil
+		})
+	}
+	assert.Equal(t, CacheStats{Misses: 2}, *rc.stats())
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Databases that have been cold for a while are compacted: every data file is
+// replaced with a compressed one. A compressed file starts with a header that
+// describes the metric:
+//
+//	#perfdb-gz 1 <base> <created> <last timestamp> <last value> <records> <raw size>
+//
+// followed by the gzipped text data file (see datafile.go). Compressed files
+// are immutable, adding a sample decompresses the metric first. The header
+// answers most questions about the metric without decompression.
+
+const (
+	compressedHeaderPrefix = "#perfdb-gz"
+	compactionInterval     = 10 * time.Minute
+
+	// Compressed files are written next to data files without holding
+	// pdb.mu, so they don't share the temporary file of replaceFile
+	compressedTmpExt = ".gz.tmp"
+)
+
+type compressedHeader struct {
+	last    Sample
+	records int
+	rawSize int64
+}
+
+type CompressionStats struct {
+	Name       string  `json:"name"`
+	Compressed bool    `json:"compressed"`
+	Size       int64   `json:"size"`
+	RawSize    int64   `json:"rawSize"`
+	Ratio      float64 `json:"ratio"`
+}
+
+type CompressionReport struct {
+	Name        string              `json:"name"`
+	Metrics     int                 `json:"metrics"`
+	Compressed  int                 `json:"compressed"` // Number of compressed metrics
+	Size        int64               `json:"size"`
+	RawSize     int64               `json:"rawSize"`
+	Ratio       float64             `json:"ratio"`
+	MetricStats []*CompressionStats `json:"metricStats"`
+}
+
+func compressionRatio(rawSize, size int64) float64 {
+	if size == 0 {
+		return 1
+	}
+	return float64(rawSize) / float64(size)
+}
+
+// compressData writes the compressed data file to a temporary file and
+// returns its name. It only reads the data file, which is described by info.
+func compressData(dataFile string, info *dataInfo) (string, error) {
+	records, err := countRecords(dataFile)
+	if err != nil {
+		return "", err
+	}
+	header := dataHeader{
+		version: dataFormatVersion,
+		base:    info.first,
+		created: info.created,
+		compressedHeader: &compressedHeader{
+			last:    info.last,
+			records: records - 1,
+			rawSize: info.size,
+		},
+	}
+
+	in, err := os.Open(dataFile)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	tmpFile := dataFile + compressedTmpExt
+	out, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	err = func() error {
+		if _, err := io.WriteString(out, formatHeader(header)); err != nil {
+			return err
+		}
+		gw, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(gw, io.NewSectionReader(in, 0, info.size)); err != nil {
+			return err
+		}
+		if err := gw.Close(); err != nil {
+			return err
+		}
+		if fsyncPolicy == fsyncAlways {
+			return syncToDisk(out)
+		}
+		return nil
+	}()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return "", err
+	}
+	return tmpFile, nil
+}
+
+// decompressData replaces the compressed data file with the text one.
+func decompressData(dataFile string) error {
+	in, err := openData(dataFile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return replaceFile(dataFile, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
+
+// compactDatabase compresses all metrics of the database.
+func (pdb *perfDB) compactDatabase(dbname string) error {
+	pdb.mu.Lock()
+	err := pdb.flushDatabase(dbname)
+	pdb.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	dataDir := pdb.getDirPath(dbname)
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != dataFileExt {
+			continue
+		}
+		dataFile := filepath.Join(dataDir, f.Name())
+		if err := pdb.compactMetric(dataFile); err != nil {
+			return fmt.Errorf("cannot compress %s: %s", dataFile, err)
+		}
+	}
+	return nil
+}
+
+// compactMetric replaces the data file with a compressed one. Compression
+// doesn't hold pdb.mu, the file is replaced only if it didn't change in the
+// meantime. Meanwhile the metric is in pdb.compressing, so that recovery and
+// fsck keep the temporary file.
+func (pdb *perfDB) compactMetric(dataFile string) error {
+	pdb.mu.Lock()
+	info, before, err := pdb.compressionSnapshot(dataFile)
+	if err == nil && info != nil {
+		pdb.compressing[dataFile] = true
+	}
+	pdb.mu.Unlock()
+	if err != nil || info == nil {
+		return err
+	}
+
+	tmpFile, err := compressData(dataFile, info)
+	if err == nil {
+		if err = failpoint("compress"); err != nil {
+			os.Remove(tmpFile)
+		}
+	}
+
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+	delete(pdb.compressing, dataFile)
+	if err != nil {
+		return err
+	}
+
+	after, err := os.Stat(dataFile)
+	if os.IsNotExist(err) {
+		os.Remove(tmpFile)
+		return nil // Deleted
+	} else if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if !os.SameFile(before, after) || before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime()) {
+		os.Remove(tmpFile)
+		return nil // Got new samples, it's not cold anymore
+	}
+	return renameFile(tmpFile, dataFile)
+}
+
+// compressionSnapshot returns the info of the data file and the file itself,
+// or nil if the metric is already compressed. Legacy metrics are converted.
+// The caller must hold pdb.mu.
+func (pdb *perfDB) compressionSnapshot(dataFile string) (*dataInfo, os.FileInfo, error) {
+	if err := pdb.recoverMetric(dataFile); err != nil {
+		return nil, nil, err
+	}
+	info, err := readDataInfo(dataFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.compressed {
+		return nil, nil, nil
+	}
+	if info.legacy {
+		if err := convertLegacy(dataFile); err != nil {
+			return nil, nil, err
+		}
+		if info, err = readDataInfo(dataFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	f, err := os.Stat(dataFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return info, f, nil
+}
+
+// isCold reports whether the database has uncompressed metrics, but neither
+// samples nor writes within the given period.
+func (pdb *perfDB) isCold(dbname string, period time.Duration) (bool, error) {
+	settings, err := pdb.getSettings(dbname)
+	if err != nil {
+		return false, err
+	}
+
+	dataDir := pdb.getDirPath(dbname)
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return false, err
+	}
+
+	cutoff := time.Now().Add(-period)
+	compressed := true
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != dataFileExt {
+			continue
+		}
+		info, err := readDataInfo(filepath.Join(dataDir, f.Name()))
+		if err != nil {
+			return false, err
+		}
+		if info.compressed {
+			continue
+		}
+		compressed = false
+
+		last := convertPrecision(info.last.ts, settings.unit(), time.Nanosecond)
+		// Samples may be written long after they were taken
+		if time.Unix(0, last).After(cutoff) || f.ModTime().After(cutoff) {
+			return false, nil
+		}
+	}
+	return !compressed, nil
+}
+
+// compactColdDatabases compresses databases that are cold for the period.
+func (pdb *perfDB) compactColdDatabases(period time.Duration) error {
+	databases, err := pdb.listDatabases()
+	if err != nil {
+		return err
+	}
+
+	for _, dbname := range databases {
+		pdb.mu.Lock()
+		err := pdb.flushDatabase(dbname)
+		pdb.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		cold, err := pdb.isCold(dbname, period)
+		if err != nil {
+			return err
+		}
+		if !cold {
+			continue
+		}
+		if err := pdb.compactDatabase(dbname); err != nil {
+			return err
+		}
+		logger.Infof("Compacted %s", dbname)
+	}
+	return nil
+}
+
+// compactInBackground periodically compacts databases that are cold for the
+// period.
+func (pdb *perfDB) compactInBackground(period time.Duration) {
+	for range time.Tick(compactionInterval) {
+		if err := pdb.compactColdDatabases(period); err != nil {
+			logger.Errorf("Compaction failed: %s", err)
+		}
+	}
+}
+
+func (pdb *perfDB) getCompression(dbname string) (*CompressionReport, error) {
+	pdb.mu.Lock()
+	err := pdb.flushDatabase(dbname)
+	pdb.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := pdb.listMetrics(dbname)
+	if err != nil {
+		return nil, err
+	}
+
+	report := CompressionReport{Name: dbname, MetricStats: []*CompressionStats{}}
+	for _, metric := range metrics {
+		info, err := readDataInfo(pdb.getFilePath(dbname, metric))
+		if err != nil {
+			return nil, err
+		}
+		report.MetricStats = append(report.MetricStats, &CompressionStats{
+			Name:       metric,
+			Compressed: info.compressed,
+			Size:       info.size,
+			RawSize:    info.rawSize,
+			Ratio:      compressionRatio(info.rawSize, info.size),
+		})
+
+		report.Metrics++
+		if info.compressed {
+			report.Compressed++
+		}
+		report.Size += info.size
+		report.RawSize += info.rawSize
+	}
+	report.Ratio = compressionRatio(report.RawSize, report.Size)
+	return &report, nil
+}
+
+// checkCompressed verifies that the compressed data matches its header. The
+// metric is decompressed in repair mode, so that the text data is repaired.
+func (f *fsck) checkCompressed(dataFile string, header *dataHeader) error {
+	scan, err := scanData(dataFile)
+	switch {
+	case err != nil:
+		f.problem(dataFile, "corrupted compressed data: %s", err)
+		return nil
+	case scan.torn || len(scan.badLines) > 0 || scan.records != header.records || scan.last != header.last.ts:
+		problem := f.problem(dataFile, "compressed data doesn't match the header")
+		if !f.repair {
+			return nil
+		}
+		if err := decompressData(dataFile); err != nil {
+			return err
+		}
+		f.repaired(problem)
+		return f.checkMetric(dataFile)
+	}
+	return nil
+}
+
+// isCompressed reports whether the line is the header of a compressed file.
+func isCompressed(line string) bool {
+	return strings.HasPrefix(line, compressedHeaderPrefix)
+}
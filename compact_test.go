@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactColdDatabases(t *testing.T) {
+	storage, err := newTmpStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	storage.addSample("cold", "cpu", Sample{old.UnixNano() / 1e6, 80})
+	storage.addSample("fresh", "cpu", Sample{time.Now().UnixNano() / 1e6, 80})
+	// Old samples that were written recently
+	storage.addSample("imported", "cpu", Sample{old.UnixNano() / 1e6, 80})
+
+	for _, dbname := range []string{"cold", "fresh"} {
+		os.Chtimes(storage.getFilePath(dbname, "cpu"), old, old)
+	}
+
+	if err := storage.compactColdDatabases(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for dbname, compressed := range map[string]bool{"cold": true, "fresh": false, "imported": false} {
+		info, err := readDataInfo(storage.getFilePath(dbname, "cpu"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, compressed, info.compressed, dbname)
+	}
+
+	// Already compacted databases are not cold anymore
+	cold, err := storage.isCold("cold", 24*time.Hour)
+	assert.Nil(t, err)
+	assert.False(t, cold)
+}
+
+func TestCompactDatabaseConcurrentWrites(t *testing.T) {
+	defer func() {
+		setFailpoint(func(string) error { return nil })
+	}()
+
+	storage, err := newTmpStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.addSample("database", "cpu", Sample{1411940889515, 1})
+	storage.addSample("database", "mem", Sample{1411940889515, 10})
+
+	// Samples can be added while files are compressed
+	setFailpoint(func(name string) error {
+		if name == "compress" {
+			setFailpoint(func(string) error { return nil })
+			return storage.addSample("database", "cpu", Sample{1411940890515, 2})
+		}
+		return nil
+	})
+	if err := storage.compactDatabase("database"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The changed metric is left as is, the other one is compressed
+	for metric, compressed := range map[string]bool{"cpu": false, "mem": true} {
+		info, err := readDataInfo(storage.getFilePath("database", metric))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, compressed, info.compressed, metric)
+	}
+	stored, err := readTestSamples(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Sample{{1411940889515, 1}, {1411940890515, 2}}, stored)
+
+	_, err = os.Stat(storage.getFilePath("database", "cpu") + compressedTmpExt)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCompactDatabaseConcurrentRecovery(t *testing.T) {
+	defer func() {
+		setFailpoint(func(string) error { return nil })
+	}()
+
+	storage := newTestStorage(t)
+	storage.addSample("database", "cpu", Sample{1411940889515, 1})
+	dataFile := storage.getFilePath("database", "cpu")
+
+	// Neither fsck nor recovery removes the file being compressed
+	setFailpoint(func(name string) error {
+		if name != "compress" {
+			return nil
+		}
+		report, err := storage.fsck(true)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, []FsckProblem{}, report.Problems)
+
+		storage.mu.Lock()
+		delete(storage.recovered, dataFile)
+		err = storage.recoverMetric(dataFile)
+		storage.mu.Unlock()
+		return err
+	})
+	if err := storage.compactDatabase("database"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := readDataInfo(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, info.compressed)
+	assert.Equal(t, "[[1411940889515,1]]", getTestRawValues(newController(storage), "database", "cpu"))
+}
@@ -1,28 +1,196 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type Controller struct {
-	storage *perfDB
+	storage     Storage
+	strict      bool   // Default ingestion mode, see addSamples
+	flatten     bool   // Whether nested objects are flattened by default
+	snapshotDir string // Where snapshots are stored, see snapshot
+	cache       *resultCache
 }
 
-func newController(storage *perfDB) *Controller {
-	return &Controller{storage}
+func newController(storage Storage) *Controller {
+	return &Controller{storage: storage, cache: newResultCache(defaultCacheSize)}
+}
+
+// abortWithMessage aborts the request and explains the reason in the response body.
+func abortWithMessage(context *gin.Context, code int, err error) {
+	context.Error(err)
+	context.JSON(code, map[string]string{"error": err.Error()})
+	context.Abort()
+}
+
+// validateNames rejects requests with malformed database or metric names
+// before they reach the storage.
+func (c *Controller) validateNames(context *gin.Context) {
+	for _, param := range context.Params {
+		var err error
+		switch param.Key {
+		case "db":
+			err = validateDbName(param.Value)
+		case "metric":
+			err = validateName(param.Value)
+		}
+		if err != nil {
+			abortWithMessage(context, http.StatusBadRequest,
+				fmt.Errorf("invalid %s name %q: %v", param.Key, param.Value, err))
+			return
+		}
+	}
+}
+
+const metaQueryPrefix = "meta."
+
+var databaseOrder = map[string]func(a, b *DatabaseInfo) bool{
+	"name":           func(a, b *DatabaseInfo) bool { return a.Name < b.Name },
+	"metrics":        func(a, b *DatabaseInfo) bool { return a.Metrics < b.Metrics },
+	"size":           func(a, b *DatabaseInfo) bool { return a.Size < b.Size },
+	"firstTimestamp": func(a, b *DatabaseInfo) bool { return a.FirstTS < b.FirstTS },
+	"lastTimestamp":  func(a, b *DatabaseInfo) bool { return a.LastTS < b.LastTS },
+	"created":        func(a, b *DatabaseInfo) bool { return a.Created < b.Created },
+}
+
+func parseIntParam(context *gin.Context, name string, defaultValue int) (int, error) {
+	value := context.Query(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("%s must not be negative", name)
+	}
+	return n, err
+}
+
+func (c *Controller) filterDatabases(context *gin.Context, databases []string) ([]string, error) {
+	prefix := context.Query("prefix")
+	pattern := context.Query("match")
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	filters := map[string]string{}
+	for key, values := range context.Request.URL.Query() {
+		if strings.HasPrefix(key, metaQueryPrefix) {
+			filters[strings.TrimPrefix(key, metaQueryPrefix)] = values[0]
+		}
+	}
+
+	matched := []string{}
+	for _, dbname := range databases {
+		if !strings.HasPrefix(dbname, prefix) {
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, dbname); pattern != "" && !ok {
+			continue
+		}
+		if len(filters) > 0 {
+			meta, err := c.storage.getMeta(dbname)
+			if err != nil {
+				return nil, err
+			}
+			if !matchMeta(meta, filters) {
+				continue
+			}
+		}
+		matched = append(matched, dbname)
+	}
+	return matched, nil
 }
 
 func (c *Controller) listDatabases(context *gin.Context) {
+	sortKey := context.DefaultQuery("sort", "name")
+	descending := strings.HasPrefix(sortKey, "-")
+	less, ok := databaseOrder[strings.TrimPrefix(sortKey, "-")]
+	if !ok {
+		context.AbortWithError(http.StatusBadRequest, fmt.Errorf("unknown sort key: %s", sortKey))
+		return
+	}
+
+	offset, err := parseIntParam(context, "offset", 0)
+	if err != nil {
+		context.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	limit, err := parseIntParam(context, "limit", 0)
+	if err != nil {
+		context.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
 	databases, err := c.storage.listDatabases()
 	if err != nil {
 		context.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
-	context.JSON(http.StatusOK, databases)
+	databases, err = c.filterDatabases(context, databases)
+	if err != nil {
+		context.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	context.Header("X-Total-Count", strconv.Itoa(len(databases)))
+
+	// Names are enough to sort by name, so only the requested page is inspected
+	byName := strings.TrimPrefix(sortKey, "-") == "name"
+	if byName {
+		sort.Strings(databases)
+		if descending {
+			sort.Sort(sort.Reverse(sort.StringSlice(databases)))
+		}
+		start, end := pageBounds(len(databases), offset, limit)
+		databases = databases[start:end]
+	}
+
+	infos := []*DatabaseInfo{}
+	for _, dbname := range databases {
+		info, err := c.storage.getDatabaseInfo(dbname)
+		if err != nil {
+			context.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		infos = append(infos, info)
+	}
+
+	if !byName {
+		sort.SliceStable(infos, func(i, j int) bool {
+			if descending {
+				return less(infos[j], infos[i])
+			}
+			return less(infos[i], infos[j])
+		})
+		start, end := pageBounds(len(infos), offset, limit)
+		infos = infos[start:end]
+	}
+
+	context.JSON(http.StatusOK, infos)
+}
+
+// pageBounds returns slice bounds of the requested page, zero limit means no limit.
+func pageBounds(total, offset, limit int) (int, int) {
+	start, end := offset, total
+	if start > total {
+		start = total
+	}
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+	return start, end
 }
 
 func (c *Controller) listMetrics(context *gin.Context) {
@@ -33,7 +201,21 @@ func (c *Controller) listMetrics(context *gin.Context) {
 		return
 	}
 
-	metrics := c.storage.listMetrics(dbname)
+	if context.Query("stats") == "true" {
+		stats, err := c.storage.listMetricStats(dbname)
+		if err != nil {
+			context.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		context.JSON(http.StatusOK, stats)
+		return
+	}
+
+	metrics, err := c.storage.listMetrics(dbname)
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
 	context.JSON(http.StatusOK, metrics)
 }
 
@@ -51,12 +233,101 @@ func (c *Controller) getRawValues(context *gin.Context) {
 		return
 	}
 
-	values, err := c.storage.getRawValues(dbname, metric)
+	settings, err := c.storage.getSettings(dbname)
 	if err != nil {
 		context.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
-	context.JSON(http.StatusOK, values)
+	writeSamples(context, settings.unit(), func(unit time.Duration, fn func(Sample) error) error {
+		return c.storage.streamRawValues(dbname, metric, unit, fn)
+	})
+}
+
+// writeSamples streams samples in the requested format and precision, the
+// default precision is the given one.
+func writeSamples(context *gin.Context, unit time.Duration, stream func(unit time.Duration, fn func(Sample) error) error) {
+	if precision := context.Query("precision"); precision != "" {
+		var err error
+		if unit, err = parsePrecision(precision); err != nil {
+			abortWithMessage(context, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	format := context.Query("format")
+	writer, err := newSampleWriter(format, context.Writer)
+	if err != nil {
+		abortWithMessage(context, http.StatusBadRequest, err)
+		return
+	}
+	if format == "" {
+		format = "json"
+	}
+
+	// Samples are streamed, errors cannot change the status code after the
+	// first write, so the response starts with the first sample and later
+	// errors close the connection.
+	started := false
+	start := func() error {
+		started = true
+		context.Header("Content-Type", contentTypes[format])
+		context.Status(http.StatusOK)
+		return writer.begin()
+	}
+
+	err = stream(unit, func(sample Sample) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		return writer.write(sample)
+	})
+	if err == nil && !started {
+		err = start()
+	}
+	if err == nil {
+		err = writer.end()
+	}
+	if err != nil && !started {
+		context.AbortWithError(http.StatusInternalServerError, err)
+	} else if err != nil {
+		abortStream(context, err)
+	}
+}
+
+// abortStream closes the connection of a response that is already started, so
+// that clients see a truncated body instead of a complete one.
+func abortStream(context *gin.Context, err error) {
+	context.Error(err)
+	context.Writer.Flush()
+	// gin panics if the underlying writer cannot be hijacked
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("Failed to abort response: %v", r)
+		}
+	}()
+	conn, _, hijackErr := context.Writer.Hijack()
+	if hijackErr != nil {
+		logger.Errorf("Failed to abort response: %s", hijackErr)
+		return
+	}
+	conn.Close()
+}
+
+// summary returns a copy of the cached summary, so that it can be extended.
+func (c *Controller) summary(dbname, metric string) (map[string]interface{}, error) {
+	cached, err := c.cache.get("summary", dbname, metric, "", func() (interface{}, error) {
+		return c.storage.getSummary(dbname, metric)
+	})
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	for key, value := range cached.(map[string]interface{}) {
+		values[key] = value
+	}
+	return values, nil
 }
 
 func (c *Controller) getSummary(context *gin.Context) {
@@ -73,43 +344,100 @@ func (c *Controller) getSummary(context *gin.Context) {
 		return
 	}
 
-	values, err := c.storage.getSummary(dbname, metric)
+	values, err := c.summary(dbname, metric)
+	if err == errNoSamples {
+		abortWithMessage(context, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	annotations, err := c.storage.getAnnotations(dbname, 0, 0)
 	if err != nil {
 		context.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
+	if len(annotations) > 0 {
+		values["annotations"] = annotations
+	}
+
 	context.JSON(http.StatusOK, values)
 }
 
-func (c *Controller) addSamples(context *gin.Context) {
-	var timestamp int64
-	if customTimestamp := context.Query("ts"); customTimestamp != "" {
-		timestamp = parseTimestamp(customTimestamp)
-	} else {
-		timestamp = time.Now().UnixNano() / 1e6
-	}
+// summaryWorkers limits the number of metrics that are summarized at the
+// same time by a single request.
+var summaryWorkers = runtime.NumCPU()
 
+// getSummaries summarizes several metrics of the database, or all of them,
+// in one request. Problems with a metric are reported in place of its
+// summary.
+func (c *Controller) getSummaries(context *gin.Context) {
 	dbname := context.Param("db")
 
-	var samples map[string]interface{}
-	if err := context.BindJSON(&samples); err != nil {
-		context.AbortWithError(http.StatusBadRequest, err)
+	if err := c.storage.checkDbExists(dbname); err != nil {
+		context.AbortWithError(http.StatusNotFound, err)
 		return
 	}
 
-	for metric, rawValue := range samples {
-		value, ok := rawValue.(float64)
-		if !ok {
-			continue
+	var metrics []string
+	if param := context.Query("metrics"); param != "" {
+		seen := map[string]bool{}
+		for _, metric := range strings.Split(param, ",") {
+			if !seen[metric] {
+				seen[metric] = true
+				metrics = append(metrics, metric)
+			}
 		}
-		sample := Sample{timestamp, value}
-		if err := c.storage.addSample(dbname, metric, sample); err != nil {
+	} else {
+		var err error
+		if metrics, err = c.storage.listMetrics(dbname); err != nil {
 			context.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
 	}
 
-	context.JSON(http.StatusOK, map[string]string{"status": "ok"})
+	summaries := make([]map[string]interface{}, len(metrics))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < summaryWorkers && i < len(metrics); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				summaries[j] = c.summarizeMetric(dbname, metrics[j])
+			}
+		}()
+	}
+	for i := range metrics {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	response := map[string]map[string]interface{}{}
+	for i, metric := range metrics {
+		response[metric] = summaries[i]
+	}
+	context.JSON(http.StatusOK, response)
+}
+
+// summarizeMetric returns the summary of the metric or the error.
+func (c *Controller) summarizeMetric(dbname, metric string) map[string]interface{} {
+	if err := validateName(metric); err != nil {
+		return map[string]interface{}{"error": fmt.Sprintf("invalid metric name: %v", err)}
+	}
+	err := c.storage.checkMetricExists(dbname, metric)
+	if os.IsNotExist(err) {
+		return map[string]interface{}{"error": "metric not found"}
+	} else if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	values, err := c.summary(dbname, metric)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	return values
 }
 
 func (c *Controller) getHeatMapSVG(context *gin.Context) {
@@ -126,7 +454,16 @@ func (c *Controller) getHeatMapSVG(context *gin.Context) {
 		return
 	}
 
-	hm, err := c.storage.getHeatMap(dbname, metric)
+	cached, err := c.cache.get("heatmap", dbname, metric, "", func() (interface{}, error) {
+		return c.storage.getHeatMap(dbname, metric)
+	})
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	hm := *cached.(*heatMap)
+
+	hm.Annotations, err = c.storage.getAnnotations(dbname, hm.MinTS, hm.MaxTS)
 	if err != nil {
 		context.AbortWithError(http.StatusInternalServerError, err)
 		return
@@ -139,6 +476,454 @@ func (c *Controller) getHeatMapSVG(context *gin.Context) {
 		title = metric
 	}
 
+	meta, err := c.storage.getMetricMeta(dbname, metric)
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if meta.Unit != "" {
+		title += ", " + meta.Unit
+	}
+
+	context.Writer.Header().Set("Content-Type", "image/svg+xml")
+	generateSVG(context.Writer, &hm, title)
+}
+
+// evalExpr evaluates "q" parameter over the database. It aborts the request
+// and returns false if the expression cannot be evaluated.
+func (c *Controller) evalExpr(context *gin.Context) ([]Sample, time.Duration, bool) {
+	dbname := context.Param("db")
+
+	if err := c.storage.checkDbExists(dbname); err != nil {
+		context.AbortWithError(http.StatusNotFound, err)
+		return nil, 0, false
+	}
+
+	samples, unit, err := evalExpr(c.storage, dbname, context.Query("q"))
+	if _, ok := err.(exprError); ok {
+		abortWithMessage(context, http.StatusBadRequest, err)
+		return nil, 0, false
+	} else if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return nil, 0, false
+	}
+	return samples, unit, true
+}
+
+func (c *Controller) getExprValues(context *gin.Context) {
+	samples, exprUnit, ok := c.evalExpr(context)
+	if !ok {
+		return
+	}
+	writeSamples(context, exprUnit, func(unit time.Duration, fn func(Sample) error) error {
+		for _, sample := range samples {
+			if err := fn(Sample{convertPrecision(sample.ts, exprUnit, unit), sample.v}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *Controller) getExprSummary(context *gin.Context) {
+	samples, _, ok := c.evalExpr(context)
+	if !ok {
+		return
+	}
+	if len(samples) == 0 {
+		abortWithMessage(context, http.StatusNotFound, errNoSamples)
+		return
+	}
+
+	values := make([]float64, 0, len(samples))
+	for _, sample := range samples {
+		values = append(values, sample.v)
+	}
+	context.JSON(http.StatusOK, summarize(values))
+}
+
+func (c *Controller) getExprHeatMapSVG(context *gin.Context) {
+	samples, unit, ok := c.evalExpr(context)
+	if !ok {
+		return
+	}
+	if len(samples) == 0 {
+		abortWithMessage(context, http.StatusNotFound, errNoSamples)
+		return
+	}
+
+	title := context.Query("q")
+	if label := context.Query("label"); label != "" {
+		title = label
+	}
+
 	context.Writer.Header().Set("Content-Type", "image/svg+xml")
-	generateSVG(context.Writer, hm, title)
+	generateSVG(context.Writer, buildHeatMap(samples, unit), title)
+}
+
+// runQuery runs the query from "q" parameter or from the request body.
+func (c *Controller) runQuery(context *gin.Context) {
+	query := context.Query("q")
+	if query == "" && context.Request.Method == "POST" {
+		body, err := ioutil.ReadAll(context.Request.Body)
+		if err != nil {
+			context.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		query = string(body)
+	}
+
+	plan, err := parseQuery(query, time.Now())
+	if err != nil {
+		abortWithMessage(context, http.StatusBadRequest, err)
+		return
+	}
+	result, err := plan.execute(c.storage)
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	context.JSON(http.StatusOK, result)
+}
+
+func (c *Controller) getMeta(context *gin.Context) {
+	dbname := context.Param("db")
+
+	if err := c.storage.checkDbExists(dbname); err != nil {
+		context.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+
+	meta, err := c.storage.getMeta(dbname)
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	context.JSON(http.StatusOK, meta)
+}
+
+func (c *Controller) setMeta(context *gin.Context) {
+	dbname := context.Param("db")
+
+	var meta map[string]interface{}
+	if err := context.BindJSON(&meta); err != nil {
+		context.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if err := c.storage.setMeta(dbname, meta); err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	context.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// setMetaByPath serves "PUT /:db/meta" as well as "/_db/:db/meta". Metrics are
+// never written with PUT, so the path doesn't shadow a metric named "meta".
+func (c *Controller) setMetaByPath(context *gin.Context) {
+	if context.Param("metric") != "meta" {
+		context.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.setMeta(context)
+}
+
+func (c *Controller) getSettings(context *gin.Context) {
+	dbname := context.Param("db")
+
+	if err := c.storage.checkDbExists(dbname); err != nil {
+		context.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+
+	settings, err := c.storage.getSettings(dbname)
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	context.JSON(http.StatusOK, settings)
+}
+
+func (c *Controller) setSettings(context *gin.Context) {
+	dbname := context.Param("db")
+
+	settings := defaultSettings
+	if err := context.BindJSON(&settings); err != nil {
+		context.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		abortWithMessage(context, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := c.storage.setSettings(dbname, settings); err == errPrecisionChange {
+		abortWithMessage(context, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.cache.invalidate(dbname, "")
+	context.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (c *Controller) exportDatabase(context *gin.Context) {
+	dbname := context.Param("db")
+
+	storage, ok := c.storage.(archiver)
+	if !ok {
+		abortWithMessage(context, http.StatusNotImplemented, errUnsupported)
+		return
+	}
+
+	if err := c.storage.checkDbExists(dbname); err != nil {
+		context.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+
+	// The archive is streamed, errors cannot change the status code after
+	// the first write, so they are only logged.
+	context.Header("Content-Type", "application/gzip")
+	context.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.tar.gz\"", escapeName(dbname)))
+	context.Status(http.StatusOK)
+
+	if err := storage.exportDatabase(dbname, context.Writer); err != nil {
+		context.Error(err)
+	}
+}
+
+func (c *Controller) importDatabase(context *gin.Context) {
+	storage, ok := c.storage.(archiver)
+	if !ok {
+		abortWithMessage(context, http.StatusNotImplemented, errUnsupported)
+		return
+	}
+
+	name := context.Query("name")
+	if name != "" {
+		if err := validateDbName(name); err != nil {
+			abortWithMessage(context, http.StatusBadRequest, fmt.Errorf("invalid db name %q: %s", name, err))
+			return
+		}
+	}
+
+	var rename bool
+	switch conflict := context.Query("conflict"); conflict {
+	case "", "fail":
+	case "rename":
+		rename = true
+	default:
+		abortWithMessage(context, http.StatusBadRequest, fmt.Errorf("conflict must be \"fail\" or \"rename\", got %q", conflict))
+		return
+	}
+
+	dbname, err := storage.importDatabase(context.Request.Body, name, rename)
+	if _, ok := err.(archiveError); ok {
+		abortWithMessage(context, http.StatusBadRequest, err)
+		return
+	} else if err == errDatabaseExists {
+		abortWithMessage(context, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.cache.invalidate(dbname, "")
+	context.JSON(http.StatusOK, map[string]string{"status": "ok", "name": dbname})
+}
+
+func (c *Controller) createSnapshot(context *gin.Context) {
+	storage, ok := c.storage.(snapshotter)
+	if !ok {
+		abortWithMessage(context, http.StatusNotImplemented, errUnsupported)
+		return
+	}
+
+	snapshot, err := storage.snapshot(c.snapshotDir)
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	context.JSON(http.StatusOK, snapshot)
+}
+
+func (c *Controller) listSnapshots(context *gin.Context) {
+	snapshots, err := listSnapshots(c.snapshotDir)
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	context.JSON(http.StatusOK, snapshots)
+}
+
+func (c *Controller) getCacheStats(context *gin.Context) {
+	context.JSON(http.StatusOK, c.cache.stats())
+}
+
+func (c *Controller) checkStorage(context *gin.Context) {
+	storage, ok := c.storage.(checker)
+	if !ok {
+		abortWithMessage(context, http.StatusNotImplemented, errUnsupported)
+		return
+	}
+
+	report, err := storage.fsck(false)
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	context.JSON(http.StatusOK, report)
+}
+
+func (c *Controller) repairStorage(context *gin.Context) {
+	storage, ok := c.storage.(checker)
+	if !ok {
+		abortWithMessage(context, http.StatusNotImplemented, errUnsupported)
+		return
+	}
+
+	report, err := storage.fsck(true)
+	c.cache.invalidate("", "")
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	context.JSON(http.StatusOK, report)
+}
+
+func (c *Controller) getCompression(context *gin.Context) {
+	dbname := context.Param("db")
+
+	storage, ok := c.storage.(compactor)
+	if !ok {
+		abortWithMessage(context, http.StatusNotImplemented, errUnsupported)
+		return
+	}
+
+	if err := c.storage.checkDbExists(dbname); err != nil {
+		context.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+
+	report, err := storage.getCompression(dbname)
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	context.JSON(http.StatusOK, report)
+}
+
+func (c *Controller) compactDatabase(context *gin.Context) {
+	dbname := context.Param("db")
+
+	storage, ok := c.storage.(compactor)
+	if !ok {
+		abortWithMessage(context, http.StatusNotImplemented, errUnsupported)
+		return
+	}
+
+	if err := c.storage.checkDbExists(dbname); err != nil {
+		context.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+
+	if err := storage.compactDatabase(dbname); err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.getCompression(context)
+}
+
+func (c *Controller) addAnnotation(context *gin.Context) {
+	dbname := context.Param("db")
+
+	settings, err := c.storage.getSettings(dbname)
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	timestamp := now(settings.unit())
+	if customTimestamp := context.Query("ts"); customTimestamp != "" {
+		timestamp = parseTimestamp(customTimestamp, settings.unit())
+	}
+
+	var annotation Annotation
+	if err := context.BindJSON(&annotation); err != nil {
+		context.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if annotation.Text == "" {
+		context.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	annotation.Timestamp = timestamp
+
+	if err := c.storage.addAnnotation(dbname, annotation); err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	context.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (c *Controller) getAnnotations(context *gin.Context) {
+	dbname := context.Param("db")
+
+	if err := c.storage.checkDbExists(dbname); err != nil {
+		context.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+
+	var bounds [2]int64
+	for i, param := range []string{"from", "to"} {
+		if value := context.Query(param); value != "" {
+			var err error
+			if bounds[i], err = strconv.ParseInt(value, 10, 64); err != nil {
+				context.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+		}
+	}
+
+	annotations, err := c.storage.getAnnotations(dbname, bounds[0], bounds[1])
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	context.JSON(http.StatusOK, annotations)
+}
+
+func (c *Controller) getMetricMeta(context *gin.Context) {
+	dbname := context.Param("db")
+	metric := context.Param("metric")
+
+	if err := c.storage.checkDbExists(dbname); err != nil {
+		context.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+
+	meta, err := c.storage.getMetricMeta(dbname, metric)
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	context.JSON(http.StatusOK, meta)
+}
+
+func (c *Controller) setMetricMeta(context *gin.Context) {
+	dbname := context.Param("db")
+	metric := context.Param("metric")
+
+	var meta MetricMeta
+	if err := context.BindJSON(&meta); err != nil {
+		context.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	if err := c.storage.setMetricMeta(dbname, metric, meta); err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	context.JSON(http.StatusOK, map[string]string{"status": "ok"})
 }
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -32,6 +42,23 @@ func newTmpStorage() (*perfDB, error) {
 	return storage, nil
 }
 
+// newTestStorage is newTmpStorage for tests that keep reading files after the
+// last use of the storage: the directory is removed when the test finishes
+// rather than when the storage is collected.
+func newTestStorage(t *testing.T) *perfDB {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	storage, err := newPerfDB(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
 func TestListDatabases(t *testing.T) {
 	var err error
 	var storage *perfDB
@@ -202,6 +229,97 @@ func TestGetRawValuesMissingMetric(t *testing.T) {
 	assert.Equal(t, "", rw.Body.String())
 }
 
+func TestGetRawValuesCorrupted(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	addTestSample(controller, "database", "?ts=1411940889515", "{\"cpu\":80}")
+	dataFile := storage.getFilePath("database", "cpu")
+	if err := ioutil.WriteFile(dataFile, []byte("#perfdb 1 1411940889515 1411940889515\nbroken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing was written yet, so the error is reported
+	for _, format := range []string{"json", "csv"} {
+		req, _ := http.NewRequest("GET", "/database/cpu?format="+format, nil)
+		rw := httptest.NewRecorder()
+		newRouter(controller).ServeHTTP(rw, req)
+
+		assert.Equal(t, http.StatusInternalServerError, rw.Code, format)
+		assert.Equal(t, "", rw.Body.String(), format)
+	}
+}
+
+func TestGetRawValuesCorruptedMidStream(t *testing.T) {
+	storage := newTestStorage(t)
+	controller := newController(storage)
+
+	addTestSample(controller, "database", "?ts=1411940889515", "{\"cpu\":80}")
+	dataFile := storage.getFilePath("database", "cpu")
+	if err := ioutil.WriteFile(dataFile, []byte("#perfdb 1 1411940889515 1411940889515\n0 80\nbroken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(newRouter(controller))
+	defer server.Close()
+
+	// The response is already started, so it's cut off
+	for _, format := range []string{"json", "csv"} {
+		resp, err := http.Get(server.URL + "/database/cpu?format=" + format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode, format)
+		assert.Equal(t, io.ErrUnexpectedEOF, err, format)
+	}
+}
+
+func TestGetCorruptedMultipleBadRecords(t *testing.T) {
+	storage := newTestStorage(t)
+	controller := newController(storage)
+
+	addTestSample(controller, "database", "?ts=1411940889515", "{\"cpu\":80}")
+	dataFile := storage.getFilePath("database", "cpu")
+	data := "#perfdb 1 1411940889515 1411940889515\nbroken\n0 80\nworse\n1000 70\n"
+	if err := ioutil.WriteFile(dataFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/database/cpu", "/database/cpu/summary", "/database/cpu/heatmap"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		rw := httptest.NewRecorder()
+		newRouter(controller).ServeHTTP(rw, req)
+
+		assert.Equal(t, http.StatusInternalServerError, rw.Code, path)
+	}
+}
+
+func TestGetSummaryHeaderOnly(t *testing.T) {
+	storage := newTestStorage(t)
+	controller := newController(storage)
+
+	addTestSample(controller, "database", "?ts=1411940889515", "{\"cpu\":80}")
+	dataFile := storage.getFilePath("database", "cpu")
+	if err := ioutil.WriteFile(dataFile, []byte("#perfdb 1 1411940889515 1411940889515\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/database/cpu/summary", nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+	assert.Equal(t, "{\"error\":\"metric has no samples\"}", rw.Body.String())
+}
+
 func TestGetSummary(t *testing.T) {
 	var err error
 	var storage *perfDB
@@ -450,3 +568,1398 @@ func TestGetHeatmapMissingMetric(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, rw.Code)
 	assert.Equal(t, "", rw.Body.String())
 }
+
+func TestGetUI(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	req, _ := http.NewRequest("GET", "/_ui", nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rw.Header().Get("Content-Type"))
+	assert.Contains(t, rw.Body.String(), "<title>perfdb</title>")
+}
+
+func TestSetMeta(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	req, _ := http.NewRequest("PUT", "/_db/database/meta",
+		bytes.NewBufferString("{\"build\":\"5.0.0-1234\",\"nodes\":4}"))
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "{\"status\":\"ok\"}", rw.Body.String())
+
+	req, _ = http.NewRequest("GET", "/_db/database/meta", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "{\"build\":\"5.0.0-1234\",\"nodes\":4}", rw.Body.String())
+
+	// The path of metrics is accepted for PUT requests to "meta" only
+	req, _ = http.NewRequest("PUT", "/database/meta", bytes.NewBufferString("{\"build\":\"5.0.0-1235\"}"))
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	req, _ = http.NewRequest("PUT", "/database/cpu", bytes.NewBufferString("{}"))
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+
+	req, _ = http.NewRequest("GET", "/_db/database/meta", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	assert.Equal(t, "{\"build\":\"5.0.0-1235\"}", rw.Body.String())
+}
+
+func TestGetMetaMissingDatabase(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	req, _ := http.NewRequest("GET", "/_db/database/meta", nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+	assert.Equal(t, "", rw.Body.String())
+}
+
+func TestListDatabasesByMeta(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	req, _ := http.NewRequest("PUT", "/_db/run1/meta",
+		bytes.NewBufferString("{\"build\":\"1234\",\"nodes\":4}"))
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	req, _ = http.NewRequest("PUT", "/_db/run2/meta",
+		bytes.NewBufferString("{\"build\":\"1235\",\"nodes\":4}"))
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	req, _ = http.NewRequest("GET", "/?meta.nodes=4&meta.build=1235", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("X-Total-Count"))
+	assert.Contains(t, rw.Body.String(), "\"name\":\"run2\"")
+	assert.NotContains(t, rw.Body.String(), "\"name\":\"run1\"")
+}
+
+func TestAddAnnotation(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	req, _ := http.NewRequest("POST", "/_db/database/annotations?ts=1411940890515",
+		bytes.NewBufferString("{\"text\":\"node failed\"}"))
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	req, _ = http.NewRequest("POST", "/_db/database/annotations?ts=1411940889515",
+		bytes.NewBufferString("{\"text\":\"compaction started\"}"))
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	req, _ = http.NewRequest("GET", "/_db/database/annotations", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t,
+		"[{\"ts\":1411940889515,\"text\":\"compaction started\"},{\"ts\":1411940890515,\"text\":\"node failed\"}]",
+		rw.Body.String())
+
+	req, _ = http.NewRequest("GET", "/_db/database/annotations?from=1411940890000", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "[{\"ts\":1411940890515,\"text\":\"node failed\"}]", rw.Body.String())
+}
+
+func TestAddAnnotationNoText(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	req, _ := http.NewRequest("POST", "/_db/database/annotations",
+		bytes.NewBufferString("{}"))
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestGetHeatmapWithAnnotations(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	req, _ := http.NewRequest("POST", "/database?ts=1411940889515",
+		bytes.NewBufferString("{\"cpu\":80}"))
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	req, _ = http.NewRequest("POST", "/database?ts=1411940891515",
+		bytes.NewBufferString("{\"cpu\":75.11}"))
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	req, _ = http.NewRequest("POST", "/_db/database/annotations?ts=1411940890515",
+		bytes.NewBufferString("{\"text\":\"node <1> failed\"}"))
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	req, _ = http.NewRequest("GET", "/database/cpu/summary", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), "\"annotations\":[{\"ts\":1411940890515,\"text\":\"node \\u003c1\\u003e failed\"}]")
+
+	req, _ = http.NewRequest("GET", "/database/cpu/heatmap", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), "node &lt;1&gt; failed</text>")
+}
+
+func addTestSample(controller *Controller, dbname, query, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/"+dbname+query, bytes.NewBufferString(body))
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	return rw
+}
+
+func listTestDatabases(t *testing.T, controller *Controller, query string) ([]DatabaseInfo, *httptest.ResponseRecorder) {
+	req, _ := http.NewRequest("GET", "/"+query, nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	var databases []DatabaseInfo
+	if rw.Code == http.StatusOK {
+		if err := json.Unmarshal(rw.Body.Bytes(), &databases); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return databases, rw
+}
+
+func TestListDatabasesInfo(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	addTestSample(controller, "database", "?ts=1411940889515", "{\"cpu\":80,\"mem\":1024}")
+	addTestSample(controller, "database", "?ts=1411940890515", "{\"cpu\":75}")
+
+	// Stray files are not databases
+	ioutil.WriteFile(filepath.Join(storage.baseDir, "README"), []byte("stray"), 0644)
+
+	databases, rw := listTestDatabases(t, controller, "")
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("X-Total-Count"))
+	assert.Len(t, databases, 1)
+	assert.Equal(t, "database", databases[0].Name)
+	assert.Equal(t, 2, databases[0].Metrics)
+	assert.Equal(t, int64(1411940889515), databases[0].FirstTS)
+	assert.Equal(t, int64(1411940890515), databases[0].LastTS)
+	assert.True(t, databases[0].Size > 0)
+	assert.True(t, databases[0].Created > 0)
+}
+
+func TestListDatabasesPagination(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	for _, dbname := range []string{"run-1", "run-2", "run-3", "build-1"} {
+		addTestSample(controller, dbname, "", "{\"cpu\":80}")
+	}
+
+	databases, rw := listTestDatabases(t, controller, "?prefix=run-&sort=-name&offset=1&limit=1")
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "3", rw.Header().Get("X-Total-Count"))
+	assert.Len(t, databases, 1)
+	assert.Equal(t, "run-2", databases[0].Name)
+
+	databases, rw = listTestDatabases(t, controller, "?match=*-1&offset=5")
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "2", rw.Header().Get("X-Total-Count"))
+	assert.Equal(t, "[]", rw.Body.String())
+}
+
+func TestListDatabasesSortBySize(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	addTestSample(controller, "small", "", "{\"cpu\":80}")
+	addTestSample(controller, "large", "", "{\"cpu\":80,\"mem\":1024,\"disk\":10}")
+	addTestSample(controller, "medium", "", "{\"cpu\":80,\"mem\":1024}")
+
+	databases, rw := listTestDatabases(t, controller, "?sort=-size&limit=2")
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "3", rw.Header().Get("X-Total-Count"))
+	assert.Len(t, databases, 2)
+	assert.Equal(t, "large", databases[0].Name)
+	assert.Equal(t, "medium", databases[1].Name)
+}
+
+func TestListDatabasesBadParams(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	for _, query := range []string{"?sort=color", "?limit=-1", "?offset=first", "?match=[a-"} {
+		_, rw := listTestDatabases(t, controller, query)
+		assert.Equal(t, http.StatusBadRequest, rw.Code, query)
+	}
+}
+
+func TestListMetricStats(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	addTestSample(controller, "database", "?ts=1411940889515", "{\"latency\":12.5}")
+	addTestSample(controller, "database", "?ts=1411940890515", "{\"latency\":10}")
+	addTestSample(controller, "database", "?ts=1411940891515", "{\"latency\":7.25}")
+
+	req, _ := http.NewRequest("PUT", "/database/latency/meta",
+		bytes.NewBufferString("{\"unit\":\"ms\",\"description\":\"Read latency\"}"))
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	req, _ = http.NewRequest("GET", "/database?stats=true", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	var metrics []MetricStats
+	if err := json.Unmarshal(rw.Body.Bytes(), &metrics); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, "latency", metrics[0].Name)
+	assert.Equal(t, "ms", metrics[0].Unit)
+	assert.Equal(t, "Read latency", metrics[0].Description)
+	assert.Equal(t, 3, metrics[0].Count)
+	assert.Equal(t, int64(1411940889515), metrics[0].FirstTS)
+	assert.Equal(t, int64(1411940891515), metrics[0].LastTS)
+	assert.Equal(t, 7.25, metrics[0].LastValue)
+	assert.True(t, metrics[0].Size > 0)
+}
+
+func TestGetMetricMeta(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	req, _ := http.NewRequest("PUT", "/database/cpu/meta",
+		bytes.NewBufferString("{\"unit\":\"%\"}"))
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	req, _ = http.NewRequest("GET", "/database/cpu/meta", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "{\"unit\":\"%\"}", rw.Body.String())
+
+	req, _ = http.NewRequest("GET", "/database/mem/meta", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "{}", rw.Body.String())
+}
+
+func TestGetHeatmapWithUnit(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	addTestSample(controller, "database", "?ts=1411940889515", "{\"cpu\":80}")
+	addTestSample(controller, "database", "?ts=1411940890515", "{\"cpu\":75.11}")
+
+	req, _ := http.NewRequest("PUT", "/database/cpu/meta",
+		bytes.NewBufferString("{\"unit\":\"%\"}"))
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	req, _ = http.NewRequest("GET", "/database/cpu/heatmap?label=CPU", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), ">CPU, %</text>")
+}
+
+func TestAddSampleHostileMetric(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	rw := addTestSample(controller, "database", "", "{\"cpu\":1,\"bad\\nname\":2}")
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Equal(t,
+		"{\"status\":\"error\",\"errors\":[{\"field\":\"bad\\nname\",\"error\":\"invalid metric name: name must not contain U+000A\"}]}",
+		rw.Body.String())
+
+	// Nothing is stored if any name is invalid
+	databases, _ := storage.listDatabases()
+	assert.Equal(t, []string{}, databases)
+}
+
+func TestAddSampleEscapedNames(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	rw := addTestSample(controller, "my%20database", "",
+		"{\"../../etc/x\":1,\"read/write\":2,\"задержка\":3}")
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	// Everything stays inside of the database directory
+	files, _ := filepath.Glob(filepath.Join(storage.baseDir, "*"))
+	assert.Equal(t, []string{filepath.Join(storage.baseDir, "my database")}, files)
+
+	req, _ := http.NewRequest("GET", "/my%20database", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "[\"../../etc/x\",\"read/write\",\"задержка\"]", rw.Body.String())
+
+	req, _ = http.NewRequest("GET", "/my%20database/read%2Fwrite/summary", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), "\"max\":2")
+}
+
+func TestAddSampleLongEscapedNames(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	// 100 slashes are 300 bytes on disk
+	slashes := strings.Repeat("/", 100)
+	rw := addTestSample(controller, "database", "", "{\""+slashes+"\":1}")
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Contains(t, rw.Body.String(), "special characters encoded")
+
+	rw = addTestSample(controller, url.PathEscape(slashes), "", "{\"cpu\":1}")
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	databases, _ := storage.listDatabases()
+	assert.Equal(t, []string{}, databases)
+}
+
+func TestReservedDatabaseName(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	req, _ := http.NewRequest("PUT", "/_db/_hidden/meta", bytes.NewBufferString("{}"))
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Contains(t, rw.Body.String(), "must not start with")
+}
+
+func TestAddSamplesLenient(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	rw := addTestSample(controller, "database", "?ts=1411940889515",
+		"{\"cpu\":99,\"host\":\"node1\",\"ok\":true,\"disk\":{\"used\":1},\"mem\":null}")
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t,
+		"{\"status\":\"ok\",\"dropped\":["+
+			"{\"field\":\"disk\",\"error\":\"expected a number, got object\"},"+
+			"{\"field\":\"host\",\"error\":\"expected a number, got string\"},"+
+			"{\"field\":\"mem\",\"error\":\"expected a number, got null\"},"+
+			"{\"field\":\"ok\",\"error\":\"expected a number, got boolean\"}]}",
+		rw.Body.String())
+
+	metrics, _ := storage.listMetrics("database")
+	assert.Equal(t, []string{"cpu"}, metrics)
+}
+
+func TestAddSamplesLenientBadTimestamp(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	rw := addTestSample(controller, "database", "?ts=yesterday", "{\"cpu\":99}")
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Equal(t,
+		"{\"status\":\"error\",\"errors\":[{\"field\":\"ts\",\"error\":\"timestamp must be an integer\"}]}",
+		rw.Body.String())
+
+	// Nothing is stored at a different time
+	databases, _ := storage.listDatabases()
+	assert.Equal(t, []string{}, databases)
+}
+
+func TestAddSamplesStrict(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	rw := addTestSample(controller, "database", "?mode=strict&ts=123",
+		"{\"cpu\":99,\"host\":\"node1\",\"ops\":[1,[2]]}")
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Equal(t,
+		"{\"status\":\"error\",\"errors\":["+
+			"{\"field\":\"ts\",\"error\":\""+errTimestampRange.Error()+"\"},"+
+			"{\"field\":\"host\",\"error\":\"expected a number, got string\"},"+
+			"{\"field\":\"ops[1]\",\"error\":\"expected a number, got array\"}]}",
+		rw.Body.String())
+
+	databases, _ := storage.listDatabases()
+	assert.Equal(t, []string{}, databases)
+
+	rw = addTestSample(controller, "database", "?mode=strict", "{\"cpu\":99}")
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "{\"status\":\"ok\"}", rw.Body.String())
+}
+
+func TestAddSamplesStrictByDefault(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+	controller.strict = true
+
+	rw := addTestSample(controller, "database", "", "{\"host\":\"node1\"}")
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	rw = addTestSample(controller, "database", "?mode=lenient", "{\"host\":\"node1\"}")
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	rw = addTestSample(controller, "database", "?mode=careless", "{\"host\":\"node1\"}")
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestAddSamplesArray(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	rw := addTestSample(controller, "database", "?ts=1411940889515", "{\"latency\":[1.5,2,\"3\",0.5]}")
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t,
+		"{\"status\":\"ok\",\"dropped\":[{\"field\":\"latency[2]\",\"error\":\"expected a number, got string\"}]}",
+		rw.Body.String())
+
+	req, _ := http.NewRequest("GET", "/database/latency", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "[[1411940889515,1.5],[1411940889515,2],[1411940889515,0.5]]", rw.Body.String())
+}
+
+func TestAddSamplesFlatten(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	rw := addTestSample(controller, "database", "?flatten=true",
+		"{\"latency\":{\"read\":1.2,\"write\":3.4,\"ops\":[1,2],\"node\":{\"id\":\"n1\"}},\"cpu\":50}")
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t,
+		"{\"status\":\"ok\",\"dropped\":[{\"field\":\"latency.node.id\",\"error\":\"expected a number, got string\"}]}",
+		rw.Body.String())
+
+	metrics, _ := storage.listMetrics("database")
+	assert.Equal(t, []string{"cpu", "latency.ops", "latency.read", "latency.write"}, metrics)
+
+	rw = addTestSample(controller, "database", "?flatten=true&separator=/", "{\"disk\":{\"sda\":10}}")
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	metrics, _ = storage.listMetrics("database")
+	assert.Contains(t, metrics, "disk/sda")
+}
+
+func TestAddSamplesFlattenDisabled(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+	controller.flatten = true
+
+	rw := addTestSample(controller, "database", "?flatten=false", "{\"latency\":{\"read\":1.2}}")
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t,
+		"{\"status\":\"ok\",\"dropped\":[{\"field\":\"latency\",\"error\":\"expected a number, got object\"}]}",
+		rw.Body.String())
+
+	rw = addTestSample(controller, "database", "?separator=", "{\"latency\":{\"read\":1.2}}")
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	rw = addTestSample(controller, "database", "?flatten=yes", "{\"latency\":{\"read\":1.2}}")
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func setTestSettings(controller *Controller, dbname, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("PUT", "/_db/"+dbname+"/settings", bytes.NewBufferString(body))
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	return rw
+}
+
+func getTestRawValues(controller *Controller, dbname, metric string) string {
+	req, _ := http.NewRequest("GET", "/"+dbname+"/"+metric, nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	return rw.Body.String()
+}
+
+func TestSettings(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	req, _ := http.NewRequest("GET", "/_db/database/settings", nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+
+	rw = setTestSettings(controller, "database", "{\"reorderWindow\":5000}")
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	req, _ = http.NewRequest("GET", "/_db/database/settings", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "{\"reorderWindow\":5000,\"outOfOrder\":\"accept\",\"duplicates\":\"keep\",\"precision\":\"ms\"}", rw.Body.String())
+}
+
+func TestSettingsInvalid(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	rw := setTestSettings(controller, "database", "{\"reorderWindow\":-1}")
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Equal(t, "{\"error\":\"reorderWindow must not be negative\"}", rw.Body.String())
+
+	rw = setTestSettings(controller, "database", "{\"outOfOrder\":\"sort\"}")
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	rw = setTestSettings(controller, "database", "{\"duplicates\":\"average\"}")
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	databases, _ := storage.listDatabases()
+	assert.Equal(t, []string{}, databases)
+}
+
+func TestReorderWindow(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+	setTestSettings(controller, "database", "{\"reorderWindow\":1000}")
+
+	for _, sample := range []string{"2000:2", "1500:1.5", "3000:3", "1000:1", "2500:2.5"} {
+		rw := addTestSample(controller, "database", "?ts=141194088"+sample[:4], "{\"cpu\":"+sample[5:]+"}")
+		assert.Equal(t, http.StatusOK, rw.Code)
+	}
+
+	// The oldest sample arrived when the first two had left the window
+	assert.Equal(t, "[[1411940881500,1.5],[1411940882000,2],[1411940881000,1],[1411940882500,2.5],[1411940883000,3]]",
+		getTestRawValues(controller, "database", "cpu"))
+}
+
+func TestRejectOutOfOrder(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+	setTestSettings(controller, "database", "{\"outOfOrder\":\"reject\"}")
+
+	addTestSample(controller, "database", "?ts=1411940882000", "{\"cpu\":2}")
+
+	rw := addTestSample(controller, "database", "?ts=1411940881000", "{\"cpu\":1,\"mem\":1}")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t,
+		"{\"status\":\"ok\",\"dropped\":[{\"field\":\"cpu\",\"error\":\""+errOutOfOrder.Error()+"\"}]}",
+		rw.Body.String())
+
+	rw = addTestSample(controller, "database", "?ts=1411940881500&mode=strict", "{\"cpu\":1.5,\"mem\":1.5}")
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Equal(t,
+		"{\"status\":\"error\",\"errors\":[{\"field\":\"cpu\",\"error\":\""+errOutOfOrder.Error()+"\"}]}",
+		rw.Body.String())
+
+	assert.Equal(t, "[[1411940882000,2]]", getTestRawValues(controller, "database", "cpu"))
+	assert.Equal(t, "[[1411940881000,1]]", getTestRawValues(controller, "database", "mem"))
+}
+
+func TestDuplicates(t *testing.T) {
+	expected := map[string]string{
+		"keep":  "[[1411940881000,1],[1411940882000,2],[1411940882000,3]]",
+		"first": "[[1411940881000,1],[1411940882000,2]]",
+		"last":  "[[1411940881000,1],[1411940882000,3]]",
+	}
+
+	for policy, values := range expected {
+		for _, window := range []string{"0", "5000"} {
+			var err error
+			var storage *perfDB
+			if storage, err = newTmpStorage(); err != nil {
+				t.Fatal(err)
+			}
+
+			controller := newController(storage)
+			setTestSettings(controller, "database",
+				"{\"duplicates\":\""+policy+"\",\"reorderWindow\":"+window+"}")
+
+			addTestSample(controller, "database", "?ts=1411940881000", "{\"cpu\":1}")
+			addTestSample(controller, "database", "?ts=1411940882000", "{\"cpu\":2}")
+			addTestSample(controller, "database", "?ts=1411940882000", "{\"cpu\":3}")
+
+			assert.Equal(t, values, getTestRawValues(controller, "database", "cpu"), policy+", window "+window)
+		}
+	}
+}
+
+func TestGetHeatmapOutOfOrder(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	addTestSample(controller, "database", "?ts=1411940882000", "{\"cpu\":2}")
+	addTestSample(controller, "database", "?ts=1411940881000", "{\"cpu\":1}")
+	addTestSample(controller, "database", "?ts=1411940883000", "{\"cpu\":3}")
+
+	hm, err := storage.getHeatMap("database", "cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(1411940881000), hm.MinTS)
+	assert.Equal(t, int64(1411940883000), hm.MaxTS)
+}
+
+func TestGetHeatmapSingleSample(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	addTestSample(controller, "database", "?ts=1411940881000", "{\"cpu\":80}")
+
+	req, _ := http.NewRequest("GET", "/database/cpu/heatmap", nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	hm, err := storage.getHeatMap("database", "cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, hm.MinTS, hm.MaxTS)
+	assert.Equal(t, 1, hm.Map[heatMapHeight-1][0])
+}
+
+func TestGetHeatmapNonPositive(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	addTestSample(controller, "database", "?ts=1411940881000", "{\"cpu\":0,\"delta\":-4}")
+	addTestSample(controller, "database", "?ts=1411940882000", "{\"cpu\":0,\"delta\":-2}")
+	addTestSample(controller, "database", "?ts=1411940883000", "{\"cpu\":0,\"delta\":0}")
+
+	for _, metric := range []string{"cpu", "delta"} {
+		req, _ := http.NewRequest("GET", "/database/"+metric+"/heatmap", nil)
+		rw := httptest.NewRecorder()
+		newRouter(controller).ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusOK, rw.Code, metric)
+	}
+
+	hm, err := storage.getHeatMap("database", "cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, hm.Map[0][0]+hm.Map[0][heatMapWidth/2]+hm.Map[0][heatMapWidth-1])
+
+	hm, err = storage.getHeatMap("database", "delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, -4.0, hm.MinValue)
+	assert.Equal(t, 0.0, hm.MaxValue)
+	assert.Equal(t, 1, hm.Map[0][0])
+	assert.Equal(t, 1, hm.Map[heatMapHeight/2][heatMapWidth/2])
+	assert.Equal(t, 1, hm.Map[heatMapHeight-1][heatMapWidth-1])
+}
+
+func TestNanosecondPrecision(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+	rw := setTestSettings(controller, "database", "{\"precision\":\"ns\"}")
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	addTestSample(controller, "database", "?ts=1411940889515410774", "{\"cpu\":1}")
+	addTestSample(controller, "database", "?ts=1411940889515410775", "{\"cpu\":2}")
+	addTestSample(controller, "database", "?ts=1411940889516", "{\"cpu\":3}")
+
+	assert.Equal(t, "[[1411940889515410774,1],[1411940889515410775,2],[1411940889516000000,3]]",
+		getTestRawValues(controller, "database", "cpu"))
+	assert.Equal(t, "[[1411940889515410,1],[1411940889515410,2],[1411940889516000,3]]",
+		getTestRawValues(controller, "database", "cpu?precision=us"))
+	assert.Equal(t, "[[1411940889515,1],[1411940889515,2],[1411940889516,3]]",
+		getTestRawValues(controller, "database", "cpu?precision=ms"))
+
+	req, _ := http.NewRequest("GET", "/database/cpu?precision=ps", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	databases, _ := listTestDatabases(t, controller, "")
+	assert.Equal(t, int64(1411940889515), databases[0].FirstTS)
+	assert.Equal(t, int64(1411940889516), databases[0].LastTS)
+}
+
+func TestPrecisionChange(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	rw := setTestSettings(controller, "database", "{\"precision\":\"ps\"}")
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	rw = setTestSettings(controller, "database", "{\"precision\":\"us\"}")
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	addTestSample(controller, "database", "", "{\"cpu\":1}")
+
+	rw = setTestSettings(controller, "database", "{\"precision\":\"ms\"}")
+	assert.Equal(t, http.StatusConflict, rw.Code)
+	assert.Equal(t, "{\"error\":\""+errPrecisionChange.Error()+"\"}", rw.Body.String())
+
+	rw = setTestSettings(controller, "database", "{\"precision\":\"us\",\"duplicates\":\"last\"}")
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
+
+func TestGetRawValuesFormats(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	addTestSample(controller, "database", "?ts=1411940889515", "{\"cpu\":99}")
+	addTestSample(controller, "database", "?ts=1411940890615", "{\"cpu\":0.5}")
+
+	expected := map[string]string{
+		"json":   "[[1411940889515,99],[1411940890615,0.5]]",
+		"ndjson": "{\"ts\":1411940889515,\"value\":99}\n{\"ts\":1411940890615,\"value\":0.5}\n",
+		"csv":    "ts,value\n1411940889515,99\n1411940890615,0.5\n",
+	}
+	for format, body := range expected {
+		req, _ := http.NewRequest("GET", "/database/cpu?format="+format, nil)
+		rw := httptest.NewRecorder()
+		newRouter(controller).ServeHTTP(rw, req)
+
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, contentTypes[format], rw.Header().Get("Content-Type"))
+		assert.Equal(t, body, rw.Body.String())
+	}
+
+	req, _ := http.NewRequest("GET", "/database/cpu?format=xml", nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
+
+func TestStreamRawValuesStop(t *testing.T) {
+	storage := newTestStorage(t)
+
+	for i := 0; i < 3*bufferSize; i++ {
+		storage.addSample("database", "cpu", Sample{1411940889515 + int64(i), float64(i)})
+	}
+
+	errStop := errors.New("stop")
+	count := 0
+	err := storage.streamRawValues("database", "cpu", time.Millisecond, func(sample Sample) error {
+		count++
+		if count == 10 {
+			return errStop
+		}
+		return nil
+	})
+	assert.Equal(t, errStop, err)
+	assert.Equal(t, 10, count)
+}
+
+func exportTestDatabase(controller *Controller, dbname string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/_db/"+dbname+"/export", nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	return rw
+}
+
+func importTestDatabase(controller *Controller, query string, archive []byte) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/_import"+query, bytes.NewReader(archive))
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	return rw
+}
+
+func TestExportImport(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	addTestSample(controller, "database", "?ts=1411940889515", "{\"cpu\":80,\"mem\":1024}")
+	addTestSample(controller, "database", "?ts=1411940890615", "{\"cpu\":75.11}")
+	storage.setMeta("database", map[string]interface{}{"build": "1.2.3"})
+
+	rw := exportTestDatabase(controller, "database")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "application/gzip", rw.Header().Get("Content-Type"))
+	archive := rw.Body.Bytes()
+
+	rw = importTestDatabase(controller, "", archive)
+	assert.Equal(t, http.StatusConflict, rw.Code)
+
+	rw = importTestDatabase(controller, "?conflict=rename", archive)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "{\"name\":\"database-1\",\"status\":\"ok\"}", rw.Body.String())
+
+	rw = importTestDatabase(controller, "?name=copy", archive)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	databases, _ := storage.listDatabases()
+	assert.Equal(t, []string{"copy", "database", "database-1"}, databases)
+
+	assert.Equal(t, "[[1411940889515,80],[1411940890615,75.11]]", getTestRawValues(controller, "copy", "cpu"))
+	assert.Equal(t, "[[1411940889515,1024]]", getTestRawValues(controller, "copy", "mem"))
+	meta, _ := storage.getMeta("copy")
+	assert.Equal(t, map[string]interface{}{"build": "1.2.3"}, meta)
+
+	// New samples go after the imported ones
+	addTestSample(controller, "copy", "?ts=1411940891708", "{\"cpu\":1}")
+	assert.Equal(t, "[[1411940889515,80],[1411940890615,75.11],[1411940891708,1]]", getTestRawValues(controller, "copy", "cpu"))
+}
+
+func TestImportInvalidArchive(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	rw := importTestDatabase(controller, "", []byte("not an archive"))
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	rw = importTestDatabase(controller, "?conflict=overwrite", nil)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	manifest := Manifest{
+		Version: archiveVersion,
+		Name:    "database",
+		Files: []ArchiveFile{
+			{"cpu.data", 5, "0000000000000000000000000000000000000000000000000000000000000000"},
+			{"cpu.data.1", 13, "0000000000000000000000000000000000000000000000000000000000000000"},
+			{"cpu.data.n", 13, "0000000000000000000000000000000000000000000000000000000000000000"},
+		},
+	}
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	data, _ := json.Marshal(manifest)
+	writeArchiveEntry(tw, archiveManifest, int64(len(data)), bytes.NewReader(data))
+	writeArchiveEntry(tw, "cpu.data", 5, bytes.NewBufferString("0 80\n"))
+	tw.Close()
+	gw.Close()
+
+	rw = importTestDatabase(controller, "", buf.Bytes())
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Equal(t, "{\"error\":\"invalid archive: checksum mismatch in \\\"cpu.data\\\"\"}", rw.Body.String())
+
+	databases, _ := storage.listDatabases()
+	assert.Equal(t, []string{}, databases)
+
+	files, _ := ioutil.ReadDir(storage.baseDir)
+	assert.Equal(t, 0, len(files))
+}
+
+func TestSnapshots(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+	controller.snapshotDir = filepath.Join(storage.baseDir, "..", filepath.Base(storage.baseDir)+"-snapshots")
+	defer os.RemoveAll(controller.snapshotDir)
+
+	setTestSettings(controller, "database", "{\"reorderWindow\":60000}")
+	addTestSample(controller, "database", "?ts=1411940889515", "{\"cpu\":80,\"mem\":1024}")
+	addTestSample(controller, "other", "?ts=1411940889515", "{\"cpu\":50}")
+
+	req, _ := http.NewRequest("POST", "/_snapshots", nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	var first Snapshot
+	json.Unmarshal(rw.Body.Bytes(), &first)
+	// Two metrics and settings in "database", one metric in "other"
+	assert.Equal(t, 4, first.Files)
+	assert.Equal(t, 0, first.Linked)
+
+	// Buffered samples are flushed
+	data, _ := ioutil.ReadFile(filepath.Join(controller.snapshotDir, first.Name, "database", "cpu.data"))
+	assert.Contains(t, string(data), "\n0 80\n")
+
+	time.Sleep(time.Millisecond)
+	addTestSample(controller, "other", "?ts=1411940890515", "{\"cpu\":60}")
+
+	second, err := storage.snapshot(controller.snapshotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The data file of "other/cpu" has changed
+	assert.Equal(t, 4, second.Files)
+	assert.Equal(t, 3, second.Linked)
+
+	prevInfo, _ := os.Stat(filepath.Join(controller.snapshotDir, first.Name, "database", "mem.data"))
+	info, _ := os.Stat(filepath.Join(controller.snapshotDir, second.Name, "database", "mem.data"))
+	assert.True(t, os.SameFile(prevInfo, info))
+
+	data, _ = ioutil.ReadFile(filepath.Join(controller.snapshotDir, second.Name, "other", "cpu.data"))
+	assert.Contains(t, string(data), "\n0 50\n1000 60\n")
+
+	req, _ = http.NewRequest("GET", "/_snapshots", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	assert.Equal(t, "[\""+first.Name+"\",\""+second.Name+"\"]", rw.Body.String())
+}
+
+func TestFsck(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	addTestSample(controller, "database", "?ts=1411940889515", "{\"cpu\":80,\"mem\":1024}")
+	addTestSample(controller, "database", "?ts=1411940890515", "{\"cpu\":75,\"mem\":2048}")
+
+	dataDir := storage.getDirPath("database")
+	appendFile := func(name, data string) {
+		file, _ := os.OpenFile(filepath.Join(dataDir, name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		file.WriteString(data)
+		file.Close()
+	}
+	// The process died while appending a sample or converting a legacy metric
+	appendFile("cpu.data", "1000 7")
+	appendFile("cpu.data.n", "1411940890515")
+	// Garbage in the middle of the file
+	ioutil.WriteFile(filepath.Join(dataDir, "mem.data"), []byte("#perfdb 1 1411940889515 1411940889515\n0 1024\n??\n500 1536\n=1411940890515 2048\n"), 0644)
+	// A legacy metric with a wrong last timestamp
+	appendFile("disk.data", "0 5\n1000 6\n")
+	appendFile("disk.data.1", "1411940889515")
+	appendFile("disk.data.n", "1411940891515")
+	appendFile("gone.data.1", "1411940889515")
+	appendFile("meta.json.tmp", "{}")
+
+	req, _ := http.NewRequest("GET", "/_fsck", nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "{\"databases\":1,\"metrics\":3,\"problems\":["+
+		"{\"file\":\"database/cpu.data\",\"problem\":\"torn last record\",\"repaired\":false},"+
+		"{\"file\":\"database/cpu.data.n\",\"problem\":\"leftover file of a legacy metric\",\"repaired\":false},"+
+		"{\"file\":\"database/disk.data.n\",\"problem\":\"last timestamp is 1411940891515, data ends at 1411940890515\",\"repaired\":false},"+
+		"{\"file\":\"database/gone.data.1\",\"problem\":\"orphan file\",\"repaired\":false},"+
+		"{\"file\":\"database/mem.data\",\"problem\":\"unparsable record at line 3\",\"repaired\":false},"+
+		"{\"file\":\"database/mem.data\",\"problem\":\"1 records with unknown timestamps after unparsable records\",\"repaired\":false},"+
+		"{\"file\":\"database/meta.json.tmp\",\"problem\":\"leftover temporary file\",\"repaired\":false}]}",
+		rw.Body.String())
+
+	req, _ = http.NewRequest("POST", "/_fsck", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	var report FsckReport
+	json.Unmarshal(rw.Body.Bytes(), &report)
+	assert.Equal(t, 7, len(report.Problems))
+	for _, problem := range report.Problems {
+		assert.True(t, problem.Repaired, problem.File)
+	}
+
+	report2, err := storage.fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []FsckProblem{}, report2.Problems)
+
+	assert.Equal(t, "[[1411940889515,80],[1411940890515,75]]", getTestRawValues(controller, "database", "cpu"))
+	assert.Equal(t, "[[1411940889515,1024],[1411940890515,2048]]", getTestRawValues(controller, "database", "mem"))
+	assert.Equal(t, "[[1411940889515,5],[1411940890515,6]]", getTestRawValues(controller, "database", "disk"))
+
+	addTestSample(controller, "database", "?ts=1411940891515", "{\"cpu\":70}")
+	assert.Equal(t, "[[1411940889515,80],[1411940890515,75],[1411940891515,70]]", getTestRawValues(controller, "database", "cpu"))
+}
+
+func compactTestDatabase(controller *Controller, method, dbname string) (*CompressionReport, *httptest.ResponseRecorder) {
+	req, _ := http.NewRequest(method, "/_db/"+dbname+"/compaction", nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	var report CompressionReport
+	json.Unmarshal(rw.Body.Bytes(), &report)
+	return &report, rw
+}
+
+func TestCompaction(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+
+	for i := 0; i < 100; i++ {
+		addTestSample(controller, "database", "?ts="+strconv.Itoa(1411940889515+i*1000), "{\"cpu\":"+strconv.Itoa(i%10)+",\"mem\":1024}")
+	}
+	rawValues := getTestRawValues(controller, "database", "cpu")
+	summary, _ := storage.getSummary("database", "cpu")
+	stats, _ := storage.getMetricStats("database", "cpu")
+	databases, _ := listTestDatabases(t, controller, "")
+
+	report, rw := compactTestDatabase(controller, "GET", "database")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, 2, report.Metrics)
+	assert.Equal(t, 0, report.Compressed)
+	assert.Equal(t, 1.0, report.Ratio)
+
+	report, rw = compactTestDatabase(controller, "POST", "database")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, 2, report.Compressed)
+	assert.Equal(t, databases[0].Size, report.RawSize)
+	assert.True(t, report.Ratio > 2, "ratio %v", report.Ratio)
+	assert.Equal(t, "cpu", report.MetricStats[0].Name)
+	assert.True(t, report.MetricStats[0].Compressed)
+
+	// Readers don't notice the difference
+	assert.Equal(t, rawValues, getTestRawValues(controller, "database", "cpu"))
+	compressedSummary, _ := storage.getSummary("database", "cpu")
+	assert.Equal(t, summary, compressedSummary)
+	compressedStats, _ := storage.getMetricStats("database", "cpu")
+	stats.Size = compressedStats.Size
+	assert.Equal(t, stats, compressedStats)
+	compressedDatabases, _ := listTestDatabases(t, controller, "")
+	databases[0].Size = compressedDatabases[0].Size
+	assert.Equal(t, databases, compressedDatabases)
+
+	fsckReport, _ := storage.fsck(false)
+	assert.Equal(t, []FsckProblem{}, fsckReport.Problems)
+
+	// Compressed files are exported as is
+	archive := exportTestDatabase(controller, "database").Body.Bytes()
+	importTestDatabase(controller, "?name=copy", archive)
+	assert.Equal(t, rawValues, getTestRawValues(controller, "copy", "cpu"))
+
+	// New samples decompress the metric
+	addTestSample(controller, "database", "?ts=1411940989515", "{\"cpu\":100}")
+	assert.Equal(t, rawValues[:len(rawValues)-1]+",[1411940989515,100]]", getTestRawValues(controller, "database", "cpu"))
+	report, _ = compactTestDatabase(controller, "GET", "database")
+	assert.Equal(t, 1, report.Compressed)
+	assert.False(t, report.MetricStats[0].Compressed)
+
+	_, rw = compactTestDatabase(controller, "GET", "nonexistent")
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
+
+func getTestCacheStats(t *testing.T, controller *Controller) CacheStats {
+	req, _ := http.NewRequest("GET", "/_cache", nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+
+	var stats CacheStats
+	if err := json.Unmarshal(rw.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestResultCache(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+	getSummary := func() string {
+		req, _ := http.NewRequest("GET", "/database/cpu/summary", nil)
+		rw := httptest.NewRecorder()
+		newRouter(controller).ServeHTTP(rw, req)
+		return rw.Body.String()
+	}
+
+	addTestSample(controller, "database", "?ts=1411940881000", "{\"cpu\":1}")
+	first := getSummary()
+	assert.Equal(t, first, getSummary())
+	assert.Equal(t, CacheStats{Capacity: defaultCacheSize, Entries: 1, Hits: 1, Misses: 1}, getTestCacheStats(t, controller))
+
+	// New samples change the version of the metric
+	addTestSample(controller, "database", "?ts=1411940882000", "{\"cpu\":3}")
+	assert.Contains(t, getSummary(), "\"avg\":2,")
+	assert.Equal(t, int64(2), getTestCacheStats(t, controller).Misses)
+
+	// Annotations are not cached
+	req, _ := http.NewRequest("POST", "/_db/database/annotations", bytes.NewBufferString("{\"text\":\"restart\"}"))
+	newRouter(controller).ServeHTTP(httptest.NewRecorder(), req)
+	assert.Contains(t, getSummary(), "restart")
+
+	req, _ = http.NewRequest("GET", "/database/cpu/heatmap", nil)
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		newRouter(controller).ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusOK, rw.Code)
+	}
+	assert.Equal(t, CacheStats{Capacity: defaultCacheSize, Entries: 3, Hits: 3, Misses: 3}, getTestCacheStats(t, controller))
+}
+
+func TestGetSummaries(t *testing.T) {
+	var err error
+	var storage *perfDB
+	if storage, err = newTmpStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	controller := newController(storage)
+	addTestSample(controller, "database", "", "{\"cpu\":1,\"mem\":10,\"disk\":100}")
+	addTestSample(controller, "database", "", "{\"cpu\":3,\"mem\":30}")
+
+	getSummaries := func(query string) (map[string]map[string]interface{}, *httptest.ResponseRecorder) {
+		req, _ := http.NewRequest("GET", "/_db/database/summary"+query, nil)
+		rw := httptest.NewRecorder()
+		newRouter(controller).ServeHTTP(rw, req)
+
+		var summaries map[string]map[string]interface{}
+		json.Unmarshal(rw.Body.Bytes(), &summaries)
+		return summaries, rw
+	}
+
+	summaries, rw := getSummaries("")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, 3, len(summaries))
+	assert.Equal(t, 2.0, summaries["cpu"]["avg"])
+	assert.Equal(t, 20.0, summaries["mem"]["avg"])
+	assert.Equal(t, 1.0, summaries["disk"]["count"])
+
+	summaries, rw = getSummaries("?metrics=mem,missing,mem,_%00")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, map[string]map[string]interface{}{
+		"mem":     summaries["mem"],
+		"missing": {"error": "metric not found"},
+		"_\x00":   {"error": "invalid metric name: name must not contain U+0000"},
+	}, summaries)
+	assert.Equal(t, 30.0, summaries["mem"]["max"])
+
+	// Summaries are shared with single metric requests
+	req, _ := http.NewRequest("GET", "/database/mem/summary", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	assert.Equal(t, int64(3), controller.cache.stats().Misses)
+
+	req, _ = http.NewRequest("GET", "/_db/missing/summary", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pmylund/go-cache"
+)
+
+// A data file starts with a header that holds the format version, the base
+// timestamp and the creation time of the metric (in milliseconds):
+//
+//	#perfdb 1 1437137708114 1437137708200
+//
+// It's followed by one record per sample. A record is either the delta from
+// the previous timestamp (the base one for the first sample) and the value,
+// or a checkpoint with the absolute timestamp:
+//
+//	0 10
+//	4 15
+//	=1437137708122 16
+//
+// A checkpoint is written at least every checkpointInterval bytes, so the
+// last timestamp is found by reading the tail of the file.
+//
+// Legacy data files have no header and no checkpoints, their first and last
+// timestamps are stored in .1 and .n files. They are still readable and are
+// converted when a sample is added. Compressed files are described in
+// compact.go.
+
+const (
+	dataFormatVersion  = 1
+	dataHeaderPrefix   = "#perfdb"
+	checkpointPrefix   = "="
+	checkpointInterval = 4096
+)
+
+type dataHeader struct {
+	version int
+	base    int64
+	created int64
+	*compressedHeader
+}
+
+func formatHeader(header dataHeader) string {
+	if c := header.compressedHeader; c != nil {
+		return fmt.Sprintf("%s %d %d %d %d %v %d %d\n", compressedHeaderPrefix, header.version, header.base, header.created,
+			c.last.ts, c.last.v, c.records, c.rawSize)
+	}
+	return fmt.Sprintf("%s %d %d %d\n", dataHeaderPrefix, header.version, header.base, header.created)
+}
+
+func parseHeader(line string) (*dataHeader, error) {
+	fields := strings.Fields(line)
+	compressed := len(fields) == 8 && fields[0] == compressedHeaderPrefix
+	if !compressed && (len(fields) != 4 || fields[0] != dataHeaderPrefix) {
+		return nil, fmt.Errorf("malformed header: %q", line)
+	}
+
+	var header dataHeader
+	var err error
+	if header.version, err = strconv.Atoi(fields[1]); err != nil {
+		return nil, err
+	}
+	if header.version != dataFormatVersion {
+		return nil, fmt.Errorf("unsupported data format version %d", header.version)
+	}
+	if header.base, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return nil, err
+	}
+	if header.created, err = strconv.ParseInt(fields[3], 10, 64); err != nil {
+		return nil, err
+	}
+	if !compressed {
+		return &header, nil
+	}
+
+	c := compressedHeader{}
+	if c.last, err = parseRecord(fields[4] + " " + fields[5]); err != nil {
+		return nil, err
+	}
+	if c.records, err = strconv.Atoi(fields[6]); err != nil {
+		return nil, err
+	}
+	if c.rawSize, err = strconv.ParseInt(fields[7], 10, 64); err != nil {
+		return nil, err
+	}
+	header.compressedHeader = &c
+	return &header, nil
+}
+
+// isHeader reports whether the line is the header of a data file. Only the
+// first line can be the header.
+func isHeader(line string, lineNumber int) bool {
+	return lineNumber == 1 && strings.HasPrefix(line, dataHeaderPrefix)
+}
+
+// readHeader returns the header of the data file, or nil for legacy files.
+func readHeader(dataFile string) (*dataHeader, error) {
+	file, err := os.Open(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !isHeader(line, 1) {
+		return nil, nil
+	}
+	if err == io.EOF {
+		return nil, fmt.Errorf("torn header: %q", line)
+	}
+	return parseHeader(line)
+}
+
+// parseLine returns the sample of the record, prev is the timestamp of the
+// previous sample.
+func parseLine(record string, prev int64) (Sample, error) {
+	if strings.HasPrefix(record, checkpointPrefix) {
+		return parseRecord(record[len(checkpointPrefix):])
+	}
+	sample, err := parseRecord(record)
+	sample.ts += prev
+	return sample, err
+}
+
+func formatRecord(sample Sample, prev int64, checkpoint bool) string {
+	if checkpoint {
+		return fmt.Sprintf("%s%d %v\n", checkpointPrefix, sample.ts, sample.v)
+	}
+	return fmt.Sprintf("%d %v\n", sample.ts-prev, sample.v)
+}
+
+// openData returns the text of the data file, compressed files are
+// decompressed on the fly.
+func openData(dataFile string) (io.ReadCloser, error) {
+	file, err := os.Open(dataFile)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	line, err := reader.ReadString('\n')
+	if err != nil || !isCompressed(line) {
+		// Not compressed, start over
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return file, nil
+	}
+
+	gr, err := gzip.NewReader(reader)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &compressedReader{gr, file}, nil
+}
+
+type compressedReader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *compressedReader) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
+
+// baseTimestamp returns the timestamp that the first delta is relative to.
+func baseTimestamp(dataFile string) (int64, error) {
+	header, err := readHeader(dataFile)
+	if err != nil {
+		return 0, err
+	}
+	if header == nil {
+		return readTimestamp(dataFile + ".1")
+	}
+	return header.base, nil
+}
+
+// dataInfo describes a metric without reading all of its samples.
+type dataInfo struct {
+	legacy     bool
+	compressed bool
+	records    int   // Only known for compressed files
+	rawSize    int64 // Size of the text data
+	first      int64
+	created    int64 // Milliseconds
+	last       Sample
+	size       int64
+	checkpoint int64 // Offset of the last checkpoint or the header
+}
+
+// dataInfoCache keeps dataInfo of recently written files, so that appending
+// a sample doesn't read the header and the tail of the file again. Entries
+// hold the file info of the described file: rewrites (conversion, compaction,
+// repairs, imports) replace or truncate the file, which invalidates them.
+var dataInfoCache *cache.Cache
+
+type cachedDataInfo struct {
+	info dataInfo
+	file os.FileInfo
+}
+
+func cacheDataInfo(dataFile string, info *dataInfo) {
+	if f, err := os.Stat(dataFile); err == nil {
+		dataInfoCache.Set(dataFile, cachedDataInfo{*info, f}, cache.DefaultExpiration)
+	}
+}
+
+// readCachedDataInfo is readDataInfo that uses the cache if the file didn't
+// change. The caller must hold pdb.mu.
+func readCachedDataInfo(dataFile string) (*dataInfo, error) {
+	f, err := os.Stat(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	if cached, found := dataInfoCache.Get(dataFile); found {
+		entry := cached.(cachedDataInfo)
+		if os.SameFile(entry.file, f) && entry.file.Size() == f.Size() && entry.file.ModTime().Equal(f.ModTime()) {
+			info := entry.info
+			return &info, nil
+		}
+	}
+
+	info, err := readDataInfo(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	dataInfoCache.Set(dataFile, cachedDataInfo{*info, f}, cache.DefaultExpiration)
+	return info, nil
+}
+
+func readDataInfo(dataFile string) (*dataInfo, error) {
+	header, err := readHeader(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return readLegacyInfo(dataFile)
+	}
+	if c := header.compressedHeader; c != nil {
+		f, err := os.Stat(dataFile)
+		if err != nil {
+			return nil, err
+		}
+		return &dataInfo{
+			compressed: true,
+			records:    c.records,
+			rawSize:    c.rawSize,
+			first:      header.base,
+			created:    header.created,
+			last:       c.last,
+			size:       f.Size(),
+		}, nil
+	}
+
+	file, err := os.Open(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	f, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	info := dataInfo{first: header.base, created: header.created, size: f.Size(), rawSize: f.Size()}
+	offset := info.size - 2*checkpointInterval
+	if offset < 0 {
+		offset = 0
+	}
+	found, err := info.scanTail(file, offset)
+	if err != nil {
+		return nil, err
+	}
+	if !found && offset > 0 {
+		// Checkpoints were not written, e.g. by a repair
+		if _, err := info.scanTail(file, 0); err != nil {
+			return nil, err
+		}
+	}
+	return &info, nil
+}
+
+// scanTail reads records starting from the offset. The last sample is known
+// only if a checkpoint (or the header) was found.
+func (info *dataInfo) scanTail(file *os.File, offset int64) (bool, error) {
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, info.size-offset))
+	pos := offset
+	if offset > 0 {
+		// Skip the first line, it's likely to be partial
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		pos += int64(len(line))
+	}
+
+	found := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break // A torn record is not committed
+		} else if err != nil {
+			return false, err
+		}
+
+		switch {
+		case pos == 0:
+			info.last = Sample{ts: info.first}
+			info.checkpoint = 0
+			found = true
+		case strings.HasPrefix(line, checkpointPrefix):
+			if info.last, err = parseLine(line, 0); err != nil {
+				return false, err
+			}
+			info.checkpoint = pos
+			found = true
+		case found:
+			if info.last, err = parseLine(line, info.last.ts); err != nil {
+				return false, err
+			}
+		}
+		pos += int64(len(line))
+	}
+	return found, nil
+}
+
+func readLegacyInfo(dataFile string) (*dataInfo, error) {
+	info := dataInfo{legacy: true}
+
+	f, err := os.Stat(dataFile + ".1")
+	if err != nil {
+		return nil, err
+	}
+	// The first timestamp is written once, so that is when the metric was created
+	info.created = f.ModTime().UnixNano() / 1e6
+
+	if info.first, err = readTimestamp(dataFile + ".1"); err != nil {
+		return nil, err
+	}
+	if info.last.ts, err = readTimestamp(dataFile + ".n"); err != nil {
+		return nil, err
+	}
+
+	if f, err = os.Stat(dataFile); err != nil {
+		return nil, err
+	}
+	info.size = f.Size()
+	info.rawSize = info.size
+	if info.size > 0 {
+		record, err := readLastRecord(dataFile, info.size)
+		if err != nil {
+			return nil, err
+		}
+		sample, err := parseRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		info.last.v = sample.v
+	}
+	return &info, nil
+}
+
+// convertLegacy rewrites a legacy metric in the current format and removes
+// its .1 and .n files.
+func convertLegacy(dataFile string) error {
+	info, err := readLegacyInfo(dataFile)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(dataFile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	err = replaceFile(dataFile, func(w io.Writer) error {
+		header := formatHeader(dataHeader{version: dataFormatVersion, base: info.first, created: info.created})
+		writer := bufio.NewWriter(w)
+		writer.WriteString(header)
+
+		reader := bufio.NewReader(in)
+		pos, checkpoint := int64(len(header)), int64(0)
+		ts := info.first
+		for {
+			record, err := reader.ReadString('\n')
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			sample, err := parseLine(record, ts)
+			if err != nil {
+				return err
+			}
+			isCheckpoint := pos-checkpoint >= checkpointInterval
+			if isCheckpoint {
+				checkpoint = pos
+			}
+			record = formatRecord(sample, ts, isCheckpoint)
+			writer.WriteString(record)
+			pos += int64(len(record))
+			ts = sample.ts
+		}
+		return writer.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	return removeLegacyFiles(dataFile)
+}
+
+func removeLegacyFiles(dataFile string) error {
+	for _, fileName := range []string{dataFile + ".n", dataFile + ".1"} {
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		timestampCache.Delete(fileName)
+	}
+	return nil
+}
+
+// initStore creates the data file with the first sample.
+func initStore(dataFile string, sample Sample) error {
+	header := dataHeader{version: dataFormatVersion, base: sample.ts, created: time.Now().UnixNano() / 1e6}
+	data := formatHeader(header) + formatRecord(sample, sample.ts, false)
+	return writeFileAtomic(dataFile, []byte(data))
+}
+
+func appendSample(dataFile string, info *dataInfo, sample Sample) error {
+	checkpoint := info.size-info.checkpoint >= checkpointInterval
+	record := formatRecord(sample, info.last.ts, checkpoint)
+	if err := storeRecord(dataFile, record); err != nil {
+		return err
+	}
+
+	appended := *info
+	if checkpoint {
+		appended.checkpoint = info.size
+	}
+	appended.size += int64(len(record))
+	appended.rawSize = appended.size
+	appended.last = sample
+	cacheDataInfo(dataFile, &appended)
+	return nil
+}
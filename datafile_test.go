@@ -0,0 +1,193 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpoints(t *testing.T) {
+	storage, err := newTmpStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Sample{}
+	for i := int64(0); i < 2000; i++ {
+		sample := Sample{1411940889515 + i*i, float64(i)}
+		if err := storage.addSample("database", "cpu", sample); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, sample)
+	}
+
+	stored, err := readTestSamples(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, stored)
+
+	dataFile := storage.getFilePath("database", "cpu")
+	info, err := readDataInfo(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected[len(expected)-1], info.last)
+	assert.Equal(t, expected[0].ts, info.first)
+
+	// Appending keeps the cached info up to date
+	cached, err := readCachedDataInfo(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, info, cached)
+
+	data, _ := ioutil.ReadFile(dataFile)
+	assert.True(t, strings.HasPrefix(string(data), "#perfdb 1 1411940889515 "))
+	offset := 0
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if strings.HasPrefix(line, checkpointPrefix) {
+			offset = 0
+		}
+		offset += len(line)
+		assert.True(t, offset < checkpointInterval+len(line), "no checkpoint")
+	}
+}
+
+func TestLegacyMetric(t *testing.T) {
+	storage, err := newTmpStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataFile := storage.getFilePath("database", "cpu")
+	os.MkdirAll(storage.getDirPath("database"), 0775)
+	ioutil.WriteFile(dataFile, []byte("0 80\n1000 75\n"), 0644)
+	ioutil.WriteFile(dataFile+".1", []byte("1411940889515"), 0644)
+	ioutil.WriteFile(dataFile+".n", []byte("1411940890515"), 0644)
+
+	stored, err := readTestSamples(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Sample{{1411940889515, 80}, {1411940890515, 75}}, stored)
+
+	stats, err := storage.getMetricStats("database", "cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, stats.Count)
+	assert.Equal(t, int64(1411940889515), stats.FirstTS)
+	assert.Equal(t, int64(1411940890515), stats.LastTS)
+	assert.Equal(t, 75.0, stats.LastValue)
+	assert.Equal(t, int64(39), stats.Size)
+
+	// The metric is converted when a sample is added
+	if err := storage.addSample("database", "cpu", Sample{1411940891515, 70}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err = readTestSamples(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Sample{{1411940889515, 80}, {1411940890515, 75}, {1411940891515, 70}}, stored)
+
+	header, err := readHeader(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(1411940889515), header.base)
+	for _, fileName := range []string{dataFile + ".1", dataFile + ".n"} {
+		_, err := os.Stat(fileName)
+		assert.True(t, os.IsNotExist(err), fileName)
+	}
+
+	stats, err = storage.getMetricStats("database", "cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, stats.Count)
+	assert.Equal(t, int64(1411940891515), stats.LastTS)
+}
+
+func TestDataInfoCacheInvalidation(t *testing.T) {
+	storage := newTestStorage(t)
+	storage.setSettings("database", DatabaseSettings{OutOfOrder: acceptOutOfOrder, Duplicates: lastDuplicate, Precision: "ms"})
+
+	add := func(samples ...Sample) {
+		for _, sample := range samples {
+			if err := storage.addSample("database", "cpu", sample); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	add(Sample{1411940889515, 1}, Sample{1411940890515, 2})
+
+	// The last record is replaced
+	add(Sample{1411940890515, 3})
+	// The file is compressed and decompressed by the next sample
+	if err := storage.compactDatabase("database"); err != nil {
+		t.Fatal(err)
+	}
+	add(Sample{1411940891515, 4})
+	// The file is truncated and rewritten outside of the storage
+	dataFile := storage.getFilePath("database", "cpu")
+	if err := writeFileAtomic(dataFile, []byte("#perfdb 1 1411940889515 1411940889515\n0 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	add(Sample{1411940892515, 5})
+
+	stored, err := readTestSamples(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Sample{{1411940889515, 1}, {1411940892515, 5}}, stored)
+}
+
+func TestReplaceLastSample(t *testing.T) {
+	storage := newTestStorage(t)
+	storage.setSettings("database", DatabaseSettings{OutOfOrder: acceptOutOfOrder, Duplicates: lastDuplicate, Precision: "ms"})
+	dataFile := storage.getFilePath("database", "cpu")
+
+	add := func(samples ...Sample) {
+		for _, sample := range samples {
+			if err := storage.addSample("database", "cpu", sample); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	add(Sample{1411940889515, 1}, Sample{1411940890515, 2})
+	before, err := os.Stat(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the tail is rewritten, the file stays the same
+	add(Sample{1411940890515, 2.5}, Sample{1411940890515, 3})
+	after, err := os.Stat(dataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, os.SameFile(before, after))
+	add(Sample{1411940891515, 4})
+
+	stored, err := readTestSamples(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Sample{{1411940889515, 1}, {1411940890515, 3}, {1411940891515, 4}}, stored)
+
+	// A header without records, e.g. after a repair, is kept
+	if err := writeFileAtomic(dataFile, []byte("#perfdb 1 1411940889515 1411940889515\n")); err != nil {
+		t.Fatal(err)
+	}
+	add(Sample{1411940889515, 5})
+	stored, err = readTestSamples(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Sample{{1411940889515, 5}}, stored)
+}
@@ -22,6 +22,62 @@ Obviously, you will rather use your favourite programming language to send HTTP
 
 It's absolutely OK to create thousands of databases.
 
+Database and metric names can be arbitrary printable UTF-8 strings up to 200 bytes long, including spaces and slashes.
+Special characters are stored encoded as 3 bytes, names with many of them must fit in 243 bytes once encoded.
+Use URL encoding (e.g., "read%2Fwrite") to refer to such names in URL paths.
+Database names cannot start with an underscore, these paths are reserved for perfdb itself.
+Requests with invalid names are rejected with "400 Bad Request" and an explanation in the response body.
+
+Only numeric values are stored. By default, other fields (strings, booleans, nulls, and etc.) are dropped and reported in the response:
+
+	$ curl -s -X POST http://localhost:8080/mydatabase -d '{"read_latency":12.3,"host":"node1"}'
+	{"status":"ok","dropped":[{"field":"host","error":"expected a number, got string"}]}
+
+Invalid "ts" parameter rejects the request with "400 Bad Request" in any mode, since the samples would be stored at a different time.
+
+In strict mode, any invalid field rejects the whole document with "400 Bad Request" and nothing is stored:
+
+	$ curl -s -X POST "http://localhost:8080/mydatabase?mode=strict" -d '{"read_latency":12.3,"host":"node1"}'
+	{"status":"error","errors":[{"field":"host","error":"expected a number, got string"}]}
+
+Use "-strict" command line argument to make it the default, "mode=lenient" parameter overrides it.
+
+Arrays of numbers are stored as multiple samples with the same timestamp, e.g. a batch of per-request latencies:
+
+	curl -X POST http://localhost:8080/mydatabase -d '{"read_latency":[12.3,10.1,15.7]}'
+
+Nested objects can be flattened into metrics with dotted names using the "flatten" parameter:
+
+	curl -X POST "http://localhost:8080/mydatabase?flatten=true" -d '{"latency":{"read":1.2,"write":3.4}}'
+
+The document above produces "latency.read" and "latency.write" metrics. The "separator" parameter changes the dot to another string.
+Use "-flatten" command line argument to flatten nested objects by default, "flatten=false" parameter overrides it.
+
+Out-of-order samples
+
+Samples are expected to arrive in timestamp order. Clients that send data from several threads or hosts can ask perfdb to sort recent samples:
+
+	curl -X PUT http://localhost:8080/_db/mydatabase/settings -d '{"reorderWindow":5000,"outOfOrder":"reject","duplicates":"last"}'
+
+where:
+
+  `reorderWindow` is the number of milliseconds that samples are kept in memory and sorted before they are written. The default is 0, samples are written immediately.
+
+  `outOfOrder` defines what happens to samples older than the latest written one: "accept" (default) stores them as is, "reject" drops them and reports in the response.
+
+  `duplicates` defines what happens to samples with the same timestamp as the previous one: "keep" (default) stores both, "first" keeps the existing sample, "last" replaces it.
+
+Buffered samples are written before any read, so queries always see all acknowledged data.
+Current settings are available via GET request to the same URL.
+
+Timestamps are stored with millisecond precision by default, so microbenchmarks that produce many samples per millisecond should use a finer precision:
+
+	curl -X PUT http://localhost:8080/_db/mydatabase/settings -d '{"precision":"ns"}'
+
+Supported values are "s", "ms", "us" (or "µs") and "ns". The "ts" parameter is converted to the database precision whatever unit it's specified in.
+Raw values, summaries, heat maps and annotations use the database precision, the list of databases always uses milliseconds.
+The precision cannot be changed once the database has samples.
+
 Aggregation and visualization
 
 This API returns JSON document with aggregated characteristics (mean, percentiles, and etc.):
@@ -42,21 +98,162 @@ This API returns JSON document with aggregated characteristics (mean, percentile
 
 Please notice that Python is used for demonstration purpose only.
 
+Several metrics of a database can be summarized in one request, the response is keyed by metric:
+
+	$ curl -s "http://127.0.0.1:8080/_db/mydatabase/summary?metrics=read_latency,write_latency"
+	{"read_latency":{"avg":5.82248,"count":200000,...},"write_latency":{"error":"metric not found"}}
+
+Without "metrics" parameter, all metrics of the database are summarized.
+Metrics are summarized concurrently, by as many workers as there are CPUs.
+A metric that cannot be summarized has an error instead of the summary, the rest of the response is not affected.
+
 Finally, it is possible to generate heat map graphs in SVG format (use your browser to view):
 
 	http://127.0.0.1:8080/mydatabase/read_latency/heatmap
 
 Each rectangle is a cluster of values. The darker color corresponds to the denser population. The legend on the right side of the graph (the vertical bar) should help to understand the density.
 
+Summaries and heat maps of recently queried metrics are cached in memory ("-cache-size" of them, 1000 by default), so finished databases are not read again on every request.
+New samples, settings, imports and repairs invalidate the results they affect.
+Cache hits and misses are reported by http://127.0.0.1:8080/_cache:
+
+	$ curl -s http://127.0.0.1:8080/_cache
+	{"capacity":1000,"entries":42,"hits":1234,"misses":56}
+
+Derived series
+
+Series can be derived from metrics of a database with expressions:
+
+	$ curl -s -G http://127.0.0.1:8080/_db/mydatabase/expr --data-urlencode "q=hits / (hits + misses)"
+	[[1411940889515,0.75],[1411940890515,0.8]]
+
+Expressions support numbers, metrics, "+", "-", "*", "/" and parentheses, e.g. "read_latency * 1000".
+Metric names starting with a digit or with characters other than letters, digits, "_", "." and ":" are double-quoted: "\"read latency\" / 1000".
+Series are aligned by timestamp: at every timestamp of either series, the latest values of both are combined.
+Samples that are not finite numbers (e.g. division by zero) are dropped.
+
+There are two functions:
+
+	rate(ops_total)         per-second rate of a counter, a decrease means that the counter was reset
+	moving_avg(cpu, 30s)    average of samples within the window that ends at every sample
+
+Derived series support the same formats and precision as raw samples, as well as summaries and heat maps:
+
+	http://127.0.0.1:8080/_db/mydatabase/expr/summary?q=rate(ops_total)
+	http://127.0.0.1:8080/_db/mydatabase/expr/heatmap?q=rate(ops_total)
+
+The web interface evaluates expressions on the database page.
+
+Aggregating runs
+
+The same metric can be aggregated across databases, e.g. repeated runs of a benchmark:
+
+	$ curl -s "http://127.0.0.1:8080/_aggregate?metric=read_latency&match=run-*" | python -m json.tool
+	{
+		"databases": ["run-1", "run-2", "run-3"],
+		"metric": "read_latency",
+		"runs": {
+			"run-1": {"avg": 5.82248, "count": 200000, ...},
+			"run-2": {"avg": 5.91374, "count": 200000, ...},
+			"run-3": {"avg": 6.10052, "count": 200000, ...}
+		},
+		"summary": {"avg": 5.94558, "count": 600000, ...},
+		"variance": {
+			"avg": {"cv": 0.02393, "max": 6.10052, "mean": 5.94558, "min": 5.82248, "stddev": 0.14228, "variance": 0.02024},
+			...
+		}
+	}
+
+Databases are selected by "databases" parameter (a comma-separated list) and the same filters as the list of databases: "prefix", "match" and "meta.*".
+"summary" pools samples of all runs, "runs" has the summary of every run, or the error if the run cannot be summarized (e.g. it doesn't have the metric).
+"variance" describes how every summary value differs from run to run: the mean, the standard deviation, the sample variance, the coefficient of variation (the standard deviation relative to the mean), the minimum and the maximum.
+
+Pooled samples can be viewed as a heat map as well:
+
+	http://127.0.0.1:8080/_aggregate/heatmap?metric=read_latency&match=run-*
+
+Runs are aligned by elapsed time, as if they all started at the same moment, and the time axis shows the time since the start of a run.
+Databases with different precision are converted to the finest one.
+
+Query language
+
+Ad-hoc questions can be answered by queries in a small subset of SQL:
+
+	$ curl -s -G http://127.0.0.1:8080/_query --data-urlencode "q=SELECT avg(value), p99(value) FROM read_latency WHERE db = 'run-*' AND time >= now() - 1h GROUP BY time(1m)"
+	[
+		{"target": "run-1 read_latency avg", "datapoints": [[5.82248, 1411940880000], [5.91374, 1411940940000], ...]},
+		{"target": "run-1 read_latency p99", "datapoints": [[40, 1411940880000], [41, 1411940940000], ...]},
+		...
+	]
+
+The query can be sent in the body of POST request as well.
+Like other system resources, it's served under "/_" since "/query" is a database.
+
+"SELECT" lists aggregations: count, sum, min, max, avg and percentiles from p0.1 to p100, e.g. "p99.9(value)" (count also accepts "*").
+"FROM" is a metric name, names with special characters are double-quoted.
+
+"WHERE" conditions are joined with "AND":
+
+	db = 'run-*'                   database name matches the glob pattern ("!=" excludes databases)
+	db IN ('run-1', 'run-2')       database name matches one of the patterns
+	build = '1.0'                  metadata value matches the pattern ("!=" and "IN" work as well)
+	time >= '2014-09-28T21:48:00Z' time range ("<", "<=", ">" and ">=")
+	time < 1411940940000           timestamps are in milliseconds
+	time > now() - 1h              relative to the current time
+
+"GROUP BY time(1m)" splits the time range into buckets aligned to the interval, otherwise the whole range is a single bucket.
+
+The result has a series for every database with the metric and every aggregation.
+Datapoints are [value, timestamp in milliseconds] pairs, the timestamp is the start of the bucket (the first sample without "GROUP BY"), as expected by Grafana JSON datasources.
+
+Grafana
+
+perfdb implements the API of the Grafana SimpleJSON datasource.
+Add a datasource of that type with URL "http://127.0.0.1:8080/_grafana":
+
+	GET  /_grafana/             connection test
+	POST /_grafana/search       metrics of all databases, e.g. {"target": "latency"} matches database or metric names
+	POST /_grafana/query        targets are queries, see above
+	POST /_grafana/annotations  annotations of databases, the annotation query is a glob pattern of database names
+
+Search suggests a query for every metric (at most 1000 of them), e.g.:
+
+	SELECT avg(value) FROM "read_latency" WHERE db = 'run-1'
+
+The dashboard time range restricts every query, and queries without "GROUP BY" are bucketed by the panel interval.
+Annotations are titled and tagged with the database name.
+
 Browsing data
 
 To list all available database, use the following request:
 
 	$ curl -s http://127.0.0.1:8080/ | python -m json.tool
 	[
-		"mydatabase"
+		{
+			"name": "mydatabase",
+			"metrics": 2,
+			"size": 4620073,
+			"firstTimestamp": 1437137708114,
+			"lastTimestamp": 1437138308529,
+			"created": 1437137708115,
+			"meta": {}
+		}
 	]
 
+where "size" is the total size of database files in bytes, "created", "firstTimestamp" and "lastTimestamp" are in milliseconds.
+
+The list can be filtered, sorted and split into pages using optional parameters:
+
+	$ curl -s "http://127.0.0.1:8080/?prefix=run-&match=*-1*&sort=-size&offset=20&limit=10"
+
+where:
+
+  `prefix` and `match` filter databases by name prefix and by glob pattern.
+
+  `sort` is one of "name" (default), "metrics", "size", "firstTimestamp", "lastTimestamp" or "created". A leading "-" reverses the order.
+
+  `offset` and `limit` select a page. The total number of matching databases is returned in the X-Total-Count header.
+
 To list all metrics, use request similar to:
 
 	$ curl -s http://127.0.0.1:8080/mydatabase | python -m json.tool
@@ -65,6 +262,191 @@ To list all metrics, use request similar to:
 		"write_latency"
 	]
 
+Metadata and annotations
+
+A database is just a name, so it's useful to record what produced it (build, commit, configuration, host and etc.).
+Arbitrary key/value metadata can be stored for each database:
+
+	curl -X PUT http://localhost:8080/_db/mydatabase/meta -d '{"build":"1.2.3","nodes":4}'
+
+The same document is available via GET request. "PUT /mydatabase/meta" is accepted as well, but GET requests to that path return a metric named "meta", so "/_db/" paths are preferred.
+The list of databases can be filtered by metadata:
+
+	$ curl -s "http://127.0.0.1:8080/?meta.build=1.2.3"
+
+Notable events are stored as timestamped annotations:
+
+	curl -X POST "http://localhost:8080/_db/mydatabase/annotations?ts=1437137708114" -d '{"text":"compaction started"}'
+
+The "ts" parameter is optional, current time is used by default.
+Annotations are returned by GET request to the same URL (optionally limited by "from" and "to" timestamps) and with metric summaries.
+Heat maps show them as vertical markers.
+
+Each metric can be described by a unit and a free-form description:
+
+	curl -X PUT http://localhost:8080/mydatabase/read_latency/meta -d '{"unit":"ms","description":"Read latency"}'
+
+The unit is shown in the Y-axis title of heat maps.
+
+The "stats" parameter extends the list of metrics with per-metric statistics:
+
+	$ curl -s "http://127.0.0.1:8080/mydatabase?stats=true" | python -m json.tool
+	[
+		{
+			"name": "read_latency",
+			"unit": "ms",
+			"description": "Read latency",
+			"count": 200000,
+			"firstTimestamp": 1437137708114,
+			"lastTimestamp": 1437138308529,
+			"lastValue": 4,
+			"size": 2310036
+		}
+	]
+
+Please note that counting samples requires reading the whole file.
+
+Export and import
+
+A database can be exported as a single archive, e.g. to move benchmark results between machines:
+
+	curl -o mydatabase.tar.gz http://localhost:8080/_db/mydatabase/export
+
+The archive is a gzipped tarball with a versioned manifest (database name, metadata and SHA-256 checksums of all files) followed by the database files.
+It's imported by POST request:
+
+	curl -X POST --data-binary @mydatabase.tar.gz "http://localhost:8080/_import?name=otherdatabase&conflict=rename"
+
+where:
+
+  `name` is the name of the new database, the original name is used by default.
+
+  `conflict` defines what happens if the database already exists: "fail" (default) rejects the archive with "409 Conflict", "rename" imports it as "name-1", "name-2" and etc.
+
+The archive is validated and unpacked before the database appears, so a broken archive never results in a partial database.
+
+Snapshots
+
+A snapshot is a point-in-time copy of all databases, it can be taken while the server is running:
+
+	$ ./perfdb snapshot
+	{"name":"20150717T125508.114Z","created":1437137708114,"files":6,"linked":3,"copiedBytes":4620073}
+
+or by POST request to http://127.0.0.1:8080/_snapshots. GET request to the same URL lists existing snapshots.
+
+Snapshots are stored in the directory specified by "-snapshots" argument, each one has the same layout as the data directory.
+Files that haven't changed since the previous snapshot are hardlinked instead of copied, so nightly backups of a large store take little time and space.
+Writes are paused while the changed files are copied, buffered samples are included.
+
+Storage format
+
+Each metric is stored in a single text file, "metric.data", in the directory of its database:
+
+	#perfdb 1 1437137708114 1437137708200
+	0 10
+	4 15
+	=1437137708122 16
+
+The header holds the format version, the first timestamp and the creation time of the metric (in milliseconds).
+Each record is the delta from the previous timestamp and the value.
+At least every 4 KB, a record with the absolute timestamp (starting with "=") is written instead, so the last timestamp is found without reading the whole file.
+
+Older versions stored the first and last timestamps in separate "metric.data.1" and "metric.data.n" files.
+Such metrics are read as is and converted to the new format when a sample is added.
+
+Compaction
+
+Databases without new samples are compressed in the background to save space.
+A database is compacted once both its last sample and the last write to it are older than "-compact-after" (a week by default, 0 disables compaction).
+Each data file is replaced with a gzipped copy and a header that keeps the first and last samples and the number of records, so listings don't need to decompress anything.
+Queries read compressed metrics transparently, a new sample decompresses the metric.
+Compression doesn't block other requests, a metric that gets new samples meanwhile stays uncompressed.
+
+Compression ratios are reported by GET request:
+
+	$ curl -s http://127.0.0.1:8080/_db/mydatabase/compaction
+	{"name":"mydatabase","metrics":2,"compressed":2,"size":10342,"rawSize":61893,"ratio":5.98,"metricStats":[...]}
+
+POST request to the same URL compacts the database immediately.
+Snapshots and archives contain compressed files as is.
+
+Checking and repairing files
+
+The integrity of database files can be checked with "fsck" command:
+
+	$ ./perfdb -path data fsck
+	mydatabase/read_latency.data: torn last record (found)
+	mydatabase/write_latency.data: unparsable record at line 7 (found)
+	1 databases, 2 metrics, 2 problems
+
+It detects invalid headers, torn and unparsable records, corrupted compressed data, leftover, orphan and unknown files.
+"-repair" flag removes broken records, leftover, orphan and temporary files, compressed metrics that don't match their header are decompressed.
+Records that follow an unparsable one are removed up to the next checkpoint, since their timestamps are deltas from the lost record; fsck reports how many were lost.
+For metrics in the legacy format (see above), it also checks that the last timestamp agrees with the data and rebuilds first/last timestamps from the data.
+The command works with the data directory directly, so the server must be stopped.
+A running server performs the same check on GET request to http://127.0.0.1:8080/_fsck and repairs files on POST request.
+
+Durability
+
+A sample is acknowledged once its record is completely appended to the data file.
+After a crash, the server discards a torn record and temporary files the next time a metric is used.
+Settings and metadata are replaced using a temporary file and a rename, an incomplete last annotation is ignored.
+With "last" duplicates, the previous record is truncated and appended again with the new value: a crash in the middle loses both values.
+
+"-fsync" argument defines when writes reach the disk:
+
+  "always" syncs files before a sample is acknowledged, this is the slowest but the safest mode.
+
+  "interval" (default) syncs modified files every second, a power loss may lose the last second of samples.
+
+  "never" leaves it to the operating system.
+
+Samples held in the reorder buffer are in memory only and are lost if the process crashes.
+
+Storage backends
+
+Databases are stored in the data directory by default ("-backend fs"), a directory per database and a file per metric.
+
+"-backend kv" keeps all databases in a single "perfdb.kv" file in the data directory, so millions of metrics don't exhaust inodes and listing databases or metrics doesn't read directories.
+Samples are stored in chunks, full chunks of 256 samples are compressed.
+Every change is appended to the file as a batch with checksums, an incomplete batch is discarded on startup.
+The file is rewritten in the background once most of it is replaced or deleted data, writes go on meanwhile.
+
+"-backend memory" keeps databases in memory instead, everything is lost when the server exits.
+It's handy for ephemeral CI runs and tests: nothing touches the disk and there is nothing to clean up.
+
+All backends follow the same settings and answer the same queries.
+Export and import, snapshots, fsck and compaction work with data directories, so other backends return "501 Not Implemented".
+Sizes in listings are estimated by the in-memory backend.
+
+Migrating between backends
+
+Databases can be copied to another backend or directory with "migrate" command:
+
+	$ ./perfdb migrate -from data -to kv:data-kv
+	[1/2] mydatabase: 2 metrics, 2000 samples copied, verified
+	[2/2] otherdatabase: 5 metrics, 51200 samples copied, verified
+	2 databases (0 already migrated), 7 metrics, 53200 samples copied, 0 mismatches
+
+"-from" and "-to" are either a directory with databases stored by "fs" backend or "backend:directory".
+Samples are copied as they are stored, settings, metadata and annotations are copied as well.
+Every database is verified once copied: metric lists, sample counts and checksums of all samples must match.
+The command exits with non-zero status if they don't.
+A source directory of "fs" backend is never modified: a metric with a torn record or an incomplete commit stops the migration, run "fsck -repair" on a copy of the data first.
+
+Verified databases are recorded in "migration.json" file in the destination directory.
+If the migration is interrupted, run the same command again: verified databases are skipped and the copy of the last one is resumed.
+The file is removed once all databases are verified.
+The command works with data directories directly, so the server must be stopped.
+
+Web interface
+
+perfdb ships a small web interface, just open it in your browser:
+
+	http://127.0.0.1:8080/_ui
+
+It lists databases and metrics, shows summary tables, charts and heat maps, and allows to compare several databases side by side.
+
 Querying samples
 
 Only bulk queries are supported, but even they are not recommended.
@@ -90,8 +472,25 @@ Output is a JSON document with all timestamps and values:
 		]
 	]
 
-The first value in the nested list is the timestamp (the number of milliseconds elapsed since January 1, 1970 UTC).
-
+The first value in the nested list is the timestamp (the number of milliseconds elapsed since January 1, 1970 UTC, unless the database uses a different precision).
 The second value is the stored measurement (integer or float).
+
+The "precision" parameter ("s", "ms", "us" or "ns") converts timestamps to another unit:
+
+	$ curl -s "http://127.0.0.1:8080/mydatabase/read_latency?precision=us"
+
+Samples are streamed as they are read from disk, so even metrics with millions of samples can be exported at full resolution.
+A read error after the first sample closes the connection, so a truncated response is never mistaken for a complete one.
+The "format" parameter selects one of the output formats: "json" (default), "ndjson" (one {"ts":...,"value":...} object per line) or "csv" (with "ts,value" header):
+
+	$ curl -s "http://127.0.0.1:8080/mydatabase/read_latency?format=csv"
+	ts,value
+	1437137708114,10
+	1437137708118,15
+	1437137708122,16
+
+For instance, the CSV output can be loaded into pandas directly:
+
+	pandas.read_csv("http://127.0.0.1:8080/mydatabase/read_latency?format=csv")
 */
 package main
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Expressions derive a series from metrics of a database:
+//
+//	expr    = term {("+" | "-") term}
+//	term    = unary {("*" | "/") unary}
+//	unary   = "-" unary | primary
+//	primary = number | metric | func "(" expr ["," duration] ")" | "(" expr ")"
+//
+// Metric names are identifiers (letters, digits, "_", "." and ":") or
+// double-quoted strings. Series are aligned by timestamp: at every timestamp
+// of either operand, the latest values of both are combined. Samples that
+// are not finite numbers (e.g. division by zero) are dropped.
+
+type exprError string
+
+func (e exprError) Error() string {
+	return "invalid expression: " + string(e)
+}
+
+type exprNode interface {
+	eval(env *exprEnv) (*exprValue, error)
+}
+
+// exprValue is either a number or a series sorted by timestamp.
+type exprValue struct {
+	scalar  bool
+	v       float64
+	samples []Sample
+}
+
+// exprEnv reads metrics of the database, timestamps are in the database
+// precision.
+type exprEnv struct {
+	storage Storage
+	dbname  string
+	unit    time.Duration
+	metrics map[string][]Sample
+}
+
+type numberNode float64
+
+type durationNode time.Duration
+
+type metricNode string
+
+type binaryNode struct {
+	op          byte
+	left, right exprNode
+}
+
+type callNode struct {
+	fn   string
+	args []exprNode
+}
+
+var exprFunctions = map[string]struct {
+	args int
+	eval func(env *exprEnv, series []Sample, args []exprNode) ([]Sample, error)
+}{
+	"rate":       {1, evalRate},
+	"moving_avg": {2, evalMovingAvg},
+}
+
+// parseExpr parses the expression, see above.
+func parseExpr(input string) (exprNode, error) {
+	p := exprParser{input: input}
+	p.next()
+	node, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "" {
+		return nil, p.errorf("unexpected %q", p.token)
+	}
+	return node, nil
+}
+
+type exprParser struct {
+	input  string
+	pos    int    // Of the next token
+	start  int    // Of the current token
+	token  string // Empty at the end of the input
+	quoted bool   // Whether the token is a quoted name
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return p.errorAt(p.start, format, args...)
+}
+
+func (p *exprParser) errorAt(pos int, format string, args ...interface{}) error {
+	return exprError(fmt.Sprintf("%s at position %d", fmt.Sprintf(format, args...), pos+1))
+}
+
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == ':'
+}
+
+// next reads the next token. Numbers (without signed exponents), durations
+// and identifiers are single tokens, quoted names keep their quotes.
+func (p *exprParser) next() {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+	p.start = p.pos
+	p.quoted = false
+	if p.pos == len(p.input) {
+		p.token = ""
+		return
+	}
+
+	switch c := p.input[p.pos]; {
+	case c == '"':
+		end := p.pos + 1
+		for end < len(p.input) && p.input[end] != '"' {
+			if p.input[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		p.pos = end + 1
+		if p.pos > len(p.input) {
+			p.pos = len(p.input)
+		}
+		p.quoted = true
+	case strings.IndexByte("+-*/(),", c) >= 0:
+		p.pos++
+	default:
+		end := strings.IndexFunc(p.input[p.pos:], func(r rune) bool { return !isNameRune(r) })
+		if end < 0 {
+			end = len(p.input) - p.pos
+		}
+		if end == 0 {
+			_, end = utf8.DecodeRuneInString(p.input[p.pos:])
+		}
+		p.pos += end
+	}
+	p.token = p.input[p.start:p.pos]
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for !p.quoted && (p.token == "+" || p.token == "-") {
+		op := p.token[0]
+		p.next()
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for !p.quoted && (p.token == "*" || p.token == "/") {
+		op := p.token[0]
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if !p.quoted && p.token == "-" {
+		p.next()
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{'-', numberNode(0), node}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	token, start := p.token, p.start
+	switch {
+	case token == "":
+		return nil, p.errorf("unexpected end")
+	case p.quoted:
+		name, err := strconv.Unquote(token)
+		if err != nil {
+			return nil, p.errorf("malformed name %s", token)
+		}
+		p.next()
+		return metricNode(name), nil
+	case token == "(":
+		p.next()
+		node, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.token != ")" {
+			return nil, p.errorf("expected \")\"")
+		}
+		p.next()
+		return node, nil
+	case unicode.IsDigit(rune(token[0])):
+		if v, err := strconv.ParseFloat(token, 64); err == nil {
+			p.next()
+			return numberNode(v), nil
+		}
+		if d, err := time.ParseDuration(token); err == nil {
+			p.next()
+			return durationNode(d), nil
+		}
+		return nil, p.errorf("malformed number %q", token)
+	case !isNameRune([]rune(token)[0]):
+		return nil, p.errorf("unexpected %q", token)
+	}
+
+	p.next()
+	if p.quoted || p.token != "(" {
+		return metricNode(token), nil
+	}
+
+	fn, ok := exprFunctions[token]
+	if !ok {
+		return nil, p.errorAt(start, "unknown function %q", token)
+	}
+	p.next()
+	call := callNode{fn: token}
+	for {
+		arg, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+		if p.token != "," {
+			break
+		}
+		p.next()
+	}
+	if p.token != ")" {
+		return nil, p.errorf("expected \")\"")
+	}
+	if len(call.args) != fn.args {
+		return nil, p.errorAt(start, "%s takes %d arguments, got %d", token, fn.args, len(call.args))
+	}
+	p.next()
+	return &call, nil
+}
+
+func (n numberNode) eval(env *exprEnv) (*exprValue, error) {
+	return &exprValue{scalar: true, v: float64(n)}, nil
+}
+
+func (n durationNode) eval(env *exprEnv) (*exprValue, error) {
+	return nil, exprError(fmt.Sprintf("unexpected duration %s", time.Duration(n)))
+}
+
+func (n metricNode) eval(env *exprEnv) (*exprValue, error) {
+	name := string(n)
+	if samples, ok := env.metrics[name]; ok {
+		return &exprValue{samples: samples}, nil
+	}
+
+	if err := validateName(name); err != nil {
+		return nil, exprError(fmt.Sprintf("invalid metric name %q: %s", name, err))
+	}
+	if err := env.storage.checkMetricExists(env.dbname, name); os.IsNotExist(err) {
+		return nil, exprError(fmt.Sprintf("unknown metric %q", name))
+	} else if err != nil {
+		return nil, err
+	}
+
+	samples := []Sample{}
+	err := env.storage.streamRawValues(env.dbname, name, env.unit, func(sample Sample) error {
+		samples = append(samples, sample)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Out-of-order samples may be stored as is
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].ts < samples[j].ts })
+
+	env.metrics[name] = samples
+	return &exprValue{samples: samples}, nil
+}
+
+func applyOp(op byte, a, b float64) float64 {
+	switch op {
+	case '+':
+		return a + b
+	case '-':
+		return a - b
+	case '*':
+		return a * b
+	default:
+		return a / b
+	}
+}
+
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+func (n *binaryNode) eval(env *exprEnv) (*exprValue, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case left.scalar && right.scalar:
+		return &exprValue{scalar: true, v: applyOp(n.op, left.v, right.v)}, nil
+	case left.scalar || right.scalar:
+		series := left.samples
+		if left.scalar {
+			series = right.samples
+		}
+		samples := make([]Sample, 0, len(series))
+		for _, sample := range series {
+			a, b := left.v, right.v
+			if left.scalar {
+				b = sample.v
+			} else {
+				a = sample.v
+			}
+			if v := applyOp(n.op, a, b); isFinite(v) {
+				samples = append(samples, Sample{sample.ts, v})
+			}
+		}
+		return &exprValue{samples: samples}, nil
+	}
+
+	// Both are series: merge timestamps and combine the latest values
+	a, b := left.samples, right.samples
+	samples := []Sample{}
+	var i, j int
+	var lastA, lastB *Sample
+	for i < len(a) || j < len(b) {
+		var ts int64
+		switch {
+		case j == len(b) || (i < len(a) && a[i].ts < b[j].ts):
+			ts, lastA = a[i].ts, &a[i]
+			i++
+		case i == len(a) || b[j].ts < a[i].ts:
+			ts, lastB = b[j].ts, &b[j]
+			j++
+		default:
+			ts, lastA, lastB = a[i].ts, &a[i], &b[j]
+			i++
+			j++
+		}
+		if lastA == nil || lastB == nil {
+			continue
+		}
+		if v := applyOp(n.op, lastA.v, lastB.v); isFinite(v) {
+			samples = append(samples, Sample{ts, v})
+		}
+	}
+	return &exprValue{samples: samples}, nil
+}
+
+func (n *callNode) eval(env *exprEnv) (*exprValue, error) {
+	arg, err := n.args[0].eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if arg.scalar {
+		return nil, exprError(fmt.Sprintf("%s expects a series", n.fn))
+	}
+	samples, err := exprFunctions[n.fn].eval(env, arg.samples, n.args[1:])
+	if err != nil {
+		return nil, err
+	}
+	return &exprValue{samples: samples}, nil
+}
+
+// evalRate returns the per-second rate of a counter. A decrease means that
+// the counter was reset.
+func evalRate(env *exprEnv, series []Sample, args []exprNode) ([]Sample, error) {
+	samples := []Sample{}
+	second := float64(time.Second / env.unit)
+	for i := 1; i < len(series); i++ {
+		prev, cur := series[i-1], series[i]
+		if cur.ts == prev.ts {
+			continue
+		}
+		increase := cur.v - prev.v
+		if increase < 0 {
+			increase = cur.v
+		}
+		samples = append(samples, Sample{cur.ts, increase * second / float64(cur.ts-prev.ts)})
+	}
+	return samples, nil
+}
+
+// evalMovingAvg returns the average of samples within the window that ends
+// at every sample.
+func evalMovingAvg(env *exprEnv, series []Sample, args []exprNode) ([]Sample, error) {
+	d, ok := args[0].(durationNode)
+	if !ok || d <= 0 {
+		return nil, exprError("moving_avg expects a positive duration, e.g. 30s")
+	}
+	window := int64(time.Duration(d) / env.unit)
+	if window == 0 {
+		return nil, exprError("moving_avg window is shorter than the database precision")
+	}
+
+	samples := make([]Sample, 0, len(series))
+	sum := 0.0
+	first := 0
+	for i, sample := range series {
+		sum += sample.v
+		for series[first].ts <= sample.ts-window {
+			sum -= series[first].v
+			first++
+		}
+		samples = append(samples, Sample{sample.ts, sum / float64(i-first+1)})
+	}
+	return samples, nil
+}
+
+// evalExpr evaluates the expression over metrics of the database and returns
+// the series with timestamps in the database precision.
+func evalExpr(storage Storage, dbname, expr string) ([]Sample, time.Duration, error) {
+	node, err := parseExpr(expr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	settings, err := storage.getSettings(dbname)
+	if err != nil {
+		return nil, 0, err
+	}
+	env := exprEnv{storage: storage, dbname: dbname, unit: settings.unit(), metrics: map[string][]Sample{}}
+
+	value, err := node.eval(&env)
+	if err != nil {
+		return nil, 0, err
+	}
+	if value.scalar {
+		return nil, 0, exprError("the expression does not refer to any metric")
+	}
+	return value.samples, env.unit, nil
+}
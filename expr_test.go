@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newExprTestStorage(t *testing.T) Storage {
+	storage := newMemStorage()
+	for _, s := range []struct {
+		metric string
+		ts     int64
+		v      float64
+	}{
+		{"ops_total", 1000, 100}, {"ops_total", 2000, 300}, {"ops_total", 4000, 700}, {"ops_total", 5000, 50},
+		{"hits", 1000, 3}, {"hits", 2000, 6}, {"hits", 3000, 9},
+		{"misses", 1000, 1}, {"misses", 2500, 0},
+		{"read latency", 1000, 0.5}, {"read latency", 2000, 1.5},
+	} {
+		if err := storage.addSample("database", s.metric, Sample{s.ts, s.v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return storage
+}
+
+func TestEvalExpr(t *testing.T) {
+	storage := newExprTestStorage(t)
+
+	for expr, expected := range map[string][]Sample{
+		`rate(ops_total)`:               {{2000, 200}, {4000, 200}, {5000, 50}},
+		`"read latency" * 1000`:         {{1000, 500}, {2000, 1500}},
+		`-(1 + 1) * hits`:               {{1000, -6}, {2000, -12}, {3000, -18}},
+		`hits / (hits + misses)`:        {{1000, 0.75}, {2000, 0.8571428571428571}, {2500, 1}, {3000, 1}},
+		`misses / misses`:               {{1000, 1}},
+		`moving_avg(hits, 2s)`:          {{1000, 3}, {2000, 4.5}, {3000, 7.5}},
+		`moving_avg(ops_total, 2500ms)`: {{1000, 100}, {2000, 200}, {4000, 500}, {5000, 375}},
+		`2 * 3 - hits / 1.5e0`:          {{1000, 4}, {2000, 2}, {3000, 0}},
+	} {
+		samples, _, err := evalExpr(storage, "database", expr)
+		assert.Nil(t, err, expr)
+		assert.Equal(t, expected, samples, expr)
+	}
+}
+
+func TestEvalExprErrors(t *testing.T) {
+	storage := newExprTestStorage(t)
+
+	for expr, expected := range map[string]string{
+		``:                      "unexpected end at position 1",
+		`hits +`:                "unexpected end at position 7",
+		`(hits`:                 "expected \")\" at position 6",
+		`hits hits`:             "unexpected \"hits\" at position 6",
+		`hits % 2`:              "unexpected \"%\" at position 6",
+		`1 + 2`:                 "the expression does not refer to any metric",
+		`cpu`:                   "unknown metric \"cpu\"",
+		`sum(hits)`:             "unknown function \"sum\" at position 1",
+		`rate(hits, 1s)`:        "rate takes 1 arguments, got 2 at position 1",
+		`rate(1)`:               "rate expects a series",
+		`moving_avg(hits, 2)`:   "moving_avg expects a positive duration, e.g. 30s",
+		`moving_avg(hits, 1us)`: "moving_avg window is shorter than the database precision",
+		`hits * 5s`:             "unexpected duration 5s",
+		`5x`:                    "malformed number \"5x\" at position 1",
+		`"hits`:                 "malformed name \"hits at position 1",
+	} {
+		_, _, err := evalExpr(storage, "database", expr)
+		assert.Equal(t, exprError(expected), err, expr)
+	}
+}
+
+func TestExprEndpoints(t *testing.T) {
+	controller := newController(newExprTestStorage(t))
+	get := func(path, expr, query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/_db/database/"+path+"?q="+url.QueryEscape(expr)+query, nil)
+		rw := httptest.NewRecorder()
+		newRouter(controller).ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := get("expr", "hits * 2", "")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "[[1000,6],[2000,12],[3000,18]]", rw.Body.String())
+
+	rw = get("expr", "hits * 2", "&format=csv&precision=s")
+	assert.Equal(t, "ts,value\n1,6\n2,12\n3,18\n", rw.Body.String())
+
+	rw = get("expr/summary", "rate(ops_total)", "")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), "\"avg\":150,\"count\":3,")
+
+	rw = get("expr/heatmap", "hits / (hits + misses)", "")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), "hits / (hits + misses)")
+
+	// Negative, zero and single-sample series
+	for _, expr := range []string{"hits - 100", "-hits", "hits * 0", "misses / misses", `rate("read latency")`} {
+		rw = get("expr/heatmap", expr, "")
+		assert.Equal(t, http.StatusOK, rw.Code, expr)
+		assert.Contains(t, rw.Body.String(), "<!-- Generated by SVGo -->", expr)
+	}
+
+	rw = get("expr/summary", "missing + 1", "")
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Equal(t, "{\"error\":\"invalid expression: unknown metric \\\"missing\\\"\"}", rw.Body.String())
+
+	rw = get("expr/summary", "misses / 0", "")
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
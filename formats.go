@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// sampleWriter serializes a stream of samples. Nothing is buffered except for
+// the underlying bufio.Writer, so memory use doesn't depend on the number of
+// samples.
+type sampleWriter interface {
+	begin() error
+	write(sample Sample) error
+	end() error
+}
+
+var contentTypes = map[string]string{
+	"json":   "application/json; charset=utf-8",
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv; charset=utf-8",
+}
+
+func newSampleWriter(format string, w io.Writer) (sampleWriter, error) {
+	bw := bufio.NewWriter(w)
+	switch format {
+	case "", "json":
+		return &jsonWriter{w: bw}, nil
+	case "ndjson":
+		return &ndjsonWriter{w: bw}, nil
+	case "csv":
+		return &csvWriter{w: bw}, nil
+	default:
+		return nil, fmt.Errorf("format must be \"json\", \"ndjson\" or \"csv\", got %q", format)
+	}
+}
+
+// appendFloat formats the value the same way as encoding/json does.
+func appendFloat(b []byte, v float64) []byte {
+	abs := math.Abs(v)
+	format := byte('f')
+	if abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	b = strconv.AppendFloat(b, v, format, -1, 64)
+	if format == 'e' {
+		// Clean up e-09 to e-9
+		n := len(b)
+		if n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return b
+}
+
+// jsonWriter produces a single array of [timestamp, value] pairs.
+type jsonWriter struct {
+	w       *bufio.Writer
+	buf     []byte
+	written bool
+}
+
+func (jw *jsonWriter) begin() error {
+	return jw.w.WriteByte('[')
+}
+
+func (jw *jsonWriter) write(sample Sample) error {
+	jw.buf = jw.buf[:0]
+	if jw.written {
+		jw.buf = append(jw.buf, ',')
+	}
+	jw.buf = append(jw.buf, '[')
+	jw.buf = strconv.AppendInt(jw.buf, sample.ts, 10)
+	jw.buf = append(jw.buf, ',')
+	jw.buf = appendFloat(jw.buf, sample.v)
+	jw.buf = append(jw.buf, ']')
+	jw.written = true
+
+	_, err := jw.w.Write(jw.buf)
+	return err
+}
+
+func (jw *jsonWriter) end() error {
+	if err := jw.w.WriteByte(']'); err != nil {
+		return err
+	}
+	return jw.w.Flush()
+}
+
+// ndjsonWriter produces one {"ts":timestamp,"value":value} object per line.
+type ndjsonWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+func (nw *ndjsonWriter) begin() error {
+	return nil
+}
+
+func (nw *ndjsonWriter) write(sample Sample) error {
+	nw.buf = append(nw.buf[:0], `{"ts":`...)
+	nw.buf = strconv.AppendInt(nw.buf, sample.ts, 10)
+	nw.buf = append(nw.buf, `,"value":`...)
+	nw.buf = appendFloat(nw.buf, sample.v)
+	nw.buf = append(nw.buf, "}\n"...)
+
+	_, err := nw.w.Write(nw.buf)
+	return err
+}
+
+func (nw *ndjsonWriter) end() error {
+	return nw.w.Flush()
+}
+
+// csvWriter produces a "ts,value" header followed by one sample per line.
+type csvWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+func (cw *csvWriter) begin() error {
+	_, err := cw.w.WriteString("ts,value\n")
+	return err
+}
+
+func (cw *csvWriter) write(sample Sample) error {
+	cw.buf = strconv.AppendInt(cw.buf[:0], sample.ts, 10)
+	cw.buf = append(cw.buf, ',')
+	cw.buf = appendFloat(cw.buf, sample.v)
+	cw.buf = append(cw.buf, '\n')
+
+	_, err := cw.w.Write(cw.buf)
+	return err
+}
+
+func (cw *csvWriter) end() error {
+	return cw.w.Flush()
+}
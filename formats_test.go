@@ -0,0 +1,15 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendFloat(t *testing.T) {
+	for _, v := range []float64{0, 1, -1.5, 575.11, 100510051005, 1e-7, 1.5e-9, 1e21, -2.5e300} {
+		expected, _ := json.Marshal(v)
+		assert.Equal(t, string(expected), string(appendFloat(nil, v)))
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fsck checks that every metric has a valid header (see datafile.go) and one
+// record per line. Legacy metrics also need a .1 file with the first
+// timestamp and a .n file with the last timestamp, which must equal the first
+// one plus all deltas. The .n file also holds the size of the data at the last
+// commit.
+//
+// In repair mode, torn and unparsable records are removed and the .1/.n files
+// are rebuilt from the data. The .1 file is trusted over the .n file since it's
+// written only once.
+
+type FsckProblem struct {
+	File     string `json:"file"`
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired"`
+}
+
+type FsckReport struct {
+	Databases int           `json:"databases"`
+	Metrics   int           `json:"metrics"`
+	Problems  []FsckProblem `json:"problems"`
+}
+
+var knownFiles = map[string]bool{
+	metaFile:        true,
+	metricsMetaFile: true,
+	annotationsFile: true,
+	settingsFile:    true,
+}
+
+type fsck struct {
+	baseDir     string
+	repair      bool
+	report      FsckReport
+	compressing map[string]bool // See perfDB.compressing
+}
+
+// problem records a problem and returns its index in the report.
+func (f *fsck) problem(fileName, format string, args ...interface{}) int {
+	relPath, err := filepath.Rel(f.baseDir, fileName)
+	if err != nil {
+		relPath = fileName
+	}
+	f.report.Problems = append(f.report.Problems, FsckProblem{File: relPath, Problem: fmt.Sprintf(format, args...)})
+	return len(f.report.Problems) - 1
+}
+
+func (f *fsck) repaired(problems ...int) {
+	for _, i := range problems {
+		f.report.Problems[i].Repaired = true
+	}
+}
+
+// remove deletes the file in repair mode.
+func (f *fsck) remove(fileName, format string, args ...interface{}) error {
+	problem := f.problem(fileName, format, args...)
+	if !f.repair {
+		return nil
+	}
+	if err := os.RemoveAll(fileName); err != nil {
+		return err
+	}
+	f.repaired(problem)
+	return nil
+}
+
+// dataScan is the result of reading a .data file.
+type dataScan struct {
+	records  int
+	sum      int64 // Sum of all deltas, only legacy files have no checkpoints
+	last     int64 // Last timestamp, unknown for legacy files
+	badLines []int
+	lost     int // Records with unknown timestamps after unparsable ones
+	torn     bool
+}
+
+func scanData(dataFile string) (*dataScan, error) {
+	file, err := openData(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scan := dataScan{}
+	gap := false
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		record, err := reader.ReadString('\n')
+		if err == io.EOF {
+			scan.torn = record != ""
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if isHeader(record, line) {
+			if header, err := parseHeader(record); err == nil {
+				scan.last = header.base
+			}
+			continue
+		}
+		sample, err := parseLine(record, 0)
+		if err != nil {
+			scan.badLines = append(scan.badLines, line)
+			gap = true
+			continue
+		}
+		if gap && !strings.HasPrefix(record, checkpointPrefix) {
+			scan.lost++
+			continue
+		}
+		gap = false
+		scan.records++
+		scan.sum += sample.ts
+		if !strings.HasPrefix(record, checkpointPrefix) {
+			sample.ts += scan.last
+		}
+		scan.last = sample.ts
+	}
+	return &scan, nil
+}
+
+// rewriteData keeps only parsable and complete records. Records that follow
+// an unparsable one are removed up to the next checkpoint: they are deltas from
+// a lost timestamp.
+func rewriteData(dataFile string) error {
+	in, err := os.Open(dataFile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return replaceFile(dataFile, func(w io.Writer) error {
+		writer := bufio.NewWriter(w)
+		reader := bufio.NewReader(in)
+		gap := false
+		for line := 1; ; line++ {
+			record, err := reader.ReadString('\n')
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			if isHeader(record, line) {
+				writer.WriteString(record)
+				continue
+			}
+			if _, err := parseLine(record, 0); err != nil {
+				gap = true
+				continue
+			}
+			// Deltas after a lost record don't give the right timestamps
+			if gap && !strings.HasPrefix(record, checkpointPrefix) {
+				continue
+			}
+			gap = false
+			writer.WriteString(record)
+		}
+		return writer.Flush()
+	})
+}
+
+func readStoredTimestamp(fileName string) (int64, error) {
+	timestampCache.Delete(fileName)
+	return readTimestamp(fileName)
+}
+
+func (f *fsck) checkMetric(dataFile string) error {
+	header, err := readHeader(dataFile)
+	if err != nil {
+		f.problem(dataFile, "invalid header: %s", err)
+		return nil
+	}
+	if header != nil && header.compressedHeader != nil {
+		return f.checkCompressed(dataFile, header)
+	}
+
+	scan, err := scanData(dataFile)
+	if err != nil {
+		return err
+	}
+
+	var problems []int
+	if scan.torn {
+		problems = append(problems, f.problem(dataFile, "torn last record"))
+	}
+	for _, line := range scan.badLines {
+		problems = append(problems, f.problem(dataFile, "unparsable record at line %d", line))
+	}
+	if scan.lost > 0 {
+		problems = append(problems, f.problem(dataFile, "%d records with unknown timestamps after unparsable records", scan.lost))
+	}
+	if f.repair && len(problems) > 0 {
+		if err := rewriteData(dataFile); err != nil {
+			return err
+		}
+		f.repaired(problems...)
+	}
+
+	if header == nil {
+		return f.checkLegacyMetric(dataFile, problems)
+	}
+	// Leftovers of an interrupted conversion
+	for _, fileName := range []string{dataFile + ".1", dataFile + ".n"} {
+		if _, err := os.Stat(fileName); err == nil {
+			if err := f.remove(fileName, "leftover file of a legacy metric"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fsck) checkLegacyMetric(dataFile string, problems []int) error {
+	scan, err := scanData(dataFile)
+	if err != nil {
+		return err
+	}
+
+	first, firstErr := readStoredTimestamp(dataFile + ".1")
+	last, lastErr := readStoredTimestamp(dataFile + ".n")
+
+	if firstErr != nil {
+		problem := f.problem(dataFile+".1", "invalid first timestamp: %s", firstErr)
+		if lastErr != nil {
+			f.problem(dataFile+".n", "invalid last timestamp: %s", lastErr)
+			return nil // Nothing to rebuild from
+		}
+		// The first record has zero delta
+		first = last - scan.sum
+		if f.repair {
+			if err := storeTimestamp(dataFile+".1", first); err != nil {
+				return err
+			}
+			f.repaired(problem)
+		}
+		return nil
+	}
+
+	if expected := first + scan.sum; lastErr != nil || last != expected {
+		var problem int
+		if lastErr != nil {
+			problem = f.problem(dataFile+".n", "invalid last timestamp: %s", lastErr)
+		} else {
+			problem = f.problem(dataFile+".n", "last timestamp is %d, data ends at %d", last, expected)
+		}
+		if f.repair {
+			if err := storeLastTimestamp(dataFile, expected); err != nil {
+				return err
+			}
+			f.repaired(problem)
+		}
+		return nil
+	}
+
+	// Size of the data at the last commit, see storeLastTimestamp. Broken
+	// records already explain a mismatch unless they were removed.
+	if len(problems) > 0 && !f.repair {
+		return nil
+	}
+	_, size, err := readCommit(dataFile)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(dataFile)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && size != info.Size() {
+		problem := f.problem(dataFile+".n", "committed size is %d, data has %d bytes", size, info.Size())
+		if f.repair {
+			if err := storeLastTimestamp(dataFile, last); err != nil {
+				return err
+			}
+			f.repaired(problem)
+		}
+	}
+	return nil
+}
+
+func (f *fsck) checkDatabase(dataDir string) error {
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return err
+	}
+
+	names := map[string]bool{}
+	for _, file := range files {
+		names[file.Name()] = true
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		fileName := filepath.Join(dataDir, name)
+
+		switch ext := filepath.Ext(name); {
+		case ext == dataFileExt:
+			f.report.Metrics++
+			if err := f.checkMetric(fileName); err != nil {
+				return err
+			}
+		case ext == ".1" || ext == ".n":
+			if !names[strings.TrimSuffix(name, ext)] {
+				if err := f.remove(fileName, "orphan file"); err != nil {
+					return err
+				}
+			}
+		case ext == ".tmp":
+			if f.compressing[strings.TrimSuffix(fileName, compressedTmpExt)] {
+				continue
+			}
+			if err := f.remove(fileName, "leftover temporary file"); err != nil {
+				return err
+			}
+		case !knownFiles[name]:
+			f.problem(fileName, "unknown file")
+		}
+	}
+	return nil
+}
+
+// fsck checks all databases. Writes are blocked until it completes.
+func (pdb *perfDB) fsck(repair bool) (*FsckReport, error) {
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+
+	if err := pdb.flushAll(); err != nil {
+		return nil, err
+	}
+
+	f := fsck{baseDir: pdb.baseDir, repair: repair, compressing: pdb.compressing}
+	f.report.Problems = []FsckProblem{}
+
+	files, err := ioutil.ReadDir(pdb.baseDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		fileName := filepath.Join(pdb.baseDir, file.Name())
+		if !file.IsDir() {
+			f.problem(fileName, "unknown file")
+			continue
+		}
+		// Exports and imports use temporary directories without holding the
+		// lock, so they are never removed automatically.
+		if strings.HasPrefix(file.Name(), "_") {
+			f.problem(fileName, "temporary directory")
+			continue
+		}
+		dbname, err := unescapeName(file.Name())
+		if err != nil || validateDbName(dbname) != nil {
+			f.problem(fileName, "unknown directory")
+			continue
+		}
+
+		f.report.Databases++
+		if err := f.checkDatabase(fileName); err != nil {
+			return nil, err
+		}
+	}
+	return &f.report, nil
+}
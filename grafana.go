@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The Grafana SimpleJSON datasource API. Targets are queries (see query.go),
+// search suggests a query for every metric of every database. Time ranges of
+// requests restrict the queries, and queries without GROUP BY are bucketed by
+// the panel interval.
+
+const maxSearchResults = 1000
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaSearchRequest struct {
+	Target string `json:"target"`
+}
+
+type grafanaSearchResult struct {
+	Text  string `json:"text"`
+	Value string `json:"value"`
+}
+
+type grafanaQueryRequest struct {
+	Range      grafanaRange `json:"range"`
+	IntervalMs int64        `json:"intervalMs"`
+	Targets    []struct {
+		Target string `json:"target"`
+		Hide   bool   `json:"hide"`
+	} `json:"targets"`
+}
+
+type grafanaAnnotationRequest struct {
+	Range      grafanaRange           `json:"range"`
+	Annotation map[string]interface{} `json:"annotation"`
+}
+
+type grafanaAnnotation struct {
+	Annotation map[string]interface{} `json:"annotation"`
+	Time       int64                  `json:"time"` // Milliseconds
+	Title      string                 `json:"title"`
+	Text       string                 `json:"text"`
+	Tags       []string               `json:"tags"`
+}
+
+// quoteQueryPattern returns a query string that matches the name literally.
+func quoteQueryPattern(name string) string {
+	var escaped []byte
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '*', '?', '[', '\\':
+			escaped = append(escaped, '\\', '\\', name[i])
+		case '\'':
+			escaped = append(escaped, '\\', name[i])
+		default:
+			escaped = append(escaped, name[i])
+		}
+	}
+	return "'" + string(escaped) + "'"
+}
+
+func quoteQueryName(name string) string {
+	return `"` + strings.Replace(strings.Replace(name, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+// checkGrafana answers the connection test of the datasource.
+func (c *Controller) checkGrafana(context *gin.Context) {
+	context.String(http.StatusOK, "OK")
+}
+
+// searchGrafana suggests metrics that contain the target in their names or
+// in names of their databases.
+func (c *Controller) searchGrafana(context *gin.Context) {
+	var request grafanaSearchRequest
+	if err := context.BindJSON(&request); err != nil {
+		context.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	target := strings.ToLower(request.Target)
+
+	databases, err := c.storage.listDatabases()
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	results := []grafanaSearchResult{}
+	for _, dbname := range databases {
+		metrics, err := c.storage.listMetrics(dbname)
+		if err != nil {
+			context.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		for _, metric := range metrics {
+			text := dbname + " " + metric
+			if !strings.Contains(strings.ToLower(text), target) {
+				continue
+			}
+			if len(results) == maxSearchResults {
+				context.JSON(http.StatusOK, results)
+				return
+			}
+			query := fmt.Sprintf("SELECT avg(value) FROM %s WHERE db = %s", quoteQueryName(metric), quoteQueryPattern(dbname))
+			results = append(results, grafanaSearchResult{text, query})
+		}
+	}
+	context.JSON(http.StatusOK, results)
+}
+
+// queryGrafana runs queries of all visible targets within the time range.
+func (c *Controller) queryGrafana(context *gin.Context) {
+	var request grafanaQueryRequest
+	if err := context.BindJSON(&request); err != nil {
+		context.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	result := []QuerySeries{}
+	for _, target := range request.Targets {
+		if target.Hide || target.Target == "" {
+			continue
+		}
+		plan, err := parseQuery(target.Target, time.Now())
+		if err != nil {
+			abortWithMessage(context, http.StatusBadRequest, err)
+			return
+		}
+		if !request.Range.From.IsZero() && request.Range.From.UnixNano() > plan.from {
+			plan.from = request.Range.From.UnixNano()
+		}
+		if !request.Range.To.IsZero() && request.Range.To.UnixNano() < plan.to {
+			plan.to = request.Range.To.UnixNano() + 1 // Inclusive
+		}
+		if plan.interval == 0 && request.IntervalMs > 0 {
+			plan.interval = time.Duration(request.IntervalMs) * time.Millisecond
+		}
+
+		series, err := plan.execute(c.storage)
+		if err != nil {
+			context.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		result = append(result, series...)
+	}
+	context.JSON(http.StatusOK, result)
+}
+
+// getGrafanaAnnotations returns annotations of databases that match the glob
+// pattern in the annotation query, or of all databases.
+func (c *Controller) getGrafanaAnnotations(context *gin.Context) {
+	var request grafanaAnnotationRequest
+	if err := context.BindJSON(&request); err != nil {
+		context.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	pattern, _ := request.Annotation["query"].(string)
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		abortWithMessage(context, http.StatusBadRequest, fmt.Errorf("malformed pattern %q", pattern))
+		return
+	}
+
+	databases, err := c.storage.listDatabases()
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	result := []grafanaAnnotation{}
+	for _, dbname := range databases {
+		if ok, _ := filepath.Match(pattern, dbname); pattern != "" && !ok {
+			continue
+		}
+		settings, err := c.storage.getSettings(dbname)
+		if err != nil {
+			context.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		// Zero means no limit
+		var from, to int64
+		if !request.Range.From.IsZero() {
+			from = convertPrecision(request.Range.From.UnixNano(), time.Nanosecond, settings.unit())
+		}
+		if !request.Range.To.IsZero() {
+			to = convertPrecision(request.Range.To.UnixNano(), time.Nanosecond, settings.unit())
+		}
+		annotations, err := c.storage.getAnnotations(dbname, from, to)
+		if err != nil {
+			context.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		for _, annotation := range annotations {
+			result = append(result, grafanaAnnotation{
+				Annotation: request.Annotation,
+				Time:       convertPrecision(annotation.Timestamp, settings.unit(), time.Millisecond),
+				Title:      dbname,
+				Text:       annotation.Text,
+				Tags:       []string{dbname},
+			})
+		}
+	}
+	context.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postTestGrafana(controller *Controller, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/_grafana/"+path, bytes.NewBufferString(body))
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	return rw
+}
+
+func TestGrafanaSearch(t *testing.T) {
+	storage := newQueryTestStorage(t)
+	storage.addSample("run*[1]'s", "read \"latency\"", Sample{1411940880000, 7})
+	controller := newController(storage)
+
+	req, _ := http.NewRequest("GET", "/_grafana/", nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	rw = postTestGrafana(controller, "search", "{\"target\":\"RUN\"}")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	var results []grafanaSearchResult
+	json.Unmarshal(rw.Body.Bytes(), &results)
+	assert.Equal(t, []grafanaSearchResult{
+		{"run*[1]'s read \"latency\"", `SELECT avg(value) FROM "read \"latency\"" WHERE db = 'run\\*\\[1]\'s'`},
+		{"run-1 latency", `SELECT avg(value) FROM "latency" WHERE db = 'run-1'`},
+		{"run-2 latency", `SELECT avg(value) FROM "latency" WHERE db = 'run-2'`},
+	}, results)
+
+	// Suggested queries select exactly one database
+	for _, result := range results {
+		rw = postTestGrafana(controller, "query", "{\"targets\":[{\"target\":"+string(mustMarshal(t, result.Value))+"}]}")
+		var series []QuerySeries
+		json.Unmarshal(rw.Body.Bytes(), &series)
+		assert.Equal(t, 1, len(series), result.Value)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGrafanaQuery(t *testing.T) {
+	controller := newController(newQueryTestStorage(t))
+
+	rw := postTestGrafana(controller, "query", `{
+		"range": {"from": "2014-09-28T21:48:20Z", "to": "2014-09-28T21:49:20Z"},
+		"intervalMs": 30000,
+		"targets": [
+			{"target": "SELECT max(value) FROM latency WHERE db = 'run-1'", "refId": "A"},
+			{"target": "SELECT count(*) FROM latency WHERE db = 'run-2' GROUP BY time(1h)", "refId": "B"},
+			{"target": "SELECT min(value) FROM latency", "refId": "C", "hide": true}
+		]
+	}`)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	var series []QuerySeries
+	json.Unmarshal(rw.Body.Bytes(), &series)
+	assert.Equal(t, []QuerySeries{
+		{"run-1 latency max", [][2]float64{{2, 1411940880000}, {3, 1411940910000}, {5, 1411940940000}}},
+		{"run-2 latency count", [][2]float64{{4, 1411938000000}}},
+	}, series)
+
+	rw = postTestGrafana(controller, "query", `{"targets": [{"target": "latency"}]}`)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Equal(t, "{\"error\":\"invalid query: expected SELECT at position 1\"}", rw.Body.String())
+}
+
+func TestGrafanaAnnotations(t *testing.T) {
+	storage := newQueryTestStorage(t)
+	storage.setSettings("run-3", DatabaseSettings{OutOfOrder: acceptOutOfOrder, Duplicates: keepDuplicates, Precision: "s"})
+	storage.addAnnotation("run-1", Annotation{1411940880000, "start"})
+	storage.addAnnotation("run-1", Annotation{1411950880000, "later"})
+	storage.addAnnotation("run-3", Annotation{1411940890, "restart"})
+	storage.addAnnotation("other", Annotation{1411940890000, "other"})
+	controller := newController(storage)
+
+	rw := postTestGrafana(controller, "annotations", `{
+		"range": {"from": "2014-09-28T21:48:00Z", "to": "2014-09-28T21:49:00Z"},
+		"annotation": {"name": "runs", "query": "run-*"}
+	}`)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	var annotations []grafanaAnnotation
+	json.Unmarshal(rw.Body.Bytes(), &annotations)
+	annotation := map[string]interface{}{"name": "runs", "query": "run-*"}
+	assert.Equal(t, []grafanaAnnotation{
+		{annotation, 1411940880000, "run-1", "start", []string{"run-1"}},
+		{annotation, 1411940890000, "run-3", "restart", []string{"run-3"}},
+	}, annotations)
+
+	rw = postTestGrafana(controller, "annotations", `{"annotation": {"query": "["}}`)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+}
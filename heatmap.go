@@ -1,11 +1,20 @@
 package main
 
+import (
+	"math"
+	"time"
+)
+
 type heatMap struct {
-	MinTS      int64   `json:"minTimestamp"`
-	MaxTS      int64   `json:"maxTimestamp"`
-	MaxValue   float64 `json:"maxValue"`
-	Map        [][]int `json:"map"`
-	maxDensity int     // Private field
+	MinTS       int64        `json:"minTimestamp"`
+	MaxTS       int64        `json:"maxTimestamp"`
+	MinValue    float64      `json:"minValue"`
+	MaxValue    float64      `json:"maxValue"`
+	Map         [][]int      `json:"map"`
+	Annotations []Annotation `json:"annotations"`
+	maxDensity  int          // Private field
+	unit        time.Duration
+	runs        bool // Timestamps are relative to the start of every run
 }
 
 const (
@@ -14,7 +23,7 @@ const (
 )
 
 func newHeatMap() *heatMap {
-	hm := heatMap{}
+	hm := heatMap{unit: time.Millisecond}
 	hm.Map = [][]int{}
 	for y := 0; y < heatMapHeight; y++ {
 		hm.Map = append(hm.Map, []int{})
@@ -24,3 +33,45 @@ func newHeatMap() *heatMap {
 	}
 	return &hm
 }
+
+// buildHeatMap counts samples in every cell of the map, timestamps are in
+// the given unit. The value axis always includes zero.
+func buildHeatMap(samples []Sample, unit time.Duration) *heatMap {
+	hm := newHeatMap()
+	hm.MinTS = int64(^uint64(0) >> 1)
+	hm.unit = unit
+
+	for _, sample := range samples {
+		hm.MinValue = math.Min(hm.MinValue, sample.v)
+		hm.MaxValue = math.Max(hm.MaxValue, sample.v)
+		// Samples may be out of order
+		if sample.ts < hm.MinTS {
+			hm.MinTS = sample.ts
+		}
+		if sample.ts > hm.MaxTS {
+			hm.MaxTS = sample.ts
+		}
+	}
+
+	for _, sample := range samples {
+		// A single timestamp or value falls into the first column or row
+		var x, y float64
+		if hm.MaxTS > hm.MinTS {
+			x = math.Floor(heatMapWidth * float64(sample.ts-hm.MinTS) / float64(hm.MaxTS-hm.MinTS))
+		}
+		if hm.MaxValue > hm.MinValue {
+			y = math.Floor(heatMapHeight * (sample.v - hm.MinValue) / (hm.MaxValue - hm.MinValue))
+		}
+		if x == heatMapWidth {
+			x--
+		}
+		if y == heatMapHeight {
+			y--
+		}
+		hm.Map[int(y)][int(x)]++
+		if hm.Map[int(y)][int(x)] > hm.maxDensity {
+			hm.maxDensity = hm.Map[int(y)][int(x)]
+		}
+	}
+	return hm
+}
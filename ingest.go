@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+type fieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+type ingestResponse struct {
+	Status  string       `json:"status"`
+	Errors  []fieldError `json:"errors,omitempty"`
+	Dropped []fieldError `json:"dropped,omitempty"`
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func isStrict(context *gin.Context, defaultMode bool) (bool, error) {
+	switch mode := context.Query("mode"); mode {
+	case "":
+		return defaultMode, nil
+	case "strict":
+		return true, nil
+	case "lenient":
+		return false, nil
+	default:
+		return false, fmt.Errorf("unknown mode: %s", mode)
+	}
+}
+
+func parseFlatten(context *gin.Context, defaultFlatten bool) (string, error) {
+	flatten := defaultFlatten
+	switch value := context.Query("flatten"); value {
+	case "":
+	case "true":
+		flatten = true
+	case "false":
+		flatten = false
+	default:
+		return "", fmt.Errorf("flatten must be true or false, got %q", value)
+	}
+	if !flatten {
+		return "", nil
+	}
+
+	separator := context.DefaultQuery("separator", ".")
+	if separator == "" {
+		return "", errors.New("separator must not be empty")
+	}
+	return separator, nil
+}
+
+// collectValues extracts numeric values from the document. Arrays of numbers
+// become multiple values of the same metric. Nested objects are flattened into
+// names joined by separator, or reported as invalid fields if separator is empty.
+func collectValues(doc map[string]interface{}, separator string) (map[string][]float64, []fieldError) {
+	values := map[string][]float64{}
+	var problems []fieldError
+
+	var collect func(metric, field string, value interface{}, inArray bool)
+	collect = func(metric, field string, value interface{}, inArray bool) {
+		switch v := value.(type) {
+		case float64:
+			values[metric] = append(values[metric], v)
+		case []interface{}:
+			if !inArray {
+				for i, item := range v {
+					collect(metric, fmt.Sprintf("%s[%d]", field, i), item, true)
+				}
+				return
+			}
+			problems = append(problems, fieldError{field, "expected a number, got array"})
+		case map[string]interface{}:
+			if separator != "" && !inArray {
+				for _, key := range sortedKeys(v) {
+					collect(metric+separator+key, field+separator+key, v[key], false)
+				}
+				return
+			}
+			problems = append(problems, fieldError{field, "expected a number, got object"})
+		default:
+			problems = append(problems, fieldError{field, "expected a number, got " + jsonType(value)})
+		}
+	}
+
+	for _, key := range sortedKeys(doc) {
+		collect(key, key, doc[key], false)
+	}
+	return values, problems
+}
+
+func sortedKeys(doc map[string]interface{}) []string {
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// addSamples stores a JSON document of metric values. In strict mode any
+// invalid field rejects the whole document. In lenient mode invalid fields
+// are dropped and listed in the response, the rest is stored.
+// Invalid metric names and timestamps are always rejected.
+func (c *Controller) addSamples(context *gin.Context) {
+	strict, err := isStrict(context, c.strict)
+	if err != nil {
+		abortWithMessage(context, http.StatusBadRequest, err)
+		return
+	}
+
+	separator, err := parseFlatten(context, c.flatten)
+	if err != nil {
+		abortWithMessage(context, http.StatusBadRequest, err)
+		return
+	}
+
+	dbname := context.Param("db")
+
+	settings, err := c.storage.getSettings(dbname)
+	if err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	var problems []fieldError
+
+	timestamp := now(settings.unit())
+	if customTimestamp := context.Query("ts"); customTimestamp != "" {
+		if ts, err := convertTimestamp(customTimestamp, settings.unit()); err != nil {
+			problems = append(problems, fieldError{"ts", err.Error()})
+		} else {
+			timestamp = ts
+		}
+	}
+	// Samples cannot be stored without their timestamp, even in lenient mode
+	if len(problems) > 0 && !strict {
+		context.JSON(http.StatusBadRequest, ingestResponse{Status: "error", Errors: problems})
+		context.Abort()
+		return
+	}
+
+	var doc map[string]interface{}
+	if err := context.BindJSON(&doc); err != nil {
+		context.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	values, invalidValues := collectValues(doc, separator)
+	problems = append(problems, invalidValues...)
+
+	metrics := make([]string, 0, len(values))
+	for metric := range values {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	names := map[string]interface{}{}
+	for _, name := range append(sortedKeys(doc), metrics...) {
+		names[name] = nil
+	}
+	var invalidNames []fieldError
+	for _, name := range sortedKeys(names) {
+		if err := validateName(name); err != nil {
+			invalidNames = append(invalidNames, fieldError{name, "invalid metric name: " + err.Error()})
+		}
+	}
+	if len(invalidNames) > 0 {
+		context.JSON(http.StatusBadRequest, ingestResponse{Status: "error", Errors: invalidNames})
+		context.Abort()
+		return
+	}
+
+	if strict {
+		for _, metric := range metrics {
+			if err := c.storage.checkOrder(dbname, metric, timestamp); err == errOutOfOrder {
+				problems = append(problems, fieldError{metric, err.Error()})
+			} else if err != nil {
+				context.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+		}
+	}
+
+	if strict && len(problems) > 0 {
+		context.JSON(http.StatusBadRequest, ingestResponse{Status: "error", Errors: problems})
+		context.Abort()
+		return
+	}
+
+	for _, metric := range metrics {
+		for _, value := range values[metric] {
+			sample := Sample{timestamp, value}
+			err := c.storage.addSample(dbname, metric, sample)
+			c.cache.invalidate(dbname, metric)
+			if err == errOutOfOrder {
+				problems = append(problems, fieldError{metric, err.Error()})
+				break
+			} else if err != nil {
+				context.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+		}
+	}
+
+	context.JSON(http.StatusOK, ingestResponse{Status: "ok", Dropped: problems})
+}
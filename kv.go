@@ -0,0 +1,800 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// kvStorage keeps all databases in a single key-value file (see kvfile.go)
+// instead of a directory per database and a file per metric. Names cannot
+// contain NUL bytes, so keys are composed of names separated by kvSeparator:
+//
+//	d<db>\0                  database record: creation time, settings and metadata
+//	m<db>\0<metric>          metric record: counters and the last sample
+//	c<db>\0<metric>\0<start> chunk of samples starting with sample number <start>
+//	t<db>\0<metric>          metric metadata
+//	a<db>\0<ts><seq>         annotation
+//
+// Numbers in keys are big-endian, so chunks are scanned in the order samples
+// were stored and annotations in timestamp order. A sample is stored in a
+// chunk of its own first, once there are kvChunkSize such chunks, they are
+// merged into a compressed one. Databases and metrics are listed by scanning
+// key prefixes.
+
+const (
+	kvDatabasePrefix   = "d"
+	kvMetricPrefix     = "m"
+	kvChunkPrefix      = "c"
+	kvMetricMetaPrefix = "t"
+	kvAnnotationPrefix = "a"
+	kvSeparator        = "\x00"
+)
+
+const (
+	kvFileName  = "perfdb.kv"
+	kvChunkSize = 256
+)
+
+const (
+	rawChunk        byte = 'r'
+	compressedChunk byte = 'z'
+)
+
+// kvDatabase is the database record.
+type kvDatabase struct {
+	Created     int64                  `json:"created"` // Milliseconds
+	Settings    DatabaseSettings       `json:"settings"`
+	Meta        map[string]interface{} `json:"meta"`
+	Annotations uint64                 `json:"annotations"` // Sequence number of the next annotation
+}
+
+// kvMetric is the metric record.
+type kvMetric struct {
+	Created   int64   `json:"created"` // Milliseconds
+	Count     int     `json:"count"`
+	Head      int     `json:"head"` // Number of uncompressed chunks at the end
+	FirstTS   int64   `json:"firstTimestamp"`
+	LastTS    int64   `json:"lastTimestamp"`
+	LastValue float64 `json:"lastValue"`
+}
+
+type kvMetricID struct {
+	dbname, metric string
+}
+
+type kvStorage struct {
+	mu        sync.Mutex
+	kv        *kvFile
+	databases map[string]*kvDatabase // Decoded records
+	metrics   map[kvMetricID]*kvMetric
+	buffers   map[kvMetricID]*reorderBuffer
+	flusher   sync.Once
+}
+
+func newKVStorage(baseDir string) (*kvStorage, error) {
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		logger.Criticalf("Failed to initialize datastore: %s", err)
+		return nil, err
+	}
+	kv, err := openKVFile(filepath.Join(baseDir, kvFileName))
+	if err != nil {
+		logger.Criticalf("Failed to initialize datastore: %s", err)
+		return nil, err
+	}
+	return &kvStorage{
+		kv:        kv,
+		databases: map[string]*kvDatabase{},
+		metrics:   map[kvMetricID]*kvMetric{},
+		buffers:   map[kvMetricID]*reorderBuffer{},
+	}, nil
+}
+
+func kvDatabaseKey(dbname string) string {
+	return kvDatabasePrefix + dbname + kvSeparator
+}
+
+func kvMetricKey(id kvMetricID) string {
+	return kvMetricPrefix + id.dbname + kvSeparator + id.metric
+}
+
+// kvChunksKey returns the common prefix of chunk keys of the metric.
+func kvChunksKey(id kvMetricID) string {
+	return kvChunkPrefix + id.dbname + kvSeparator + id.metric + kvSeparator
+}
+
+func kvChunkKey(id kvMetricID, start int) string {
+	return kvChunksKey(id) + encodeKeyNumber(uint64(start))
+}
+
+func kvMetricMetaKey(id kvMetricID) string {
+	return kvMetricMetaPrefix + id.dbname + kvSeparator + id.metric
+}
+
+func kvAnnotationKey(dbname string, ts int64, seq uint64) string {
+	// Flipping the sign bit orders negative timestamps first
+	return kvAnnotationPrefix + dbname + kvSeparator + encodeKeyNumber(uint64(ts)^1<<63) + encodeKeyNumber(seq)
+}
+
+func encodeKeyNumber(n uint64) string {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	return string(buf[:])
+}
+
+// encodeChunk stores timestamps as deltas and values as IEEE 754 numbers.
+func encodeChunk(samples []Sample, compress bool) []byte {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var fw *flate.Writer
+	if compress {
+		buf.WriteByte(compressedChunk)
+		fw, _ = flate.NewWriter(&buf, flate.BestCompression)
+		w = fw
+	} else {
+		buf.WriteByte(rawChunk)
+	}
+
+	var varint [binary.MaxVarintLen64]byte
+	var value [8]byte
+	prev := int64(0)
+	for _, sample := range samples {
+		w.Write(varint[:binary.PutVarint(varint[:], sample.ts-prev)])
+		binary.BigEndian.PutUint64(value[:], math.Float64bits(sample.v))
+		w.Write(value[:])
+		prev = sample.ts
+	}
+	if fw != nil {
+		fw.Close()
+	}
+	return buf.Bytes()
+}
+
+func decodeChunk(data []byte) ([]Sample, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty chunk")
+	}
+
+	payload := data[1:]
+	switch data[0] {
+	case rawChunk:
+	case compressedChunk:
+		var err error
+		if payload, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(payload))); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown chunk type %q", data[0])
+	}
+
+	samples := []Sample{}
+	prev := int64(0)
+	for len(payload) > 0 {
+		delta, n := binary.Varint(payload)
+		if n <= 0 || len(payload) < n+8 {
+			return nil, fmt.Errorf("malformed chunk")
+		}
+		prev += delta
+		v := math.Float64frombits(binary.BigEndian.Uint64(payload[n:]))
+		samples = append(samples, Sample{prev, v})
+		payload = payload[n+8:]
+	}
+	return samples, nil
+}
+
+// database returns the database record, or nil if the database doesn't
+// exist. The caller must hold ks.mu.
+func (ks *kvStorage) database(dbname string) (*kvDatabase, error) {
+	if db, ok := ks.databases[dbname]; ok {
+		return db, nil
+	}
+
+	data, err := ks.kv.get(kvDatabaseKey(dbname))
+	if err == errKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	db := kvDatabase{Settings: defaultSettings, Meta: map[string]interface{}{}}
+	if err := json.Unmarshal(data, &db); err != nil {
+		return nil, err
+	}
+	ks.databases[dbname] = &db
+	return &db, nil
+}
+
+// loadDatabase returns a copy of the database record to be updated, a new
+// record if the database doesn't exist. The caller must hold ks.mu.
+func (ks *kvStorage) loadDatabase(dbname string) (kvDatabase, error) {
+	db, err := ks.database(dbname)
+	if err != nil {
+		return kvDatabase{}, err
+	}
+	if db == nil {
+		return kvDatabase{
+			Created:  time.Now().UnixNano() / 1e6,
+			Settings: defaultSettings,
+			Meta:     map[string]interface{}{},
+		}, nil
+	}
+	return *db, nil
+}
+
+// storeDatabase commits the batch along with the database record. The caller
+// must hold ks.mu.
+func (ks *kvStorage) storeDatabase(dbname string, db kvDatabase, batch *kvBatch) error {
+	data, err := json.Marshal(db)
+	if err != nil {
+		return err
+	}
+	batch.put(kvDatabaseKey(dbname), data)
+	if err := ks.kv.write(batch); err != nil {
+		return err
+	}
+	ks.databases[dbname] = &db
+	return nil
+}
+
+// metric returns the metric record, or nil if the metric doesn't exist. The
+// caller must hold ks.mu.
+func (ks *kvStorage) metric(id kvMetricID) (*kvMetric, error) {
+	if m, ok := ks.metrics[id]; ok {
+		return m, nil
+	}
+
+	data, err := ks.kv.get(kvMetricKey(id))
+	if err == errKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var m kvMetric
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	ks.metrics[id] = &m
+	return &m, nil
+}
+
+// writeSample stores the sample according to the out-of-order and duplicate
+// policies, see writeSample. The caller must hold ks.mu.
+func (ks *kvStorage) writeSample(id kvMetricID, sample Sample, settings DatabaseSettings) error {
+	current, err := ks.metric(id)
+	if err != nil {
+		return err
+	}
+
+	batch := kvBatch{}
+	m := kvMetric{Created: time.Now().UnixNano() / 1e6, FirstTS: sample.ts}
+	if current != nil {
+		m = *current
+
+		switch {
+		case sample.ts < m.LastTS && settings.OutOfOrder == rejectOutOfOrder:
+			return errOutOfOrder
+		case sample.ts == m.LastTS && settings.Duplicates == firstDuplicate:
+			return nil
+		case sample.ts == m.LastTS && settings.Duplicates == lastDuplicate:
+			// The last sample is always in a chunk of its own
+			batch.put(kvChunkKey(id, m.Count-1), encodeChunk([]Sample{sample}, false))
+			m.LastValue = sample.v
+			return ks.storeMetric(id, m, &batch)
+		}
+	}
+
+	if m.Head == kvChunkSize {
+		if err := ks.sealHead(id, &m, &batch); err != nil {
+			return err
+		}
+	}
+	batch.put(kvChunkKey(id, m.Count), encodeChunk([]Sample{sample}, false))
+	m.Count++
+	m.Head++
+	m.LastTS, m.LastValue = sample.ts, sample.v
+	return ks.storeMetric(id, m, &batch)
+}
+
+// sealHead merges uncompressed chunks into a compressed one. The caller must
+// hold ks.mu.
+func (ks *kvStorage) sealHead(id kvMetricID, m *kvMetric, batch *kvBatch) error {
+	start := m.Count - m.Head
+	samples := []Sample{}
+	for i := start; i < m.Count; i++ {
+		data, err := ks.kv.get(kvChunkKey(id, i))
+		if err != nil {
+			return err
+		}
+		chunk, err := decodeChunk(data)
+		if err != nil {
+			return err
+		}
+		samples = append(samples, chunk...)
+		if i > start {
+			batch.delete(kvChunkKey(id, i))
+		}
+	}
+	batch.put(kvChunkKey(id, start), encodeChunk(samples, true))
+	m.Head = 0
+	return nil
+}
+
+// storeMetric commits the batch along with the metric record. The caller must
+// hold ks.mu.
+func (ks *kvStorage) storeMetric(id kvMetricID, m kvMetric, batch *kvBatch) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	batch.put(kvMetricKey(id), data)
+	if err := ks.kv.write(batch); err != nil {
+		return err
+	}
+	ks.metrics[id] = &m
+	return nil
+}
+
+func (ks *kvStorage) addSample(dbname, metric string, sample Sample) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	db, err := ks.database(dbname)
+	if err != nil {
+		return err
+	}
+	if db == nil {
+		created, err := ks.loadDatabase(dbname)
+		if err != nil {
+			return err
+		}
+		if err := ks.storeDatabase(dbname, created, &kvBatch{}); err != nil {
+			return err
+		}
+		db = &created
+	}
+
+	id := kvMetricID{dbname, metric}
+	settings := db.Settings
+	if settings.ReorderWindow == 0 {
+		return ks.writeSample(id, sample, settings)
+	}
+
+	// Samples older than the stored ones cannot be reordered anymore
+	m, err := ks.metric(id)
+	if err != nil {
+		return err
+	}
+	if m != nil && sample.ts < m.LastTS {
+		return ks.writeSample(id, sample, settings)
+	}
+
+	buf, ok := ks.buffers[id]
+	if !ok {
+		buf = &reorderBuffer{dbname: dbname}
+		ks.buffers[id] = buf
+		ks.flusher.Do(func() { go ks.flushIdleBuffers() })
+	}
+	return buf.flushTo(func(sample Sample) error {
+		return ks.writeSample(id, sample, settings)
+	}, buf.insert(sample, settings))
+}
+
+// flushMetric writes all buffered samples of the metric. The caller must
+// hold ks.mu.
+func (ks *kvStorage) flushMetric(id kvMetricID) error {
+	buf, ok := ks.buffers[id]
+	if !ok {
+		return nil
+	}
+	err := buf.flushTo(func(sample Sample) error {
+		return ks.writeSample(id, sample, buf.settings)
+	}, len(buf.samples))
+	if err != nil {
+		return err
+	}
+	delete(ks.buffers, id)
+	return nil
+}
+
+// flushDatabase writes all buffered samples of the database. The caller must
+// hold ks.mu.
+func (ks *kvStorage) flushDatabase(dbname string) error {
+	for id := range ks.buffers {
+		if id.dbname == dbname {
+			if err := ks.flushMetric(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flushIdleBuffers periodically writes samples of metrics that haven't been
+// updated for longer than their reorder window.
+func (ks *kvStorage) flushIdleBuffers() {
+	for range time.Tick(flushInterval) {
+		ks.mu.Lock()
+		for id, buf := range ks.buffers {
+			window := time.Duration(buf.settings.ReorderWindow) * time.Millisecond
+			if time.Since(buf.updated) < window {
+				continue
+			}
+			if err := ks.flushMetric(id); err != nil {
+				logger.Errorf("Failed to flush %s/%s: %s", id.dbname, id.metric, err)
+			}
+		}
+		ks.mu.Unlock()
+	}
+}
+
+func (ks *kvStorage) checkOrder(dbname, metric string, ts int64) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	db, err := ks.database(dbname)
+	if err != nil || db == nil || db.Settings.OutOfOrder != rejectOutOfOrder {
+		return err
+	}
+	m, err := ks.metric(kvMetricID{dbname, metric})
+	if err == nil && m != nil && ts < m.LastTS {
+		return errOutOfOrder
+	}
+	return err
+}
+
+func (ks *kvStorage) checkDbExists(dbname string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	db, err := ks.database(dbname)
+	if err == nil && db == nil {
+		return notExist(dbname)
+	}
+	return err
+}
+
+func (ks *kvStorage) checkMetricExists(dbname, metric string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	id := kvMetricID{dbname, metric}
+	if err := ks.flushMetric(id); err != nil {
+		return err
+	}
+	m, err := ks.metric(id)
+	if err == nil && m == nil {
+		return notExist(metric)
+	}
+	return err
+}
+
+func (ks *kvStorage) listDatabases() ([]string, error) {
+	databases := ks.kv.list(kvDatabasePrefix)
+	for i, key := range databases {
+		databases[i] = key[:len(key)-len(kvSeparator)]
+	}
+	return databases, nil
+}
+
+func (ks *kvStorage) getDatabaseInfo(dbname string) (*DatabaseInfo, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	db, err := ks.database(dbname)
+	if err != nil {
+		return nil, err
+	} else if db == nil {
+		return nil, notExist(dbname)
+	}
+	if err := ks.flushDatabase(dbname); err != nil {
+		return nil, err
+	}
+
+	info := DatabaseInfo{Name: dbname, Created: db.Created, Metadata: copyMeta(db.Meta)}
+	for _, prefix := range []string{kvDatabasePrefix, kvMetricPrefix, kvChunkPrefix, kvMetricMetaPrefix, kvAnnotationPrefix} {
+		info.Size += ks.kv.usage(prefix + dbname + kvSeparator)
+	}
+	for _, metric := range ks.kv.list(kvMetricPrefix + dbname + kvSeparator) {
+		m, err := ks.metric(kvMetricID{dbname, metric})
+		if err != nil {
+			return nil, err
+		}
+
+		info.Metrics++
+		if info.FirstTS == 0 || m.FirstTS < info.FirstTS {
+			info.FirstTS = m.FirstTS
+		}
+		if m.LastTS > info.LastTS {
+			info.LastTS = m.LastTS
+		}
+	}
+
+	// Listings mix databases of different precision, so they use milliseconds
+	info.FirstTS = convertPrecision(info.FirstTS, db.Settings.unit(), time.Millisecond)
+	info.LastTS = convertPrecision(info.LastTS, db.Settings.unit(), time.Millisecond)
+	return &info, nil
+}
+
+func (ks *kvStorage) listMetrics(dbname string) ([]string, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	db, err := ks.database(dbname)
+	if err != nil {
+		return nil, err
+	} else if db == nil {
+		return nil, notExist(dbname)
+	}
+	if err := ks.flushDatabase(dbname); err != nil {
+		return nil, err
+	}
+	return ks.kv.list(kvMetricPrefix + dbname + kvSeparator), nil
+}
+
+func (ks *kvStorage) getMetricStats(dbname, metric string) (*MetricStats, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	id := kvMetricID{dbname, metric}
+	if err := ks.flushMetric(id); err != nil {
+		return nil, err
+	}
+	m, err := ks.metric(id)
+	if err != nil {
+		return nil, err
+	} else if m == nil {
+		return nil, notExist(metric)
+	}
+
+	return &MetricStats{
+		Name:      metric,
+		Count:     m.Count,
+		FirstTS:   m.FirstTS,
+		LastTS:    m.LastTS,
+		LastValue: m.LastValue,
+		Size:      ks.kv.usage(kvChunksKey(id)),
+	}, nil
+}
+
+func (ks *kvStorage) listMetricStats(dbname string) ([]*MetricStats, error) {
+	metrics, err := ks.listMetrics(dbname)
+	if err != nil {
+		return nil, err
+	}
+
+	allStats := []*MetricStats{}
+	for _, metric := range metrics {
+		stats, err := ks.getMetricStats(dbname, metric)
+		if err != nil {
+			return nil, err
+		}
+		if stats.MetricMeta, err = ks.getMetricMeta(dbname, metric); err != nil {
+			return nil, err
+		}
+		allStats = append(allStats, stats)
+	}
+	return allStats, nil
+}
+
+// readChunks returns all chunks of the metric. They are decoded by the
+// caller, so that readers don't block writers.
+func (ks *kvStorage) readChunks(dbname, metric string) ([][]byte, DatabaseSettings, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	id := kvMetricID{dbname, metric}
+	if err := ks.flushMetric(id); err != nil {
+		return nil, DatabaseSettings{}, err
+	}
+	m, err := ks.metric(id)
+	if err != nil {
+		return nil, DatabaseSettings{}, err
+	} else if m == nil {
+		return nil, DatabaseSettings{}, notExist(metric)
+	}
+	db, err := ks.database(dbname)
+	if err != nil {
+		return nil, DatabaseSettings{}, err
+	}
+
+	chunks, err := ks.kv.scan(kvChunksKey(id))
+	return chunks, db.Settings, err
+}
+
+func (ks *kvStorage) readSamples(dbname, metric string) ([]Sample, DatabaseSettings, error) {
+	chunks, settings, err := ks.readChunks(dbname, metric)
+	if err != nil {
+		return nil, settings, err
+	}
+
+	samples := []Sample{}
+	for _, data := range chunks {
+		chunk, err := decodeChunk(data)
+		if err != nil {
+			return nil, settings, err
+		}
+		samples = append(samples, chunk...)
+	}
+	return samples, settings, nil
+}
+
+func (ks *kvStorage) streamRawValues(dbname, metric string, unit time.Duration, fn func(Sample) error) error {
+	chunks, settings, err := ks.readChunks(dbname, metric)
+	if err != nil {
+		return err
+	}
+
+	for _, data := range chunks {
+		chunk, err := decodeChunk(data)
+		if err != nil {
+			return err
+		}
+		for _, sample := range chunk {
+			sample.ts = convertPrecision(sample.ts, settings.unit(), unit)
+			if err := fn(sample); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ks *kvStorage) getSummary(dbname, metric string) (map[string]interface{}, error) {
+	samples, _, err := ks.readSamples(dbname, metric)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]float64, len(samples))
+	for i, sample := range samples {
+		values[i] = sample.v
+	}
+	return summarize(values), nil
+}
+
+func (ks *kvStorage) getHeatMap(dbname, metric string) (*heatMap, error) {
+	samples, settings, err := ks.readSamples(dbname, metric)
+	if err != nil {
+		return nil, err
+	}
+	return buildHeatMap(samples, settings.unit()), nil
+}
+
+func (ks *kvStorage) getSettings(dbname string) (DatabaseSettings, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	db, err := ks.database(dbname)
+	if err != nil || db == nil {
+		return defaultSettings, err
+	}
+	return db.Settings, nil
+}
+
+func (ks *kvStorage) setSettings(dbname string, settings DatabaseSettings) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	db, err := ks.loadDatabase(dbname)
+	if err != nil {
+		return err
+	}
+
+	// Buffered samples follow the settings they were acknowledged with
+	if err := ks.flushDatabase(dbname); err != nil {
+		return err
+	}
+
+	if db.Settings.unit() != settings.unit() && len(ks.kv.list(kvMetricPrefix+dbname+kvSeparator)) > 0 {
+		return errPrecisionChange
+	}
+	db.Settings = settings
+	return ks.storeDatabase(dbname, db, &kvBatch{})
+}
+
+func (ks *kvStorage) getMeta(dbname string) (map[string]interface{}, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	db, err := ks.database(dbname)
+	if err != nil {
+		return nil, err
+	} else if db == nil {
+		return map[string]interface{}{}, nil
+	}
+	return copyMeta(db.Meta), nil
+}
+
+func (ks *kvStorage) setMeta(dbname string, meta map[string]interface{}) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	db, err := ks.loadDatabase(dbname)
+	if err != nil {
+		return err
+	}
+	db.Meta = copyMeta(meta)
+	return ks.storeDatabase(dbname, db, &kvBatch{})
+}
+
+func (ks *kvStorage) getMetricMeta(dbname, metric string) (MetricMeta, error) {
+	var meta MetricMeta
+
+	data, err := ks.kv.get(kvMetricMetaKey(kvMetricID{dbname, metric}))
+	if err == errKeyNotFound {
+		return meta, nil
+	} else if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+func (ks *kvStorage) setMetricMeta(dbname, metric string, meta MetricMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	db, err := ks.loadDatabase(dbname)
+	if err != nil {
+		return err
+	}
+	batch := kvBatch{}
+	batch.put(kvMetricMetaKey(kvMetricID{dbname, metric}), data)
+	return ks.storeDatabase(dbname, db, &batch)
+}
+
+func (ks *kvStorage) addAnnotation(dbname string, annotation Annotation) error {
+	data, err := json.Marshal(annotation)
+	if err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	db, err := ks.loadDatabase(dbname)
+	if err != nil {
+		return err
+	}
+	batch := kvBatch{}
+	batch.put(kvAnnotationKey(dbname, annotation.Timestamp, db.Annotations), data)
+	db.Annotations++
+	return ks.storeDatabase(dbname, db, &batch)
+}
+
+// getAnnotations returns annotations within [from, to], ordered by timestamp.
+// Zero bounds are not applied.
+func (ks *kvStorage) getAnnotations(dbname string, from, to int64) ([]Annotation, error) {
+	records, err := ks.kv.scan(kvAnnotationPrefix + dbname + kvSeparator)
+	if err != nil {
+		return nil, err
+	}
+
+	annotations := []Annotation{}
+	for _, record := range records {
+		var annotation Annotation
+		if err := json.Unmarshal(record, &annotation); err != nil {
+			return nil, err
+		}
+		if (from != 0 && annotation.Timestamp < from) || (to != 0 && annotation.Timestamp > to) {
+			continue
+		}
+		annotations = append(annotations, annotation)
+	}
+	return annotations, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTmpKVStorage returns a storage in a temporary directory, which is
+// removed when the test finishes.
+func newTmpKVStorage(t *testing.T) *kvStorage {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	storage, err := newKVStorage(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.kv.close() })
+	return storage
+}
+
+// reopenKVStorage returns a new instance that reads the same file, as if the
+// server was restarted.
+func reopenKVStorage(t *testing.T, ks *kvStorage) *kvStorage {
+	reopened, err := newKVStorage(filepath.Dir(ks.kv.fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reopened.kv.close() })
+	return reopened
+}
+
+func readKVSamples(ks *kvStorage) ([]Sample, error) {
+	samples := []Sample{}
+	err := ks.streamRawValues("database", "cpu", time.Millisecond, func(sample Sample) error {
+		samples = append(samples, sample)
+		return nil
+	})
+	return samples, err
+}
+
+func TestKVChunks(t *testing.T) {
+	storage := newTmpKVStorage(t)
+
+	expected := []Sample{}
+	for i := 0; i < 2*kvChunkSize+10; i++ {
+		sample := Sample{1411940889515 + int64(i*1000), float64(i % 7)}
+		if err := storage.addSample("database", "cpu", sample); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, sample)
+	}
+
+	// Two compressed chunks and one sample per chunk in the head
+	chunks := storage.kv.list(kvChunksKey(kvMetricID{"database", "cpu"}))
+	assert.Equal(t, 2+10, len(chunks))
+
+	reopened := reopenKVStorage(t, storage)
+	samples, err := readKVSamples(reopened)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, samples)
+
+	stats, err := reopened.getMetricStats("database", "cpu")
+	assert.Nil(t, err)
+	assert.Equal(t, len(expected), stats.Count)
+	assert.Equal(t, expected[len(expected)-1].ts, stats.LastTS)
+	// Compression pays off
+	assert.True(t, stats.Size < int64(len(expected)*16), "size %d", stats.Size)
+
+	databases, _ := reopened.listDatabases()
+	assert.Equal(t, []string{"database"}, databases)
+	metrics, _ := reopened.listMetrics("database")
+	assert.Equal(t, []string{"cpu"}, metrics)
+}
+
+func TestKVTornBatch(t *testing.T) {
+	defer func() {
+		setFailpoint(func(string) error { return nil })
+	}()
+
+	for _, name := range []string{"write", "torn write", "sync"} {
+		storage := newTmpKVStorage(t)
+		storage.addSample("database", "cpu", Sample{1411940889515, 1})
+
+		crashAt(name, 1)
+		err := storage.addSample("database", "cpu", Sample{1411940889516, 2})
+		assert.Equal(t, errCrash, err, name)
+		setFailpoint(func(string) error { return nil })
+
+		// A synced batch is complete, it's only not acknowledged
+		expected := []Sample{{1411940889515, 1}}
+		if name == "sync" {
+			expected = append(expected, Sample{1411940889516, 2})
+		}
+		reopened := reopenKVStorage(t, storage)
+		samples, err := readKVSamples(reopened)
+		assert.Nil(t, err, name)
+		assert.Equal(t, expected, samples, name)
+
+		// The torn batch is overwritten
+		assert.Nil(t, reopened.addSample("database", "cpu", Sample{1411940889517, 3}))
+		samples, _ = readKVSamples(reopenKVStorage(t, reopened))
+		assert.Equal(t, append(expected, Sample{1411940889517, 3}), samples, name)
+	}
+}
+
+func TestKVFileCompaction(t *testing.T) {
+	storage := newTmpKVStorage(t)
+	storage.setSettings("database", DatabaseSettings{OutOfOrder: acceptOutOfOrder, Duplicates: lastDuplicate, Precision: "ms"})
+
+	// Every sample replaces the previous one
+	for i := 0; i < 20000; i++ {
+		if err := storage.addSample("database", "cpu", Sample{1411940889515, float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storage.kv.compactions.Wait()
+	f, err := os.Stat(storage.kv.fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, f.Size() < 2*kvCompactionSize, "size %d", f.Size())
+
+	samples, err := readKVSamples(reopenKVStorage(t, storage))
+	assert.Nil(t, err)
+	assert.Equal(t, []Sample{{1411940889515, 19999}}, samples)
+}
+
+func TestKVFileCompactionConcurrentWrites(t *testing.T) {
+	storage := newTmpKVStorage(t)
+
+	// Writes go on while the file is compacted in the background
+	expected := []Sample{}
+	for i := 0; i < 20000; i++ {
+		sample := Sample{1411940889515 + int64(i), float64(i)}
+		if err := storage.addSample("database", "cpu", sample); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, sample)
+	}
+	storage.kv.compactions.Wait()
+	f, err := os.Stat(storage.kv.fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, f.Size() < 2*kvCompactionSize, "size %d", f.Size())
+
+	samples, err := readKVSamples(storage)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, samples)
+
+	samples, err = readKVSamples(reopenKVStorage(t, storage))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, samples)
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// kvFile is a small embedded key-value store kept in a single append-only
+// file. The file starts with kvMagic followed by records:
+//
+//	<crc32> <op> <key length> <value length> <key> <value>
+//
+// where the checksum covers everything after itself and lengths are uvarints.
+// Puts and deletes are written in batches terminated by a commit record, a
+// batch without the commit record is discarded when the file is opened.
+//
+// Keys are kept in memory in sorted order, so prefix scans don't touch the
+// file. Values are read from the file on demand. Replaced and deleted values
+// are garbage, the file is rewritten in the background once garbage outweighs
+// live data.
+
+const kvMagic = "#perfdb-kv 1\n"
+
+const (
+	kvPut byte = iota + 1
+	kvDelete
+	kvCommit
+)
+
+// kvCompactionSize is the amount of garbage that is tolerated regardless of
+// the amount of live data.
+const kvCompactionSize = 1 << 20
+
+var errKeyNotFound = errors.New("key not found")
+
+type kvEntry struct {
+	offset int64 // Of the value
+	length int   // Of the whole record
+	size   int   // Of the value
+}
+
+type kvFile struct {
+	mu       sync.Mutex
+	fileName string
+	file     *os.File
+	index    map[string]kvEntry
+	keys     []string // Sorted
+	size     int64
+	garbage  int64
+
+	closed      bool
+	compacting  bool
+	compactions sync.WaitGroup
+}
+
+type kvOp struct {
+	op    byte
+	key   string
+	value []byte
+}
+
+// kvBatch is a group of changes that are committed atomically.
+type kvBatch struct {
+	ops []kvOp
+}
+
+func (b *kvBatch) put(key string, value []byte) {
+	b.ops = append(b.ops, kvOp{kvPut, key, value})
+}
+
+func (b *kvBatch) delete(key string) {
+	b.ops = append(b.ops, kvOp{op: kvDelete, key: key})
+}
+
+func openKVFile(fileName string) (*kvFile, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	kv := kvFile{fileName: fileName, file: file}
+	if err := kv.load(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot open %s: %s", fileName, err)
+	}
+	return &kv, nil
+}
+
+func (kv *kvFile) close() error {
+	kv.mu.Lock()
+	kv.closed = true // No new compactions
+	kv.mu.Unlock()
+	kv.compactions.Wait()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.file.Close()
+}
+
+// load builds the index. Uncommitted and torn records left by a crash are
+// truncated.
+func (kv *kvFile) load() error {
+	kv.index = map[string]kvEntry{}
+	kv.keys = nil
+	kv.garbage = 0
+
+	f, err := kv.file.Stat()
+	if err != nil {
+		return err
+	}
+	if f.Size() < int64(len(kvMagic)) {
+		// New file, or the creation was interrupted
+		if err := kv.file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := kv.file.WriteAt([]byte(kvMagic), 0); err != nil {
+			return err
+		}
+		kv.size = int64(len(kvMagic))
+		return nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(kv.file, 0, f.Size()))
+	magic := make([]byte, len(kvMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != kvMagic {
+		return fmt.Errorf("not a key-value file")
+	}
+
+	pos := int64(len(kvMagic))
+	committed := pos
+	pending := []kvOp{}
+	pendingEntries := []kvEntry{}
+	for {
+		op, entry, err := readKVRecord(reader, pos)
+		if err != nil {
+			break // A torn or uncommitted batch
+		}
+		pos += int64(entry.length)
+		if op.op != kvCommit {
+			pending = append(pending, op)
+			pendingEntries = append(pendingEntries, entry)
+			continue
+		}
+		for i, op := range pending {
+			kv.apply(op, pendingEntries[i])
+		}
+		kv.garbage += int64(entry.length) // Commit records are never live
+		pending, pendingEntries = pending[:0], pendingEntries[:0]
+		committed = pos
+	}
+
+	if committed < f.Size() {
+		if err := kv.file.Truncate(committed); err != nil {
+			return err
+		}
+	}
+	kv.size = committed
+	return nil
+}
+
+// readKVRecord reads the record at the position, only the key is kept in
+// memory.
+func readKVRecord(reader *bufio.Reader, pos int64) (kvOp, kvEntry, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return kvOp{}, kvEntry{}, err
+	}
+	checksum := binary.BigEndian.Uint32(header[:])
+
+	hash := crc32.NewIEEE()
+	body := io.TeeReader(reader, hash)
+
+	var opCode [1]byte
+	if _, err := io.ReadFull(body, opCode[:]); err != nil {
+		return kvOp{}, kvEntry{}, err
+	}
+	op := kvOp{op: opCode[0]}
+	keyLen, err := readUvarint(body)
+	if err != nil {
+		return kvOp{}, kvEntry{}, err
+	}
+	valueLen, err := readUvarint(body)
+	if err != nil {
+		return kvOp{}, kvEntry{}, err
+	}
+	if keyLen > 1<<16 || valueLen > 1<<30 {
+		return kvOp{}, kvEntry{}, fmt.Errorf("record is too large")
+	}
+
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(body, key); err != nil {
+		return kvOp{}, kvEntry{}, err
+	}
+	op.key = string(key)
+	if _, err := io.CopyN(hash, reader, int64(valueLen)); err != nil {
+		return kvOp{}, kvEntry{}, err
+	}
+	if hash.Sum32() != checksum {
+		return kvOp{}, kvEntry{}, fmt.Errorf("checksum mismatch")
+	}
+
+	headerLen := 4 + 1 + uvarintLen(keyLen) + uvarintLen(valueLen)
+	entry := kvEntry{
+		offset: pos + int64(headerLen) + int64(keyLen),
+		length: headerLen + int(keyLen) + int(valueLen),
+		size:   int(valueLen),
+	}
+	return op, entry, nil
+}
+
+func readUvarint(r io.Reader) (uint64, error) {
+	var b [1]byte
+	var x uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, err
+		}
+		x |= uint64(b[0]&0x7f) << shift
+		if b[0] < 0x80 {
+			return x, nil
+		}
+	}
+	return 0, fmt.Errorf("malformed varint")
+}
+
+func uvarintLen(x uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], x)
+}
+
+func appendKVRecord(buf *bytes.Buffer, op kvOp) {
+	var body bytes.Buffer
+	var varint [binary.MaxVarintLen64]byte
+	body.WriteByte(op.op)
+	body.Write(varint[:binary.PutUvarint(varint[:], uint64(len(op.key)))])
+	body.Write(varint[:binary.PutUvarint(varint[:], uint64(len(op.value)))])
+	body.WriteString(op.key)
+	body.Write(op.value)
+
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(body.Bytes()))
+	buf.Write(checksum[:])
+	buf.Write(body.Bytes())
+}
+
+// apply updates the index. The caller must hold kv.mu.
+func (kv *kvFile) apply(op kvOp, entry kvEntry) {
+	old, exists := kv.index[op.key]
+	if exists {
+		kv.garbage += int64(old.length)
+	}
+
+	switch op.op {
+	case kvPut:
+		kv.index[op.key] = entry
+		if !exists {
+			i := sort.SearchStrings(kv.keys, op.key)
+			kv.keys = append(kv.keys, "")
+			copy(kv.keys[i+1:], kv.keys[i:])
+			kv.keys[i] = op.key
+		}
+	case kvDelete:
+		kv.garbage += int64(entry.length)
+		if exists {
+			delete(kv.index, op.key)
+			i := sort.SearchStrings(kv.keys, op.key)
+			kv.keys = append(kv.keys[:i], kv.keys[i+1:]...)
+		}
+	}
+}
+
+// write commits the batch. Compaction is started if the file has too much
+// garbage.
+func (kv *kvFile) write(batch *kvBatch) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	var buf bytes.Buffer
+	entries := make([]kvEntry, len(batch.ops))
+	for i, op := range batch.ops {
+		start := kv.size + int64(buf.Len())
+		appendKVRecord(&buf, op)
+		length := kv.size + int64(buf.Len()) - start
+		entries[i] = kvEntry{
+			offset: start + length - int64(len(op.value)),
+			length: int(length),
+			size:   len(op.value),
+		}
+	}
+	opsLen := buf.Len()
+	appendKVRecord(&buf, kvOp{op: kvCommit})
+
+	if err := failpoint("write"); err != nil {
+		return err
+	}
+	if err := failpoint("torn write"); err != nil {
+		kv.file.WriteAt(buf.Bytes()[:buf.Len()/2], kv.size)
+		return err
+	}
+	if _, err := kv.file.WriteAt(buf.Bytes(), kv.size); err != nil {
+		return err
+	}
+	if err := failpoint("sync"); err != nil {
+		return err
+	}
+	if fsyncPolicy == fsyncAlways {
+		if err := syncToDisk(kv.file); err != nil {
+			return err
+		}
+	} else {
+		markDirty(kv.fileName)
+	}
+
+	for i, op := range batch.ops {
+		kv.apply(op, entries[i])
+	}
+	kv.garbage += int64(buf.Len() - opsLen) // The commit record
+	kv.size += int64(buf.Len())
+
+	// Compaction copies the whole file, it must not stall writers
+	if kv.needsCompaction() && !kv.compacting {
+		kv.compacting = true
+		kv.compactions.Add(1)
+		go kv.compactInBackground()
+	}
+	return nil
+}
+
+// needsCompaction reports whether garbage outweighs live data. The caller
+// must hold kv.mu.
+func (kv *kvFile) needsCompaction() bool {
+	return !kv.closed && kv.garbage > kvCompactionSize && kv.garbage > kv.size-kv.garbage
+}
+
+// compactInBackground compacts the file until it has little garbage. The
+// file stays valid if compaction fails, so errors are only logged.
+func (kv *kvFile) compactInBackground() {
+	defer kv.compactions.Done()
+
+	for {
+		err := kv.compact()
+		if err != nil {
+			logger.Errorf("Failed to compact %s: %s", kv.fileName, err)
+		}
+
+		kv.mu.Lock()
+		if err != nil || !kv.needsCompaction() {
+			kv.compacting = false
+			kv.mu.Unlock()
+			return
+		}
+		kv.mu.Unlock()
+	}
+}
+
+// compact rewrites live records into a new file. Live records are copied
+// without holding kv.mu, batches committed in the meantime are appended as
+// is: most of them without the lock as well, only the last ones under the
+// lock right before the new file replaces the old one.
+func (kv *kvFile) compact() error {
+	kv.mu.Lock()
+	file, end := kv.file, kv.size
+	keys := append([]string{}, kv.keys...)
+	entries := make([]kvEntry, len(keys))
+	for i, key := range keys {
+		entries[i] = kv.index[key]
+	}
+	kv.mu.Unlock()
+
+	tmpFile := kv.fileName + ".tmp"
+	out, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	replaced := false
+	defer func() {
+		if !replaced {
+			out.Close()
+			os.Remove(tmpFile)
+		}
+	}()
+
+	writer := bufio.NewWriter(out)
+	writer.WriteString(kvMagic)
+	pos := int64(len(kvMagic))
+	index := make(map[string]kvEntry, len(keys))
+	var buf bytes.Buffer
+	for i, key := range keys {
+		value := make([]byte, entries[i].size)
+		if _, err := file.ReadAt(value, entries[i].offset); err != nil {
+			return err
+		}
+		buf.Reset()
+		appendKVRecord(&buf, kvOp{kvPut, key, value})
+		index[key] = kvEntry{
+			offset: pos + int64(buf.Len()-len(value)),
+			length: buf.Len(),
+			size:   len(value),
+		}
+		writer.Write(buf.Bytes())
+		pos += int64(buf.Len())
+	}
+	buf.Reset()
+	appendKVRecord(&buf, kvOp{op: kvCommit})
+	writer.Write(buf.Bytes())
+	pos += int64(buf.Len())
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	// Records after the old end move by the same distance
+	shift := pos - end
+
+	kv.mu.Lock()
+	size := kv.size
+	kv.mu.Unlock()
+	if _, err := io.Copy(out, io.NewSectionReader(file, end, size-end)); err != nil {
+		return err
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if _, err := io.Copy(out, io.NewSectionReader(file, size, kv.size-size)); err != nil {
+		return err
+	}
+	if fsyncPolicy == fsyncAlways {
+		if err := syncToDisk(out); err != nil {
+			return err
+		}
+	}
+	if err := failpoint("rename"); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, kv.fileName); err != nil {
+		return err
+	}
+	replaced = true
+
+	kv.file.Close()
+	kv.file = out
+	kv.size += shift
+	kv.garbage = kv.size - int64(len(kvMagic))
+	for key, entry := range kv.index {
+		if entry.offset >= end {
+			entry.offset += shift
+		} else {
+			entry = index[key] // Not changed since the snapshot
+		}
+		kv.index[key] = entry
+		kv.garbage -= int64(entry.length)
+	}
+
+	dir := filepath.Dir(kv.fileName)
+	if fsyncPolicy == fsyncAlways {
+		return syncFile(dir)
+	}
+	markDirty(kv.fileName)
+	markDirty(dir)
+	return nil
+}
+
+// read returns the value of the key. The caller must hold kv.mu.
+func (kv *kvFile) read(key string) ([]byte, error) {
+	entry, ok := kv.index[key]
+	if !ok {
+		return nil, errKeyNotFound
+	}
+	value := make([]byte, entry.size)
+	if _, err := kv.file.ReadAt(value, entry.offset); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (kv *kvFile) get(key string) ([]byte, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.read(key)
+}
+
+// prefixRange returns bounds of keys with the prefix. The caller must hold
+// kv.mu.
+func (kv *kvFile) prefixRange(prefix string) (int, int) {
+	start := sort.SearchStrings(kv.keys, prefix)
+	end := start
+	for end < len(kv.keys) && strings.HasPrefix(kv.keys[end], prefix) {
+		end++
+	}
+	return start, end
+}
+
+// list returns keys with the prefix in sorted order, the prefix is trimmed.
+func (kv *kvFile) list(prefix string) []string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	start, end := kv.prefixRange(prefix)
+	keys := make([]string, 0, end-start)
+	for _, key := range kv.keys[start:end] {
+		keys = append(keys, strings.TrimPrefix(key, prefix))
+	}
+	return keys
+}
+
+// scan returns values of keys with the prefix in key order.
+func (kv *kvFile) scan(prefix string) ([][]byte, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	start, end := kv.prefixRange(prefix)
+	values := make([][]byte, 0, end-start)
+	for _, key := range kv.keys[start:end] {
+		value, err := kv.read(key)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// usage returns the number of bytes taken by records with the prefix.
+func (kv *kvFile) usage(prefix string) int64 {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	start, end := kv.prefixRange(prefix)
+	var size int64
+	for _, key := range kv.keys[start:end] {
+		size += int64(kv.index[key].length)
+	}
+	return size
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/alexcesaro/log"
 	"github.com/alexcesaro/log/golog"
@@ -11,25 +16,197 @@ import (
 var (
 	logger        *golog.Logger
 	address, path *string
+	strict        *bool
+	flatten       *bool
+	snapshotDir   *string
+	fsync         *string
+	compactAfter  *time.Duration
+	backend       *string
+	cacheSize     *int
 )
 
 func init() {
 	address = flag.String("address", "127.0.0.1:8080", "serve requests to this host[:port]")
 	path = flag.String("path", "data", "PerfDB data directory")
-	flag.Parse()
+	backend = flag.String("backend", fsBackend, "where to store databases: fs (a directory per database in -path), kv (a single file in -path) or memory (lost on exit)")
+	cacheSize = flag.Int("cache-size", defaultCacheSize, "number of summaries and heat maps to keep in memory, 0 disables caching")
+	strict = flag.Bool("strict", false, "reject samples with invalid fields instead of dropping them")
+	flatten = flag.Bool("flatten", false, "store nested JSON objects as metrics with dotted names")
+	snapshotDir = flag.String("snapshots", "snapshots", "directory for snapshots of the data directory")
+	compactAfter = flag.Duration("compact-after", 7*24*time.Hour, "compress databases without new samples for this long, 0 disables compaction")
+	fsync = flag.String("fsync", fsyncInterval, "when to flush writes to disk: always, interval or never")
+	flag.Usage = usage
 
 	logger = golog.New(os.Stdout, log.Info)
 }
 
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [flags]           start the server\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [flags] snapshot  take a snapshot using the server at -address\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [flags] fsck [-repair]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "                     check files in -path, the server must be stopped\n")
+	fmt.Fprintf(os.Stderr, "  %s migrate -from [backend:]dir -to [backend:]dir\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "                     copy and verify all databases, the server must be stopped\n")
+	flag.PrintDefaults()
+}
+
+// runSnapshot asks the running server to take a snapshot, so that it's
+// consistent with concurrent writes.
+func runSnapshot() {
+	resp, err := http.Post("http://"+*address+"/_snapshots", "application/json", nil)
+	if err != nil {
+		logger.Critical(err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logger.Critical(err)
+		os.Exit(1)
+	}
+	if resp.StatusCode != http.StatusOK {
+		logger.Criticalf("Snapshot failed: %s %s", resp.Status, body)
+		os.Exit(1)
+	}
+	fmt.Printf("%s\n", body)
+}
+
+// runFsck checks the data directory directly, so it also works when the
+// server cannot start.
+func runFsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix problems where possible")
+	flags.Parse(args)
+
+	storage, err := newPerfDB(*path)
+	if err != nil {
+		os.Exit(1)
+	}
+	report, err := storage.fsck(*repair)
+	if err != nil {
+		logger.Critical(err)
+		os.Exit(1)
+	}
+
+	unrepaired := 0
+	for _, problem := range report.Problems {
+		status := "found"
+		if problem.Repaired {
+			status = "repaired"
+		} else {
+			unrepaired++
+		}
+		fmt.Printf("%s: %s (%s)\n", problem.File, problem.Problem, status)
+	}
+	fmt.Printf("%d databases, %d metrics, %d problems\n", report.Databases, report.Metrics, len(report.Problems))
+	if unrepaired > 0 {
+		os.Exit(1)
+	}
+}
+
+// runMigrate copies databases between directories or backends. It can be
+// started again if interrupted.
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "", "source directory, optionally prefixed by the backend (e.g. fs:data)")
+	to := flags.String("to", "", "destination directory, optionally prefixed by the backend (e.g. kv:data-kv)")
+	flags.Parse(args)
+
+	var specs [2]storageSpec
+	for i, spec := range []string{*from, *to} {
+		var err error
+		if specs[i], err = parseStorageSpec(spec); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			flags.Usage()
+			os.Exit(2)
+		}
+	}
+	if _, err := os.Stat(specs[0].dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if filepath.Clean(specs[0].dir) == filepath.Clean(specs[1].dir) {
+		fmt.Fprintln(os.Stderr, "source and destination must be different directories")
+		os.Exit(2)
+	}
+
+	var storages [2]Storage
+	for i, spec := range specs {
+		var err error
+		if storages[i], err = openStorage(spec.backend, spec.dir); err != nil {
+			os.Exit(1)
+		}
+	}
+	if pdb, ok := storages[0].(*perfDB); ok {
+		pdb.readOnly = true
+	}
+
+	report, err := migrate(storages[0], storages[1], filepath.Join(specs[1].dir, migrationJournal), os.Stdout)
+	if err != nil {
+		logger.Critical(err)
+		os.Exit(1)
+	}
+
+	for _, mismatch := range report.Mismatches {
+		fmt.Printf("%s\n", mismatch)
+	}
+	fmt.Printf("%d databases (%d already migrated), %d metrics, %d samples copied, %d mismatches\n",
+		report.Databases, report.Skipped, report.Metrics, report.Samples, len(report.Mismatches))
+	if len(report.Mismatches) > 0 {
+		os.Exit(1)
+	}
+}
+
 func main() {
+	flag.Parse()
+
+	if err := validateFsyncPolicy(*fsync); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		usage()
+		os.Exit(2)
+	}
+	fsyncPolicy = *fsync
+	if err := validateBackend(*backend); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		usage()
+		os.Exit(2)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "snapshot":
+		runSnapshot()
+		return
+	case "fsck":
+		runFsck(flag.Args()[1:])
+		return
+	case "migrate":
+		runMigrate(flag.Args()[1:])
+		return
+	default:
+		usage()
+		os.Exit(2)
+	}
+
 	// Database handler
-	var err error
-	var storage *perfDB
-	if storage, err = newPerfDB(*path); err != nil {
+	storage, err := openStorage(*backend, *path)
+	if err != nil {
 		os.Exit(1)
 	}
+	if pdb, ok := storage.(*perfDB); ok && *compactAfter > 0 {
+		go pdb.compactInBackground(*compactAfter)
+	}
 
 	// Controller
 	controller := newController(storage)
-	newRouter(controller).Run(*address)
+	controller.strict = *strict
+	controller.flatten = *flatten
+	controller.snapshotDir = *snapshotDir
+	controller.cache = newResultCache(*cacheSize)
+	if err := http.ListenAndServe(*address, newRouter(controller)); err != nil {
+		logger.Critical(err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memStorage keeps databases in memory, nothing survives a restart. Samples
+// are stored according to the same settings as in perfDB, so it's a drop-in
+// replacement for ephemeral CI runs and tests.
+type memStorage struct {
+	mu        sync.Mutex
+	databases map[string]*memDatabase
+}
+
+type memDatabase struct {
+	created     int64 // Milliseconds
+	settings    DatabaseSettings
+	meta        map[string]interface{}
+	metricsMeta map[string]MetricMeta
+	annotations []Annotation
+	metrics     map[string]*memMetric
+}
+
+type memMetric struct {
+	samples []Sample // In the order they were stored, like records of a data file
+	buffer  reorderBuffer
+}
+
+// memSampleSize is the estimated size of a sample, it stands for the size of
+// data files.
+const memSampleSize = 16
+
+func newMemStorage() *memStorage {
+	return &memStorage{databases: map[string]*memDatabase{}}
+}
+
+func notExist(name string) error {
+	return &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+// database returns the database, it's created if needed. The caller must hold
+// ms.mu.
+func (ms *memStorage) database(dbname string) *memDatabase {
+	db, ok := ms.databases[dbname]
+	if !ok {
+		db = &memDatabase{
+			created:     time.Now().UnixNano() / 1e6,
+			settings:    defaultSettings,
+			meta:        map[string]interface{}{},
+			metricsMeta: map[string]MetricMeta{},
+			annotations: []Annotation{},
+			metrics:     map[string]*memMetric{},
+		}
+		ms.databases[dbname] = db
+	}
+	return db
+}
+
+// metric returns the metric with all buffered samples stored. The caller must
+// hold ms.mu.
+func (ms *memStorage) metric(dbname, metric string) (*memDatabase, *memMetric, error) {
+	db, ok := ms.databases[dbname]
+	if !ok {
+		return nil, nil, notExist(dbname)
+	}
+	m, ok := db.metrics[metric]
+	if !ok {
+		return nil, nil, notExist(metric)
+	}
+	if err := m.flush(); err != nil {
+		return nil, nil, err
+	}
+	return db, m, nil
+}
+
+// write stores the sample according to the out-of-order and duplicate
+// policies, see writeSample.
+func (m *memMetric) write(sample Sample, settings DatabaseSettings) error {
+	if n := len(m.samples); n > 0 {
+		last := m.samples[n-1].ts
+		switch {
+		case sample.ts < last && settings.OutOfOrder == rejectOutOfOrder:
+			return errOutOfOrder
+		case sample.ts == last && settings.Duplicates == firstDuplicate:
+			return nil
+		case sample.ts == last && settings.Duplicates == lastDuplicate:
+			m.samples[n-1] = sample
+			return nil
+		}
+	}
+	m.samples = append(m.samples, sample)
+	return nil
+}
+
+func (m *memMetric) flush() error {
+	return m.buffer.flushTo(func(sample Sample) error {
+		return m.write(sample, m.buffer.settings)
+	}, len(m.buffer.samples))
+}
+
+func (ms *memStorage) addSample(dbname, metric string, sample Sample) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	db := ms.database(dbname)
+	m, ok := db.metrics[metric]
+	if !ok {
+		m = &memMetric{}
+		db.metrics[metric] = m
+	}
+
+	settings := db.settings
+	if settings.ReorderWindow == 0 {
+		return m.write(sample, settings)
+	}
+	// Samples older than the stored ones cannot be reordered anymore
+	if n := len(m.samples); n > 0 && sample.ts < m.samples[n-1].ts {
+		return m.write(sample, settings)
+	}
+	return m.buffer.flushTo(func(sample Sample) error {
+		return m.write(sample, settings)
+	}, m.buffer.insert(sample, settings))
+}
+
+func (ms *memStorage) checkOrder(dbname, metric string, ts int64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	db, ok := ms.databases[dbname]
+	if !ok || db.settings.OutOfOrder != rejectOutOfOrder {
+		return nil
+	}
+	m, ok := db.metrics[metric]
+	if ok && len(m.samples) > 0 && ts < m.samples[len(m.samples)-1].ts {
+		return errOutOfOrder
+	}
+	return nil
+}
+
+func (ms *memStorage) checkDbExists(dbname string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.databases[dbname]; !ok {
+		return notExist(dbname)
+	}
+	return nil
+}
+
+func (ms *memStorage) checkMetricExists(dbname, metric string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	_, _, err := ms.metric(dbname, metric)
+	return err
+}
+
+func (ms *memStorage) listDatabases() ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	databases := []string{}
+	for dbname := range ms.databases {
+		databases = append(databases, dbname)
+	}
+	sort.Strings(databases)
+	return databases, nil
+}
+
+func (ms *memStorage) getDatabaseInfo(dbname string) (*DatabaseInfo, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	db, ok := ms.databases[dbname]
+	if !ok {
+		return nil, notExist(dbname)
+	}
+
+	info := DatabaseInfo{Name: dbname, Created: db.created, Metadata: copyMeta(db.meta)}
+	for metric := range db.metrics {
+		_, m, err := ms.metric(dbname, metric)
+		if err != nil {
+			return nil, err
+		}
+
+		info.Metrics++
+		info.Size += int64(len(m.samples)) * memSampleSize
+		first, last := m.samples[0].ts, m.samples[len(m.samples)-1].ts
+		if info.FirstTS == 0 || first < info.FirstTS {
+			info.FirstTS = first
+		}
+		if last > info.LastTS {
+			info.LastTS = last
+		}
+	}
+
+	// Listings mix databases of different precision, so they use milliseconds
+	info.FirstTS = convertPrecision(info.FirstTS, db.settings.unit(), time.Millisecond)
+	info.LastTS = convertPrecision(info.LastTS, db.settings.unit(), time.Millisecond)
+	return &info, nil
+}
+
+func (ms *memStorage) listMetrics(dbname string) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	db, ok := ms.databases[dbname]
+	if !ok {
+		return nil, notExist(dbname)
+	}
+
+	metrics := []string{}
+	for metric := range db.metrics {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	return metrics, nil
+}
+
+// metricStats returns statistics of the metric. The caller must hold ms.mu.
+func (ms *memStorage) metricStats(dbname, metric string) (*MetricStats, error) {
+	_, m, err := ms.metric(dbname, metric)
+	if err != nil {
+		return nil, err
+	}
+
+	last := m.samples[len(m.samples)-1]
+	return &MetricStats{
+		Name:      metric,
+		Count:     len(m.samples),
+		FirstTS:   m.samples[0].ts,
+		LastTS:    last.ts,
+		LastValue: last.v,
+		Size:      int64(len(m.samples)) * memSampleSize,
+	}, nil
+}
+
+func (ms *memStorage) getMetricStats(dbname, metric string) (*MetricStats, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.metricStats(dbname, metric)
+}
+
+func (ms *memStorage) listMetricStats(dbname string) ([]*MetricStats, error) {
+	metrics, err := ms.listMetrics(dbname)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	allStats := []*MetricStats{}
+	for _, metric := range metrics {
+		stats, err := ms.metricStats(dbname, metric)
+		if err != nil {
+			return nil, err
+		}
+		stats.MetricMeta = ms.databases[dbname].metricsMeta[metric]
+		allStats = append(allStats, stats)
+	}
+	return allStats, nil
+}
+
+// readSamples returns a copy of the samples, so that readers don't block
+// writers.
+func (ms *memStorage) readSamples(dbname, metric string) ([]Sample, DatabaseSettings, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	db, m, err := ms.metric(dbname, metric)
+	if err != nil {
+		return nil, DatabaseSettings{}, err
+	}
+	samples := make([]Sample, len(m.samples))
+	copy(samples, m.samples)
+	return samples, db.settings, nil
+}
+
+func (ms *memStorage) streamRawValues(dbname, metric string, unit time.Duration, fn func(Sample) error) error {
+	samples, settings, err := ms.readSamples(dbname, metric)
+	if err != nil {
+		return err
+	}
+
+	for _, sample := range samples {
+		sample.ts = convertPrecision(sample.ts, settings.unit(), unit)
+		if err := fn(sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *memStorage) getSummary(dbname, metric string) (map[string]interface{}, error) {
+	samples, _, err := ms.readSamples(dbname, metric)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]float64, len(samples))
+	for i, sample := range samples {
+		values[i] = sample.v
+	}
+	return summarize(values), nil
+}
+
+func (ms *memStorage) getHeatMap(dbname, metric string) (*heatMap, error) {
+	samples, settings, err := ms.readSamples(dbname, metric)
+	if err != nil {
+		return nil, err
+	}
+	return buildHeatMap(samples, settings.unit()), nil
+}
+
+func (ms *memStorage) getSettings(dbname string) (DatabaseSettings, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if db, ok := ms.databases[dbname]; ok {
+		return db.settings, nil
+	}
+	return defaultSettings, nil
+}
+
+func (ms *memStorage) setSettings(dbname string, settings DatabaseSettings) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	db := ms.database(dbname)
+
+	// Buffered samples follow the settings they were acknowledged with
+	for _, m := range db.metrics {
+		if err := m.flush(); err != nil {
+			return err
+		}
+	}
+
+	if db.settings.unit() != settings.unit() && len(db.metrics) > 0 {
+		return errPrecisionChange
+	}
+	db.settings = settings
+	return nil
+}
+
+func copyMeta(meta map[string]interface{}) map[string]interface{} {
+	copied := map[string]interface{}{}
+	for key, value := range meta {
+		copied[key] = value
+	}
+	return copied
+}
+
+func (ms *memStorage) getMeta(dbname string) (map[string]interface{}, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if db, ok := ms.databases[dbname]; ok {
+		return copyMeta(db.meta), nil
+	}
+	return map[string]interface{}{}, nil
+}
+
+func (ms *memStorage) setMeta(dbname string, meta map[string]interface{}) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.database(dbname).meta = copyMeta(meta)
+	return nil
+}
+
+func (ms *memStorage) getMetricMeta(dbname, metric string) (MetricMeta, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if db, ok := ms.databases[dbname]; ok {
+		return db.metricsMeta[metric], nil
+	}
+	return MetricMeta{}, nil
+}
+
+func (ms *memStorage) setMetricMeta(dbname, metric string, meta MetricMeta) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.database(dbname).metricsMeta[metric] = meta
+	return nil
+}
+
+func (ms *memStorage) addAnnotation(dbname string, annotation Annotation) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	db := ms.database(dbname)
+	db.annotations = append(db.annotations, annotation)
+	return nil
+}
+
+// getAnnotations returns annotations within [from, to], ordered by timestamp.
+// Zero bounds are not applied.
+func (ms *memStorage) getAnnotations(dbname string, from, to int64) ([]Annotation, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	annotations := []Annotation{}
+	db, ok := ms.databases[dbname]
+	if !ok {
+		return annotations, nil
+	}
+	for _, annotation := range db.annotations {
+		if (from != 0 && annotation.Timestamp < from) || (to != 0 && annotation.Timestamp > to) {
+			continue
+		}
+		annotations = append(annotations, annotation)
+	}
+
+	sort.SliceStable(annotations, func(i, j int) bool {
+		return annotations[i].Timestamp < annotations[j].Timestamp
+	})
+	return annotations, nil
+}
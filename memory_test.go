@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// runConformanceRequests feeds the same data to the controller and returns
+// responses that must not depend on the backend.
+func runConformanceRequests(t *testing.T, controller *Controller) []string {
+	setTestSettings(controller, "reorder", "{\"reorderWindow\":1000,\"duplicates\":\"last\"}")
+	for _, sample := range []string{"2000:2", "1500:1.5", "3000:3", "1000:1", "2500:2.5", "3000:4"} {
+		addTestSample(controller, "reorder", "?ts=141194088"+sample[:4], "{\"cpu\":"+sample[5:]+"}")
+	}
+
+	setTestSettings(controller, "reject", "{\"outOfOrder\":\"reject\",\"precision\":\"us\"}")
+	for _, sample := range []string{"2000:2", "1000:1", "2000:3", "4000:5"} {
+		addTestSample(controller, "reject", "?ts=141194088"+sample[:4]+"000", "{\"cpu\":"+sample[5:]+",\"mem\":1}")
+	}
+
+	requests := []struct{ method, url, body string }{
+		{"PUT", "/_db/reorder/meta", "{\"build\":\"1.0\"}"},
+		{"PUT", "/reorder/cpu/meta", "{\"unit\":\"%\"}"},
+		{"POST", "/_db/reorder/annotations?ts=1411940882000", "{\"text\":\"restart\"}"},
+		{"PUT", "/_db/reject/settings", "{\"precision\":\"ms\"}"},
+		{"GET", "/reorder", ""},
+		{"GET", "/reject", ""},
+		{"GET", "/missing", ""},
+		{"GET", "/reorder/cpu", ""},
+		{"GET", "/reject/cpu?format=csv", ""},
+		{"GET", "/reject/mem?precision=ms", ""},
+		{"GET", "/reorder/mem", ""},
+		{"GET", "/reorder/cpu/summary", ""},
+		{"GET", "/reject/cpu/summary", ""},
+		{"GET", "/_db/reject/summary?metrics=cpu,missing", ""},
+		{"GET", "/reorder/cpu/heatmap", ""},
+		{"GET", "/reorder/cpu/meta", ""},
+		{"GET", "/_db/reorder/meta", ""},
+		{"GET", "/_db/reject/settings", ""},
+		{"GET", "/_db/reorder/annotations", ""},
+	}
+
+	responses := []string{}
+	for _, r := range requests {
+		req, _ := http.NewRequest(r.method, r.url, bytes.NewBufferString(r.body))
+		rw := httptest.NewRecorder()
+		newRouter(controller).ServeHTTP(rw, req)
+		responses = append(responses, r.method+" "+r.url+" "+http.StatusText(rw.Code)+" "+rw.Body.String())
+	}
+
+	// Sizes and creation times are backend specific
+	databases, _ := listTestDatabases(t, controller, "")
+	for i := range databases {
+		databases[i].Size, databases[i].Created = 0, 0
+	}
+	stats := []*MetricStats{}
+	for _, dbname := range []string{"reorder", "reject"} {
+		dbStats, err := controller.storage.listMetricStats(dbname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats = append(stats, dbStats...)
+	}
+	for _, s := range stats {
+		s.Size = 0
+	}
+	data, _ := json.Marshal([]interface{}{databases, stats})
+	return append(responses, string(data))
+}
+
+func TestBackendConformance(t *testing.T) {
+	pdb, err := newTmpStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := newTmpKVStorage(t)
+	expected := runConformanceRequests(t, newController(pdb))
+
+	for _, storage := range []Storage{newMemStorage(), ks} {
+		actual := runConformanceRequests(t, newController(storage))
+
+		assert.Equal(t, len(expected), len(actual))
+		for i := range expected {
+			assert.Equal(t, expected[i], actual[i])
+		}
+	}
+}
+
+func TestMemoryUnsupported(t *testing.T) {
+	controller := newController(newMemStorage())
+	addTestSample(controller, "database", "?ts=1411940889515", "{\"cpu\":1}")
+
+	for _, r := range []struct{ method, url string }{
+		{"GET", "/_db/database/export"},
+		{"POST", "/_import"},
+		{"POST", "/_snapshots"},
+		{"GET", "/_fsck"},
+		{"POST", "/_fsck"},
+		{"GET", "/_db/database/compaction"},
+		{"POST", "/_db/database/compaction"},
+	} {
+		req, _ := http.NewRequest(r.method, r.url, nil)
+		rw := httptest.NewRecorder()
+		newRouter(controller).ServeHTTP(rw, req)
+
+		assert.Equal(t, http.StatusNotImplemented, rw.Code, r.method+" "+r.url)
+		assert.Equal(t, "{\"error\":\""+errUnsupported.Error()+"\"}", rw.Body.String())
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	metaFile        = "meta.json"
+	metricsMetaFile = "metrics.json"
+	annotationsFile = "annotations.json"
+)
+
+type MetricMeta struct {
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type Annotation struct {
+	Timestamp int64  `json:"ts"`
+	Text      string `json:"text"`
+}
+
+func (pdb *perfDB) getMeta(dbname string) (map[string]interface{}, error) {
+	meta := map[string]interface{}{}
+
+	data, err := ioutil.ReadFile(filepath.Join(pdb.getDirPath(dbname), metaFile))
+	if os.IsNotExist(err) {
+		return meta, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (pdb *perfDB) setMeta(dbname string, meta map[string]interface{}) error {
+	dataDir := pdb.getDirPath(dbname)
+	if err := os.MkdirAll(dataDir, 0775); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+
+	return writeFileAtomic(filepath.Join(dataDir, metaFile), data)
+}
+
+func (pdb *perfDB) readMetricsMeta(dbname string) (map[string]MetricMeta, error) {
+	metrics := map[string]MetricMeta{}
+
+	data, err := ioutil.ReadFile(filepath.Join(pdb.getDirPath(dbname), metricsMetaFile))
+	if os.IsNotExist(err) {
+		return metrics, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &metrics); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+func (pdb *perfDB) getMetricMeta(dbname, metric string) (MetricMeta, error) {
+	metrics, err := pdb.readMetricsMeta(dbname)
+	if err != nil {
+		return MetricMeta{}, err
+	}
+	return metrics[metric], nil
+}
+
+func (pdb *perfDB) setMetricMeta(dbname, metric string, meta MetricMeta) error {
+	dataDir := pdb.getDirPath(dbname)
+	if err := os.MkdirAll(dataDir, 0775); err != nil {
+		return err
+	}
+
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+
+	metrics, err := pdb.readMetricsMeta(dbname)
+	if err != nil {
+		return err
+	}
+	metrics[metric] = meta
+
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(dataDir, metricsMetaFile), data)
+}
+
+// matchMeta reports whether every filter value equals the corresponding
+// metadata value. Values are compared in their text form, so that query
+// parameters can match numbers and booleans as well.
+func matchMeta(meta map[string]interface{}, filters map[string]string) bool {
+	for key, expected := range filters {
+		value, ok := meta[key]
+		if !ok || fmt.Sprint(value) != expected {
+			return false
+		}
+	}
+	return true
+}
+
+func (pdb *perfDB) addAnnotation(dbname string, annotation Annotation) error {
+	dataDir := pdb.getDirPath(dbname)
+	if err := os.MkdirAll(dataDir, 0775); err != nil {
+		return err
+	}
+
+	record, err := json.Marshal(annotation)
+	if err != nil {
+		return err
+	}
+
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+
+	file, err := os.OpenFile(filepath.Join(dataDir, annotationsFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := truncateTorn(file); err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(file, "%s\n", record); err != nil {
+		return err
+	}
+	if fsyncPolicy == fsyncAlways {
+		return syncToDisk(file)
+	}
+	markDirty(file.Name())
+	return nil
+}
+
+// getAnnotations returns annotations within [from, to], ordered by timestamp.
+// Zero bounds are not applied.
+func (pdb *perfDB) getAnnotations(dbname string, from, to int64) ([]Annotation, error) {
+	annotations := []Annotation{}
+
+	file, err := os.Open(filepath.Join(pdb.getDirPath(dbname), annotationsFile))
+	if os.IsNotExist(err) {
+		return annotations, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		record, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break // A torn record is left by an interrupted write
+		} else if err != nil {
+			return nil, err
+		}
+
+		var annotation Annotation
+		if err := json.Unmarshal(record, &annotation); err != nil {
+			return nil, err
+		}
+		if (from != 0 && annotation.Timestamp < from) || (to != 0 && annotation.Timestamp > to) {
+			continue
+		}
+		annotations = append(annotations, annotation)
+	}
+
+	sort.SliceStable(annotations, func(i, j int) bool {
+		return annotations[i].Timestamp < annotations[j].Timestamp
+	})
+	return annotations, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// migrate copies databases between storage backends (or directories). Every
+// database is verified once copied: both sides must have the same metrics,
+// and every metric the same number of samples with the same checksum.
+//
+// Verified databases are recorded in a journal in the destination
+// directory, so an interrupted migration skips them when it's started again.
+// A database that was being copied is resumed: samples and annotations that
+// are already in the destination are not copied again. The journal is
+// removed once all databases are verified.
+//
+// A source in the file store is read-only: metrics that need recovery (a torn
+// record, an incomplete legacy commit) fail the migration instead of being
+// repaired, so that the archive is kept intact. Run fsck on a copy first.
+
+const migrationJournal = "migration.json"
+
+type MigrationReport struct {
+	Databases  int      `json:"databases"`
+	Skipped    int      `json:"skipped"` // Verified by a previous run
+	Metrics    int      `json:"metrics"`
+	Samples    int64    `json:"samples"` // Copied by this run
+	Mismatches []string `json:"mismatches"`
+}
+
+// storageSpec is either a directory or "backend:directory".
+type storageSpec struct {
+	backend string
+	dir     string
+}
+
+func parseStorageSpec(spec string) (storageSpec, error) {
+	if i := strings.Index(spec, ":"); i > 0 && validateBackend(spec[:i]) == nil {
+		spec := storageSpec{backend: spec[:i], dir: spec[i+1:]}
+		if spec.backend == memoryBackend {
+			return spec, fmt.Errorf("cannot migrate from or to memory")
+		}
+		return spec, nil
+	}
+	if spec == "" {
+		return storageSpec{}, fmt.Errorf("storage is not specified")
+	}
+	return storageSpec{backend: fsBackend, dir: spec}, nil
+}
+
+type journal struct {
+	fileName string
+	Verified map[string]bool `json:"verified"`
+}
+
+func loadJournal(fileName string) (*journal, error) {
+	j := journal{fileName: fileName, Verified: map[string]bool{}}
+
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return &j, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, fmt.Errorf("malformed journal %s: %s", fileName, err)
+	}
+	return &j, nil
+}
+
+func (j *journal) verified(dbname string) error {
+	j.Verified[dbname] = true
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.fileName, data)
+}
+
+// migrate copies all databases from src to dst. Progress is reported to out.
+func migrate(src, dst Storage, journalFile string, out io.Writer) (*MigrationReport, error) {
+	j, err := loadJournal(journalFile)
+	if err != nil {
+		return nil, err
+	}
+
+	databases, err := src.listDatabases()
+	if err != nil {
+		return nil, err
+	}
+
+	report := MigrationReport{Mismatches: []string{}}
+	for i, dbname := range databases {
+		report.Databases++
+		progress := fmt.Sprintf("[%d/%d] %s", i+1, len(databases), dbname)
+		if j.Verified[dbname] {
+			report.Skipped++
+			fmt.Fprintf(out, "%s: already migrated\n", progress)
+			continue
+		}
+
+		metrics, samples, err := migrateDatabase(src, dst, dbname)
+		report.Metrics += metrics
+		report.Samples += samples
+		if err != nil {
+			return &report, fmt.Errorf("%s: %s", dbname, err)
+		}
+
+		mismatches, err := verifyDatabase(src, dst, dbname)
+		if err != nil {
+			return &report, fmt.Errorf("%s: %s", dbname, err)
+		}
+		if len(mismatches) > 0 {
+			report.Mismatches = append(report.Mismatches, mismatches...)
+			fmt.Fprintf(out, "%s: %d metrics, %d samples copied, %d mismatches\n", progress, metrics, samples, len(mismatches))
+			continue
+		}
+		// The database must be on disk before it's skipped by the next run
+		if err := flushDirtyFiles(); err != nil {
+			return &report, err
+		}
+		if err := j.verified(dbname); err != nil {
+			return &report, err
+		}
+		fmt.Fprintf(out, "%s: %d metrics, %d samples copied, verified\n", progress, metrics, samples)
+	}
+
+	if len(report.Mismatches) == 0 {
+		if err := os.Remove(journalFile); err != nil && !os.IsNotExist(err) {
+			return &report, err
+		}
+	}
+	return &report, nil
+}
+
+// migrateDatabase copies the database and returns the number of metrics and
+// copied samples.
+func migrateDatabase(src, dst Storage, dbname string) (int, int64, error) {
+	settings, err := src.getSettings(dbname)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Samples are copied in the order they are stored, so that nothing is
+	// reordered, rejected or deduplicated for the second time
+	copySettings := DatabaseSettings{
+		OutOfOrder: acceptOutOfOrder,
+		Duplicates: keepDuplicates,
+		Precision:  settings.Precision,
+	}
+	if err := dst.setSettings(dbname, copySettings); err == errPrecisionChange {
+		return 0, 0, fmt.Errorf("the destination has samples with another precision")
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	meta, err := src.getMeta(dbname)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := dst.setMeta(dbname, meta); err != nil {
+		return 0, 0, err
+	}
+
+	metrics, err := src.listMetrics(dbname)
+	if err != nil {
+		return 0, 0, err
+	}
+	var copied int64
+	for _, metric := range metrics {
+		n, err := migrateMetric(src, dst, dbname, metric, settings)
+		copied += n
+		if err != nil {
+			return len(metrics), copied, fmt.Errorf("%s: %s", metric, err)
+		}
+	}
+
+	annotations, err := src.getAnnotations(dbname, 0, 0)
+	if err != nil {
+		return len(metrics), copied, err
+	}
+	existing, err := dst.getAnnotations(dbname, 0, 0)
+	if err != nil {
+		return len(metrics), copied, err
+	}
+	// Both are ordered the same way, existing ones were copied by a previous run
+	if len(existing) > len(annotations) {
+		return len(metrics), copied, fmt.Errorf("the destination has more annotations")
+	}
+	for _, annotation := range annotations[len(existing):] {
+		if err := dst.addAnnotation(dbname, annotation); err != nil {
+			return len(metrics), copied, err
+		}
+	}
+
+	return len(metrics), copied, dst.setSettings(dbname, settings)
+}
+
+// migrateMetric copies samples of the metric that are not in the destination
+// yet and returns their number.
+func migrateMetric(src, dst Storage, dbname, metric string, settings DatabaseSettings) (int64, error) {
+	meta, err := src.getMetricMeta(dbname, metric)
+	if err != nil {
+		return 0, err
+	}
+	if meta != (MetricMeta{}) {
+		if err := dst.setMetricMeta(dbname, metric, meta); err != nil {
+			return 0, err
+		}
+	}
+
+	existing := 0
+	if dst.checkMetricExists(dbname, metric) == nil {
+		stats, err := dst.getMetricStats(dbname, metric)
+		if err != nil {
+			return 0, err
+		}
+		existing = stats.Count
+	}
+
+	var n, copied int64
+	err = src.streamRawValues(dbname, metric, settings.unit(), func(sample Sample) error {
+		n++
+		if n <= int64(existing) {
+			return nil
+		}
+		copied++
+		return dst.addSample(dbname, metric, sample)
+	})
+	return copied, err
+}
+
+// metricChecksum returns the number of samples and their checksum.
+func metricChecksum(storage Storage, dbname, metric string, settings DatabaseSettings) (int, uint64, error) {
+	hash := crc64.New(crc64.MakeTable(crc64.ECMA))
+	count := 0
+	var buf [16]byte
+	err := storage.streamRawValues(dbname, metric, settings.unit(), func(sample Sample) error {
+		count++
+		binary.BigEndian.PutUint64(buf[:8], uint64(sample.ts))
+		binary.BigEndian.PutUint64(buf[8:], math.Float64bits(sample.v))
+		hash.Write(buf[:])
+		return nil
+	})
+	return count, hash.Sum64(), err
+}
+
+// verifyDatabase compares the database in both storages and describes every
+// difference.
+func verifyDatabase(src, dst Storage, dbname string) ([]string, error) {
+	mismatches := []string{}
+
+	settings, err := src.getSettings(dbname)
+	if err != nil {
+		return nil, err
+	}
+	if dstSettings, err := dst.getSettings(dbname); err != nil {
+		return nil, err
+	} else if dstSettings != settings {
+		mismatches = append(mismatches, fmt.Sprintf("%s: settings differ", dbname))
+	}
+
+	srcMetrics, err := src.listMetrics(dbname)
+	if err != nil {
+		return nil, err
+	}
+	dstMetrics, err := dst.listMetrics(dbname)
+	if err != nil {
+		return nil, err
+	}
+	if len(srcMetrics) != len(dstMetrics) {
+		mismatches = append(mismatches, fmt.Sprintf("%s: %d metrics instead of %d", dbname, len(dstMetrics), len(srcMetrics)))
+	} else if !reflect.DeepEqual(srcMetrics, dstMetrics) {
+		mismatches = append(mismatches, fmt.Sprintf("%s: metric names differ", dbname))
+	}
+
+	for _, metric := range srcMetrics {
+		count, checksum, err := metricChecksum(src, dbname, metric, settings)
+		if err != nil {
+			return nil, err
+		}
+		dstCount, dstChecksum, err := metricChecksum(dst, dbname, metric, settings)
+		switch {
+		case err != nil:
+			mismatches = append(mismatches, fmt.Sprintf("%s/%s: %s", dbname, metric, err))
+		case dstCount != count:
+			mismatches = append(mismatches, fmt.Sprintf("%s/%s: %d samples instead of %d", dbname, metric, dstCount, count))
+		case dstChecksum != checksum:
+			mismatches = append(mismatches, fmt.Sprintf("%s/%s: checksum mismatch", dbname, metric))
+		}
+	}
+
+	annotations, err := src.getAnnotations(dbname, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	dstAnnotations, err := dst.getAnnotations(dbname, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(annotations, dstAnnotations) {
+		mismatches = append(mismatches, fmt.Sprintf("%s: %d annotations instead of %d", dbname, len(dstAnnotations), len(annotations)))
+	}
+	return mismatches, nil
+}
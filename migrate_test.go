@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// addMigrationTestData stores samples that would be changed by the settings
+// if they were added again.
+func addMigrationTestData(t *testing.T, storage Storage) {
+	for _, sample := range []Sample{{1411940882000, 2}, {1411940881000, 1}, {1411940882000, 3}} {
+		if err := storage.addSample("run-1", "cpu", sample); err != nil {
+			t.Fatal(err)
+		}
+	}
+	settings := DatabaseSettings{ReorderWindow: 5000, OutOfOrder: rejectOutOfOrder, Duplicates: firstDuplicate, Precision: "ms"}
+	if err := storage.setSettings("run-1", settings); err != nil {
+		t.Fatal(err)
+	}
+	storage.setMeta("run-1", map[string]interface{}{"build": "1.0"})
+	storage.setMetricMeta("run-1", "cpu", MetricMeta{Unit: "%"})
+	storage.addAnnotation("run-1", Annotation{1411940881500, "restart"})
+
+	storage.setSettings("run-2", DatabaseSettings{OutOfOrder: acceptOutOfOrder, Duplicates: keepDuplicates, Precision: "us"})
+	for i := 0; i < 1000; i++ {
+		storage.addSample("run-2", "mem", Sample{1411940881000000 + int64(i), float64(i)})
+	}
+}
+
+func readMigrationTestSamples(t *testing.T, storage Storage, dbname, metric string) []Sample {
+	samples := []Sample{}
+	err := storage.streamRawValues(dbname, metric, time.Nanosecond, func(sample Sample) error {
+		samples = append(samples, sample)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return samples
+}
+
+func TestMigrate(t *testing.T) {
+	src := newTestStorage(t)
+	dst := newTmpKVStorage(t)
+	addMigrationTestData(t, src)
+
+	var out bytes.Buffer
+	journalFile := filepath.Join(filepath.Dir(dst.kv.fileName), migrationJournal)
+	report, err := migrate(src, dst, journalFile, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, MigrationReport{Databases: 2, Metrics: 2, Samples: 1003, Mismatches: []string{}}, *report)
+	assert.Equal(t, "[1/2] run-1: 1 metrics, 3 samples copied, verified\n[2/2] run-2: 1 metrics, 1000 samples copied, verified\n",
+		out.String())
+
+	assert.Equal(t, readMigrationTestSamples(t, src, "run-1", "cpu"), readMigrationTestSamples(t, dst, "run-1", "cpu"))
+	settings, _ := dst.getSettings("run-1")
+	assert.Equal(t, int64(5000), settings.ReorderWindow)
+	meta, _ := dst.getMeta("run-1")
+	assert.Equal(t, map[string]interface{}{"build": "1.0"}, meta)
+	metricMeta, _ := dst.getMetricMeta("run-1", "cpu")
+	assert.Equal(t, "%", metricMeta.Unit)
+	annotations, _ := dst.getAnnotations("run-1", 0, 0)
+	assert.Equal(t, []Annotation{{1411940881500, "restart"}}, annotations)
+
+	_, err = os.Stat(journalFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMigrateResume(t *testing.T) {
+	defer func() {
+		setFailpoint(func(string) error { return nil })
+	}()
+
+	src := newTestStorage(t)
+	dst := newTmpKVStorage(t)
+	addMigrationTestData(t, src)
+
+	// Interrupted in the middle of run-2
+	journalFile := filepath.Join(filepath.Dir(dst.kv.fileName), migrationJournal)
+	crashAt("write", 500)
+	_, err := migrate(src, dst, journalFile, &bytes.Buffer{})
+	assert.NotNil(t, err)
+	setFailpoint(func(string) error { return nil })
+
+	dst = reopenKVStorage(t, dst)
+	var out bytes.Buffer
+	report, err := migrate(src, dst, journalFile, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, report.Skipped)
+	assert.True(t, report.Samples > 0 && report.Samples < 1000, "%d samples", report.Samples)
+	assert.Equal(t, []string{}, report.Mismatches)
+	assert.Contains(t, out.String(), "[1/2] run-1: already migrated\n")
+	assert.Contains(t, out.String(), "[2/2] run-2: 1 metrics")
+
+	assert.Equal(t, readMigrationTestSamples(t, src, "run-2", "mem"), readMigrationTestSamples(t, dst, "run-2", "mem"))
+}
+
+func TestMigrateEscapedNames(t *testing.T) {
+	src := newTestStorage(t)
+	dst := newTmpKVStorage(t)
+	// "cpu-idle.data" is listed before "cpu.data"
+	for _, metric := range []string{"cpu", "cpu-idle", "cpu/user"} {
+		if err := src.addSample("run-1", metric, Sample{1411940881000, 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	journalFile := filepath.Join(filepath.Dir(dst.kv.fileName), migrationJournal)
+	report, err := migrate(src, dst, journalFile, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, MigrationReport{Databases: 1, Metrics: 3, Samples: 3, Mismatches: []string{}}, *report)
+
+	metrics, err := src.listMetrics("run-1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"cpu", "cpu-idle", "cpu/user"}, metrics)
+}
+
+func TestMigrateReadOnlySource(t *testing.T) {
+	src := newTestStorage(t)
+	addMigrationTestData(t, src)
+
+	// A torn record and a legacy metric with an incomplete commit
+	dataDir := src.getDirPath("run-1")
+	appendFile := func(name, data string) {
+		file, _ := os.OpenFile(filepath.Join(dataDir, name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		file.WriteString(data)
+		file.Close()
+	}
+	appendFile("cpu.data", "1000 7")
+	appendFile("cpu.data.tmp", "{}")
+	appendFile("disk.data", "0 5\n1000 6\n")
+	appendFile("disk.data.1", "1411940881000")
+	appendFile("disk.data.n", "1411940881000 6")
+
+	snapshot := func() map[string]string {
+		files := map[string]string{}
+		filepath.Walk(src.baseDir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				data, _ := ioutil.ReadFile(path)
+				files[path] = string(data)
+			}
+			return nil
+		})
+		return files
+	}
+	before := snapshot()
+
+	src, _ = newPerfDB(src.baseDir)
+	src.readOnly = true
+	for metric, problem := range map[string]string{"cpu": "torn last record", "disk": "committed size is 6, data has 11 bytes"} {
+		err := src.streamRawValues("run-1", metric, time.Millisecond, func(Sample) error { return nil })
+		if assert.NotNil(t, err, metric) {
+			assert.Contains(t, err.Error(), problem, metric)
+		}
+	}
+	_, _, err := migrateDatabase(src, newMemStorage(), "run-1")
+	assert.NotNil(t, err)
+
+	// Nothing is repaired or removed
+	assert.Equal(t, before, snapshot())
+}
+
+func TestMigrateMismatch(t *testing.T) {
+	src := newTestStorage(t)
+	dst := newMemStorage()
+	addMigrationTestData(t, src)
+	dst.setSettings("run-2", DatabaseSettings{OutOfOrder: acceptOutOfOrder, Duplicates: keepDuplicates, Precision: "us"})
+	dst.addSample("run-2", "extra", Sample{1411940881000000, 1})
+
+	journalFile := filepath.Join(src.baseDir, migrationJournal)
+	report, err := migrate(src, dst, journalFile, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"run-2: 2 metrics instead of 1"}, report.Mismatches)
+
+	// Only the verified database is recorded
+	j, err := loadJournal(journalFile)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"run-1": true}, j.Verified)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Database and metric names are arbitrary printable UTF-8 strings. Database
+// names cannot start with an underscore, those paths are reserved for perfdb
+// itself (see systemPrefix).
+//
+// On disk, every name is a single path element. Bytes that are not safe in
+// file names (path separators, characters reserved on Windows, etc.) are
+// percent-encoded, so that names like "../../etc/x" or "read/write" never
+// leave the data directory.
+
+const (
+	maxNameLength = 200 // in bytes
+
+	// Escaped names must fit in a file name with the longest extension
+	// (a compressed data file being written, see compactMetric)
+	maxFileNameLength = 255
+	maxEscapedLength  = maxFileNameLength - len(dataFileExt+compressedTmpExt)
+)
+
+var (
+	errEmptyName    = errors.New("name must not be empty")
+	errLongName     = fmt.Errorf("name must not be longer than %d bytes", maxNameLength)
+	errLongEscaped  = fmt.Errorf("name must not be longer than %d bytes with special characters encoded as 3 bytes", maxEscapedLength)
+	errInvalidUTF8  = errors.New("name must be valid UTF-8")
+	errReservedName = errors.New("database name must not start with \"_\"")
+)
+
+func validateName(name string) error {
+	switch {
+	case name == "":
+		return errEmptyName
+	case len(name) > maxNameLength:
+		return errLongName
+	case !utf8.ValidString(name):
+		return errInvalidUTF8
+	case len(escapeName(name)) > maxEscapedLength:
+		return errLongEscaped
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) && r != ' ' {
+			return fmt.Errorf("name must not contain %U", r)
+		}
+	}
+	return nil
+}
+
+func validateDbName(dbname string) error {
+	if err := validateName(dbname); err != nil {
+		return err
+	}
+	if strings.HasPrefix(dbname, "_") {
+		return errReservedName
+	}
+	return nil
+}
+
+func isUnsafeByte(b byte) bool {
+	return b < 0x20 || b == 0x7f || strings.IndexByte(`%/\:*?"<>|`, b) >= 0
+}
+
+// escapeName encodes a name into a safe file name.
+func escapeName(name string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		b := name[i]
+		// Leading dots make hidden files (or "." and ".."), trailing dots
+		// and spaces are dropped by Windows.
+		edge := (i == 0 && b == '.') || (i == len(name)-1 && (b == '.' || b == ' '))
+		if edge || isUnsafeByte(b) {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		} else {
+			buf.WriteByte(b)
+		}
+	}
+	return buf.String()
+}
+
+// unescapeName decodes a file name produced by escapeName.
+func unescapeName(fileName string) (string, error) {
+	var buf bytes.Buffer
+	for i := 0; i < len(fileName); i++ {
+		if fileName[i] != '%' {
+			buf.WriteByte(fileName[i])
+			continue
+		}
+		if i+2 >= len(fileName) {
+			return "", fmt.Errorf("invalid escape sequence in %q", fileName)
+		}
+		b, err := strconv.ParseUint(fileName[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence in %q", fileName)
+		}
+		buf.WriteByte(byte(b))
+		i += 2
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var hostileNames = []string{
+	"../../etc/x",
+	"..",
+	".",
+	".hidden",
+	"/etc/passwd",
+	"read/write",
+	"C:\\Windows\\system32",
+	"a:b",
+	"100%",
+	"%2E%2E",
+	"trailing.",
+	"trailing ",
+	"what?",
+	"<script>",
+	"pipe|star*quote\"",
+	"cpu usage",
+	"задержка",
+	"延迟 p99",
+}
+
+func TestEscapeName(t *testing.T) {
+	for _, name := range hostileNames {
+		fileName := escapeName(name)
+
+		assert.NotContains(t, fileName, "/", name)
+		assert.NotContains(t, fileName, "\\", name)
+		assert.False(t, strings.HasPrefix(fileName, "."), name)
+		assert.Equal(t, fileName, filepath.Base(fileName), name)
+
+		decoded, err := unescapeName(fileName)
+		assert.Nil(t, err, name)
+		assert.Equal(t, name, decoded)
+	}
+}
+
+func TestEscapeSafeName(t *testing.T) {
+	assert.Equal(t, "read_latency-1.5", escapeName("read_latency-1.5"))
+	assert.Equal(t, "cpu usage", escapeName("cpu usage"))
+	assert.Equal(t, "%2E.%2F..%2Fetc%2Fx", escapeName("../../etc/x"))
+}
+
+func TestEscapeNamesDontCollide(t *testing.T) {
+	seen := map[string]string{}
+	for _, name := range hostileNames {
+		fileName := escapeName(name)
+		if other, ok := seen[fileName]; ok {
+			t.Fatalf("%q and %q are both stored as %q", name, other, fileName)
+		}
+		seen[fileName] = name
+	}
+}
+
+func TestUnescapeBadName(t *testing.T) {
+	for _, fileName := range []string{"100%", "%2", "%zz", "a%g1"} {
+		_, err := unescapeName(fileName)
+		assert.NotNil(t, err, fileName)
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	for _, name := range hostileNames {
+		assert.Nil(t, validateName(name), name)
+	}
+
+	assert.Equal(t, errEmptyName, validateName(""))
+	assert.Equal(t, errLongName, validateName(strings.Repeat("x", maxNameLength+1)))
+	assert.Nil(t, validateName(strings.Repeat("/", maxEscapedLength/3)))
+	assert.Equal(t, errLongEscaped, validateName(strings.Repeat("/", maxEscapedLength/3+1)))
+	assert.Equal(t, errInvalidUTF8, validateName("\xff\xfe"))
+	assert.NotNil(t, validateName("new\nline"))
+	assert.NotNil(t, validateName("tab\t"))
+	assert.NotNil(t, validateName("nul\x00"))
+}
+
+func TestValidateDbName(t *testing.T) {
+	assert.Nil(t, validateDbName("mydatabase"))
+	assert.Equal(t, errReservedName, validateDbName("_ui"))
+	assert.Equal(t, errEmptyName, validateDbName(""))
+}
@@ -2,9 +2,10 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"math"
 	"os"
 	"path/filepath"
 	"sort"
@@ -26,29 +27,41 @@ type Sample struct {
 }
 
 type perfDB struct {
-	baseDir string
-	mu      sync.Mutex
+	baseDir     string
+	mu          sync.Mutex
+	buffers     map[string]*reorderBuffer
+	flusher     sync.Once
+	recovered   map[string]bool // Metrics checked by recoverCommit
+	compressing map[string]bool // Metrics compressed by compactMetric
+	readOnly    bool            // Files are never recovered, see migrate
 }
 
 var timestampCache *cache.Cache
 
 func newPerfDB(baseDir string) (*perfDB, error) {
 	if err := os.MkdirAll(baseDir, 0755); err != nil {
-		logger.Critical("Failed to initialize datastore: %s", err)
+		logger.Criticalf("Failed to initialize datastore: %s", err)
 		return nil, err
 	}
 	timestampCache = cache.New(time.Minute, time.Hour)
-	return &perfDB{baseDir, sync.Mutex{}}, nil
+	settingsCache = cache.New(time.Minute, time.Hour)
+	dataInfoCache = cache.New(time.Minute, time.Hour)
+	return &perfDB{
+		baseDir:     baseDir,
+		buffers:     map[string]*reorderBuffer{},
+		recovered:   map[string]bool{},
+		compressing: map[string]bool{},
+	}, nil
 }
 
 func (pdb *perfDB) getDirPath(dbname string) string {
-	return filepath.Join(pdb.baseDir, dbname)
+	return filepath.Join(pdb.baseDir, escapeName(dbname))
 }
 
 func (pdb *perfDB) getFilePath(dbname, metric string) string {
 	dataDir := pdb.getDirPath(dbname)
 
-	return filepath.Join(dataDir, metric+dataFileExt)
+	return filepath.Join(dataDir, escapeName(metric)+dataFileExt)
 }
 
 func (pdb *perfDB) checkDbExists(dbname string) error {
@@ -61,12 +74,19 @@ func (pdb *perfDB) checkDbExists(dbname string) error {
 func (pdb *perfDB) checkMetricExists(dbname string, metric string) error {
 	dataFile := pdb.getFilePath(dbname, metric)
 
+	if err := pdb.flushMetric(dataFile); err != nil {
+		return err
+	}
+
 	_, err := os.Stat(dataFile)
 	return err
 }
 
 func parseRecord(record string) (Sample, error) {
 	fields := strings.Fields(record)
+	if len(fields) != 2 {
+		return Sample{}, fmt.Errorf("malformed record: %q", record)
+	}
 
 	ts, err := strconv.ParseInt(fields[0], 10, 64)
 	if err != nil {
@@ -90,56 +110,50 @@ func readTimestamp(dataFile string) (int64, error) {
 		return 0, err
 	}
 
-	return strconv.ParseInt(string(record), 10, 64)
+	// The .n file also holds the size of the data, see storeLastTimestamp
+	fields := strings.Fields(string(record))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("malformed timestamp file: %q", record)
+	}
+	return strconv.ParseInt(fields[0], 10, 64)
 }
 
 func storeTimestamp(dataFile string, timestamp int64) error {
-	file, err := os.OpenFile(dataFile, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	if _, err = fmt.Fprint(file, timestamp); err != nil {
+	if err := writeFileAtomic(dataFile, []byte(strconv.FormatInt(timestamp, 10))); err != nil {
 		return err
 	}
 	timestampCache.Set(dataFile, timestamp, cache.DefaultExpiration)
 	return nil
 }
 
-func storeSample(dataFile string, sample Sample) error {
-	file, err := os.OpenFile(dataFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+// storeRecord appends the record to the data file, the sample is committed
+// once the whole line is written.
+func storeRecord(dataFile string, record string) error {
+	file, err := os.OpenFile(dataFile, os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	_, err = fmt.Fprintf(file, "%d %v\n", sample.ts, sample.v)
-	return err
-}
-
-func initStore(dataFile string, sample Sample) error {
-	if err := storeTimestamp(dataFile+".1", sample.ts); err != nil {
+	if err := failpoint("write"); err != nil {
 		return err
 	}
-	if err := storeTimestamp(dataFile+".n", sample.ts); err != nil {
+	if err := failpoint("torn write"); err != nil {
+		file.WriteString(record[:len(record)/2])
 		return err
 	}
-
-	sample.ts = 0
-	return storeSample(dataFile, sample)
-}
-
-func appendSample(dataFile string, sample Sample) error {
-	ts, err := readTimestamp(dataFile + ".n")
-	if err != nil {
+	if _, err := file.WriteString(record); err != nil {
 		return err
 	}
-	if err := storeTimestamp(dataFile+".n", sample.ts); err != nil {
+
+	if err := failpoint("sync"); err != nil {
 		return err
 	}
-	sample.ts -= ts
-	return storeSample(dataFile, sample)
+	if fsyncPolicy == fsyncAlways {
+		return syncToDisk(file)
+	}
+	markDirty(dataFile)
+	return nil
 }
 
 func (pdb *perfDB) addSample(dbname, metric string, sample Sample) error {
@@ -149,14 +163,43 @@ func (pdb *perfDB) addSample(dbname, metric string, sample Sample) error {
 	}
 	dataFile := pdb.getFilePath(dbname, metric)
 
+	settings, err := pdb.getSettings(dbname)
+	if err != nil {
+		return err
+	}
+
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+
+	if err := pdb.recoverMetric(dataFile); err != nil {
+		return err
+	}
+
+	if settings.ReorderWindow > 0 {
+		err = pdb.bufferSample(dbname, dataFile, sample, settings)
+	} else {
+		err = writeSample(dataFile, sample, settings)
+	}
+	if err != nil {
+		pdb.uncommitted(dataFile, err)
+	}
+	return err
+}
+
+// checkOrder returns errOutOfOrder if the sample would be rejected because
+// of its timestamp.
+func (pdb *perfDB) checkOrder(dbname, metric string, ts int64) error {
+	settings, err := pdb.getSettings(dbname)
+	if err != nil || settings.OutOfOrder != rejectOutOfOrder {
+		return err
+	}
+
 	pdb.mu.Lock()
 	defer pdb.mu.Unlock()
 
-	_, err := os.Stat(dataFile + ".n")
-	if err == nil {
-		return appendSample(dataFile, sample)
-	} else if os.IsNotExist(err) {
-		return initStore(dataFile, sample)
+	last, exists, err := latestTimestamp(pdb.getFilePath(dbname, metric))
+	if err == nil && exists && ts < last {
+		return errOutOfOrder
 	}
 	return err
 }
@@ -169,23 +212,225 @@ func (pdb *perfDB) listDatabases() ([]string, error) {
 
 	databases := []string{}
 	for _, f := range files {
-		databases = append(databases, f.Name())
+		if !f.IsDir() {
+			continue
+		}
+		// Skip directories that were not created by perfdb
+		dbname, err := unescapeName(f.Name())
+		if err != nil || validateDbName(dbname) != nil {
+			continue
+		}
+		databases = append(databases, dbname)
 	}
 	return databases, nil
 }
 
-func (pdb *perfDB) listMetrics(dbname string) []string {
+type DatabaseInfo struct {
+	Name     string                 `json:"name"`
+	Metrics  int                    `json:"metrics"`
+	Size     int64                  `json:"size"`
+	FirstTS  int64                  `json:"firstTimestamp"`
+	LastTS   int64                  `json:"lastTimestamp"`
+	Created  int64                  `json:"created"`
+	Metadata map[string]interface{} `json:"meta"`
+}
+
+func (pdb *perfDB) getDatabaseInfo(dbname string) (*DatabaseInfo, error) {
 	dataDir := pdb.getDirPath(dbname)
 
-	matches, _ := filepath.Glob(dataDir + "/*.data") // Glob ignores file system errors
+	dir, err := os.Stat(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	pdb.mu.Lock()
+	err = pdb.flushDatabase(dbname)
+	pdb.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	info := DatabaseInfo{Name: dbname, Created: dir.ModTime().UnixNano() / 1e6}
+	for _, f := range files {
+		info.Size += f.Size()
+		if filepath.Ext(f.Name()) != dataFileExt {
+			continue
+		}
+
+		info.Metrics++
+		data, err := readDataInfo(filepath.Join(dataDir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if data.created < info.Created {
+			info.Created = data.created
+		}
+		if info.FirstTS == 0 || data.first < info.FirstTS {
+			info.FirstTS = data.first
+		}
+		if data.last.ts > info.LastTS {
+			info.LastTS = data.last.ts
+		}
+	}
+
+	// Listings mix databases of different precision, so they use milliseconds
+	settings, err := pdb.getSettings(dbname)
+	if err != nil {
+		return nil, err
+	}
+	info.FirstTS = convertPrecision(info.FirstTS, settings.unit(), time.Millisecond)
+	info.LastTS = convertPrecision(info.LastTS, settings.unit(), time.Millisecond)
+
+	if info.Metadata, err = pdb.getMeta(dbname); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (pdb *perfDB) listMetrics(dbname string) ([]string, error) {
+	pdb.mu.Lock()
+	err := pdb.flushDatabase(dbname)
+	pdb.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(pdb.getDirPath(dbname))
+	if err != nil {
+		return nil, err
+	}
 
 	metrics := []string{}
-	for _, match := range matches {
-		name := strings.TrimPrefix(match, dataDir+"/")
-		name = strings.TrimSuffix(name, dataFileExt)
-		metrics = append(metrics, name)
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != dataFileExt {
+			continue
+		}
+		metric, err := unescapeName(strings.TrimSuffix(f.Name(), dataFileExt))
+		if err != nil || validateName(metric) != nil {
+			continue
+		}
+		metrics = append(metrics, metric)
 	}
-	return metrics
+	// Escaped names sort differently, e.g. "cpu-idle.data" < "cpu.data"
+	sort.Strings(metrics)
+	return metrics, nil
+}
+
+type MetricStats struct {
+	Name string `json:"name"`
+	MetricMeta
+	Count     int     `json:"count"`
+	FirstTS   int64   `json:"firstTimestamp"`
+	LastTS    int64   `json:"lastTimestamp"`
+	LastValue float64 `json:"lastValue"`
+	Size      int64   `json:"size"`
+}
+
+// readLastRecord returns the last line of the file without scanning all of it.
+func readLastRecord(fileName string, size int64) (string, error) {
+	const tailSize = 4096
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	offset := size - tailSize
+	if offset < 0 {
+		offset = 0
+	}
+	tail := make([]byte, size-offset)
+	if _, err := file.ReadAt(tail, offset); err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(strings.TrimRight(string(tail), "\n"), "\n")
+	return lines[len(lines)-1], nil
+}
+
+func countRecords(fileName string) (int, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := 0
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buf)
+		count += bytes.Count(buf[:n], []byte{'\n'})
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (pdb *perfDB) getMetricStats(dbname, metric string) (*MetricStats, error) {
+	dataFile := pdb.getFilePath(dbname, metric)
+	stats := MetricStats{Name: metric}
+
+	if err := pdb.flushMetric(dataFile); err != nil {
+		return nil, err
+	}
+
+	for _, fileName := range []string{dataFile, dataFile + ".1", dataFile + ".n"} {
+		f, err := os.Stat(fileName)
+		if os.IsNotExist(err) && fileName != dataFile {
+			continue // Only legacy metrics have .1 and .n files
+		} else if err != nil {
+			return nil, err
+		}
+		stats.Size += f.Size()
+	}
+
+	data, err := readDataInfo(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	stats.FirstTS = data.first
+	stats.LastTS = data.last.ts
+	stats.LastValue = data.last.v
+
+	if data.compressed {
+		stats.Count = data.records
+	} else if stats.Count, err = countRecords(dataFile); err != nil {
+		return nil, err
+	} else if !data.legacy {
+		stats.Count-- // The header
+	}
+
+	return &stats, nil
+}
+
+func (pdb *perfDB) listMetricStats(dbname string) ([]*MetricStats, error) {
+	metrics, err := pdb.listMetrics(dbname)
+	if err != nil {
+		return nil, err
+	}
+	metricsMeta, err := pdb.readMetricsMeta(dbname)
+	if err != nil {
+		return nil, err
+	}
+
+	allStats := []*MetricStats{}
+	for _, metric := range metrics {
+		stats, err := pdb.getMetricStats(dbname, metric)
+		if err != nil {
+			return nil, err
+		}
+		stats.MetricMeta = metricsMeta[metric]
+		allStats = append(allStats, stats)
+	}
+	return allStats, nil
 }
 
 const bufferSize = 1000
@@ -198,13 +443,12 @@ func readDeltas(fileName string, done <-chan struct{}) (<-chan string, <-chan er
 		defer close(samples)
 		defer close(errc)
 
-		file, err := os.Open(fileName)
+		file, err := openData(fileName)
 		if err != nil {
 			errc <- err
 			return
 		}
 		defer file.Close()
-		defer file.Sync()
 
 		scanner := bufio.NewScanner(file)
 		for scanner.Scan() {
@@ -230,15 +474,20 @@ func parseSamples(records <-chan string, ts int64) (<-chan Sample, <-chan error)
 		defer close(samples)
 		defer close(errc)
 
+		lineNumber := 0
 		for record := range records {
-			sample, err := parseRecord(record)
+			lineNumber++
+			if isHeader(record, lineNumber) {
+				continue
+			}
+			sample, err := parseLine(record, ts)
 			if err != nil {
+				// Later timestamps are unknown after a bad delta
 				errc <- err
-			} else {
-				sample.ts += ts
-				ts = sample.ts
-				samples <- sample
+				return
 			}
+			ts = sample.ts
+			samples <- sample
 		}
 	}()
 	return samples, errc
@@ -253,39 +502,59 @@ func mergeErrors(errcs ...<-chan error) error {
 	return nil
 }
 
-func (pdb *perfDB) getRawValues(dbname, metric string) ([][]interface{}, error) {
+// streamRawValues calls fn for every sample of the metric, with timestamps in
+// the given unit. Samples are never held in memory all at once. Iteration
+// stops at the first error returned by fn.
+func (pdb *perfDB) streamRawValues(dbname, metric string, unit time.Duration, fn func(Sample) error) error {
 	dataFile := pdb.getFilePath(dbname, metric)
 
-	first, err := readTimestamp(dataFile + ".1")
+	if err := pdb.flushMetric(dataFile); err != nil {
+		return err
+	}
+
+	settings, err := pdb.getSettings(dbname)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	first, err := baseTimestamp(dataFile)
+	if err != nil {
+		return err
 	}
 
 	done := make(chan struct{}, 1)
 	rawSamples, rawErrors := readDeltas(dataFile, done)
 	parsedSamples, parsedErrors := parseSamples(rawSamples, first)
 
-	values := [][]interface{}{}
+	var fnErr error
 	for sample := range parsedSamples {
-		values = append(values, []interface{}{sample.ts, sample.v})
+		if fnErr != nil {
+			continue // Drain the pipeline
+		}
+		sample.ts = convertPrecision(sample.ts, settings.unit(), unit)
+		if fnErr = fn(sample); fnErr != nil {
+			done <- struct{}{}
+		}
 	}
 
-	done <- struct{}{}
-	if err := mergeErrors(rawErrors, parsedErrors); err != nil {
-		return nil, err
+	if fnErr != nil {
+		return fnErr
 	}
-	return values, nil
+	done <- struct{}{}
+	return mergeErrors(rawErrors, parsedErrors)
 }
 
 func (pdb *perfDB) getSummary(dbname, metric string) (map[string]interface{}, error) {
-	var summary map[string]interface{}
-
 	dataFile := pdb.getFilePath(dbname, metric)
 
+	if err := pdb.flushMetric(dataFile); err != nil {
+		return nil, err
+	}
+
 	done := make(chan struct{}, 1)
 	defer close(done)
 
-	first, err := readTimestamp(dataFile + ".1")
+	first, err := baseTimestamp(dataFile)
 	if err != nil {
 		return nil, err
 	}
@@ -294,9 +563,7 @@ func (pdb *perfDB) getSummary(dbname, metric string) (map[string]interface{}, er
 	parsedSamples, parsedErrors := parseSamples(rawSamples, first)
 
 	values := []float64{}
-	sum := 0.0
 	for sample := range parsedSamples {
-		sum += sample.v
 		values = append(values, sample.v)
 	}
 
@@ -304,39 +571,62 @@ func (pdb *perfDB) getSummary(dbname, metric string) (map[string]interface{}, er
 	if err := mergeErrors(rawErrors, parsedErrors); err != nil {
 		return nil, err
 	}
+	// fsck -repair may leave a header without records
+	if len(values) == 0 {
+		return nil, errNoSamples
+	}
+	return summarize(values), nil
+}
+
+// summarize returns aggregates and percentiles of the values, which are
+// sorted in place.
+func summarize(values []float64) map[string]interface{} {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
 
 	count := len(values)
 	sort.Float64s(values)
 
-	summary = map[string]interface{}{
+	summary := map[string]interface{}{
 		"max":   values[count-1],
 		"min":   values[0],
 		"count": count,
 		"avg":   sum / float64(count),
 	}
 
-	for _, percentile := range []float64{0.5, 0.8, 0.9, 0.95, 0.99, 0.999} {
-		var pIdx int
-		if count > 1 {
-			pIdx = int(float64(count)*percentile) - 1
-		}
-		p := fmt.Sprintf("p%v", percentile*100)
-		summary[p] = values[pIdx]
+	for _, p := range []float64{0.5, 0.8, 0.9, 0.95, 0.99, 0.999} {
+		summary[fmt.Sprintf("p%v", p*100)] = percentile(values, p)
 	}
+	return summary
+}
 
-	return summary, nil
+// percentile returns the p-quantile (0 < p <= 1) of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	i := int(float64(len(sorted))*p) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
 }
 
 func (pdb *perfDB) getHeatMap(dbname, metric string) (*heatMap, error) {
 	dataFile := pdb.getFilePath(dbname, metric)
 
-	hm := newHeatMap()
-	hm.MinTS = int64(^uint64(0) >> 1)
+	if err := pdb.flushMetric(dataFile); err != nil {
+		return nil, err
+	}
+
+	settings, err := pdb.getSettings(dbname)
+	if err != nil {
+		return nil, err
+	}
 
 	done := make(chan struct{}, 1)
 	defer close(done)
 
-	first, err := readTimestamp(dataFile + ".1")
+	first, err := baseTimestamp(dataFile)
 	if err != nil {
 		return nil, err
 	}
@@ -346,12 +636,6 @@ func (pdb *perfDB) getHeatMap(dbname, metric string) (*heatMap, error) {
 
 	samples := []Sample{}
 	for sample := range parsedSamples {
-		hm.MaxValue = math.Max(hm.MaxValue, sample.v)
-		if sample.ts < hm.MinTS {
-			hm.MinTS = sample.ts
-		} else if sample.ts > hm.MaxTS {
-			hm.MaxTS = sample.ts
-		}
 		samples = append(samples, sample)
 	}
 
@@ -359,20 +643,5 @@ func (pdb *perfDB) getHeatMap(dbname, metric string) (*heatMap, error) {
 	if err := mergeErrors(rawErrors, parsedErrors); err != nil {
 		return nil, err
 	}
-
-	for _, sample := range samples {
-		x := math.Floor(heatMapWidth * float64(sample.ts-hm.MinTS) / float64(hm.MaxTS-hm.MinTS))
-		y := math.Floor(heatMapHeight * sample.v / hm.MaxValue)
-		if x == heatMapWidth {
-			x--
-		}
-		if y == heatMapHeight {
-			y--
-		}
-		hm.Map[int(y)][int(x)]++
-		if hm.Map[int(y)][int(x)] > hm.maxDensity {
-			hm.maxDensity = hm.Map[int(y)][int(x)]
-		}
-	}
-	return hm, nil
+	return buildHeatMap(samples, settings.unit()), nil
 }
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pmylund/go-cache"
+)
+
+// A sample is committed once its record is completely appended to the data
+// file. A torn record left by a crash is discarded before the metric is used
+// again. Other files are replaced with a temporary file and a rename.
+//
+// Legacy metrics (see datafile.go) are committed in two steps: the record is
+// appended to the .data file, then the .n file is atomically replaced.
+// Besides the last timestamp, the .n file holds the size of the .data file at
+// the time of the commit, so that interrupted commits are detected.
+//
+// Whether writes reach the disk before they are acknowledged depends on the
+// fsync policy.
+
+const (
+	fsyncAlways   = "always"   // Every commit is synced
+	fsyncInterval = "interval" // Modified files are synced every syncInterval
+	fsyncNever    = "never"    // The OS decides when to write data
+)
+
+const syncInterval = time.Second
+
+var fsyncPolicy = fsyncInterval
+
+func validateFsyncPolicy(policy string) error {
+	switch policy {
+	case fsyncAlways, fsyncInterval, fsyncNever:
+		return nil
+	default:
+		return fmt.Errorf("fsync must be %q, %q or %q, got %q", fsyncAlways, fsyncInterval, fsyncNever, policy)
+	}
+}
+
+// failpoint is called at every step of a commit and before every fsync. Tests
+// replace it with setFailpoint to simulate crashes. It's guarded because the
+// background flusher calls it too.
+var failpoints = struct {
+	sync.RWMutex
+	fn func(name string) error
+}{fn: func(string) error { return nil }}
+
+func failpoint(name string) error {
+	failpoints.RLock()
+	fn := failpoints.fn
+	failpoints.RUnlock()
+	return fn(name)
+}
+
+func setFailpoint(fn func(name string) error) {
+	failpoints.Lock()
+	failpoints.fn = fn
+	failpoints.Unlock()
+}
+
+var dirtyFiles = struct {
+	sync.Mutex
+	files map[string]bool
+	once  sync.Once
+}{files: map[string]bool{}}
+
+// markDirty schedules the file (or directory) to be synced according to the
+// fsync policy.
+func markDirty(fileName string) {
+	if fsyncPolicy != fsyncInterval {
+		return
+	}
+	dirtyFiles.Lock()
+	dirtyFiles.files[fileName] = true
+	dirtyFiles.Unlock()
+
+	dirtyFiles.once.Do(func() { go syncDirtyFiles() })
+}
+
+func syncFile(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return syncToDisk(file)
+}
+
+// syncToDisk flushes the file (or directory) to disk.
+func syncToDisk(file *os.File) error {
+	if err := failpoint("fsync"); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func syncDirtyFiles() {
+	for range time.Tick(syncInterval) {
+		flushDirtyFiles()
+	}
+}
+
+// flushDirtyFiles syncs scheduled files right away. Failures are logged, the
+// last one is returned.
+func flushDirtyFiles() error {
+	dirtyFiles.Lock()
+	files := dirtyFiles.files
+	dirtyFiles.files = map[string]bool{}
+	dirtyFiles.Unlock()
+
+	var lastErr error
+	for fileName := range files {
+		if err := syncFile(fileName); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("Failed to sync %s: %s", fileName, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// replaceFile writes a temporary file and renames it, so that readers never
+// see a partial document.
+func replaceFile(fileName string, write func(w io.Writer) error) error {
+	tmpFile := fileName + ".tmp"
+	file, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	if fsyncPolicy == fsyncAlways {
+		if err := syncToDisk(file); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return renameFile(tmpFile, fileName)
+}
+
+// renameFile moves the written temporary file over the file and syncs the
+// directory according to the fsync policy.
+func renameFile(tmpFile, fileName string) error {
+	if err := failpoint("rename"); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, fileName); err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(fileName)
+	if fsyncPolicy == fsyncAlways {
+		return syncFile(dir)
+	}
+	markDirty(fileName)
+	markDirty(dir)
+	return nil
+}
+
+func writeFileAtomic(fileName string, data []byte) error {
+	return replaceFile(fileName, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// truncateTorn removes an incomplete last line left by an interrupted append.
+func truncateTorn(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	buf := make([]byte, 4096)
+	for end := size; end > 0; {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := file.ReadAt(chunk, start); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			if complete := start + int64(i) + 1; complete < size {
+				return file.Truncate(complete)
+			}
+			return nil
+		}
+		end = start
+	}
+	if size > 0 {
+		return file.Truncate(0)
+	}
+	return nil
+}
+
+// storeLastTimestamp commits the last timestamp of the metric.
+func storeLastTimestamp(dataFile string, timestamp int64) error {
+	info, err := os.Stat(dataFile)
+	if err != nil {
+		return err
+	}
+	record := fmt.Sprintf("%d %d", timestamp, info.Size())
+	if err := writeFileAtomic(dataFile+".n", []byte(record)); err != nil {
+		return err
+	}
+	timestampCache.Set(dataFile+".n", timestamp, cache.DefaultExpiration)
+	return nil
+}
+
+// readCommit returns the last timestamp and the size of the data file. The
+// size is -1 for files written by older versions.
+func readCommit(dataFile string) (int64, int64, error) {
+	record, err := ioutil.ReadFile(dataFile + ".n")
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(string(record))
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, 0, fmt.Errorf("malformed timestamp file: %q", record)
+	}
+
+	ts, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(fields) == 1 {
+		return ts, -1, nil
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	return ts, size, err
+}
+
+// recoverCommit discards a torn record and temporary files left by an
+// interrupted commit. The compressed file is kept while it's being written.
+func recoverCommit(dataFile string, compressing bool) error {
+	for _, ext := range []string{".tmp", ".1.tmp", ".n.tmp", compressedTmpExt} {
+		if ext == compressedTmpExt && compressing {
+			continue
+		}
+		if err := os.Remove(dataFile + ext); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	header, err := readHeader(dataFile)
+	if os.IsNotExist(err) {
+		return removeLegacyFiles(dataFile)
+	} else if err != nil {
+		return err
+	}
+	if header == nil {
+		return recoverLegacyCommit(dataFile)
+	}
+	if header.compressedHeader != nil {
+		return removeLegacyFiles(dataFile) // Compressed files are immutable
+	}
+
+	file, err := os.OpenFile(dataFile, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := truncateTorn(file); err != nil {
+		return err
+	}
+	// Leftovers of an interrupted conversion
+	return removeLegacyFiles(dataFile)
+}
+
+// recoverLegacyCommit makes the .n file consistent with the data. Complete
+// records beyond the committed size are kept, a torn record is discarded.
+func recoverLegacyCommit(dataFile string) error {
+	last, size, err := readCommit(dataFile)
+	if os.IsNotExist(err) {
+		// The first sample was never committed
+		for _, fileName := range []string{dataFile, dataFile + ".1"} {
+			if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(dataFile)
+	if err != nil {
+		return err
+	}
+	if size < 0 || info.Size() == size {
+		return nil
+	}
+
+	// The data was modified by an interrupted commit or, with "never" fsync
+	// policy, committed data was lost. Either way, the last timestamp is
+	// rebuilt from the complete records.
+	if err := rewriteData(dataFile); err != nil {
+		return err
+	}
+	first, err := readStoredTimestamp(dataFile + ".1")
+	if err != nil {
+		return err
+	}
+	scan, err := scanData(dataFile)
+	if err != nil {
+		return err
+	}
+	if last != first+scan.sum {
+		logger.Warningf("Recovered %s: last timestamp %d instead of %d", dataFile, first+scan.sum, last)
+	}
+	return storeLastTimestamp(dataFile, first+scan.sum)
+}
+
+// checkCommit returns an error if the metric needs recovery. Unlike
+// recoverCommit, it never modifies files.
+func checkCommit(dataFile string) error {
+	header, err := readHeader(dataFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if header != nil && header.compressedHeader != nil {
+		return nil
+	}
+
+	info, err := os.Stat(dataFile)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		_, size, err := readCommit(dataFile)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s needs recovery: the first sample was never committed", dataFile)
+		} else if err != nil {
+			return err
+		}
+		if size >= 0 && info.Size() != size {
+			return fmt.Errorf("%s needs recovery: committed size is %d, data has %d bytes", dataFile, size, info.Size())
+		}
+		return nil
+	}
+
+	file, err := os.Open(dataFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] != '\n' {
+		return fmt.Errorf("%s needs recovery: torn last record", dataFile)
+	}
+	return nil
+}
+
+// recoverMetric runs recoverCommit once per metric, or only checkCommit if the
+// storage is read-only. The caller must hold pdb.mu.
+func (pdb *perfDB) recoverMetric(dataFile string) error {
+	if pdb.recovered[dataFile] {
+		return nil
+	}
+	check := func(dataFile string) error {
+		return recoverCommit(dataFile, pdb.compressing[dataFile])
+	}
+	if pdb.readOnly {
+		check = checkCommit
+	}
+	if err := check(dataFile); err != nil {
+		return err
+	}
+	pdb.recovered[dataFile] = true
+	return nil
+}
+
+// uncommitted makes sure that the metric is recovered before it's used again
+// if writing failed in the middle of a commit.
+func (pdb *perfDB) uncommitted(dataFile string, err error) {
+	if err != errOutOfOrder {
+		delete(pdb.recovered, dataFile)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errCrash = errors.New("simulated crash")
+
+// crashAt makes the n-th call of the named failpoint fail.
+func crashAt(name string, n int) {
+	calls := 0
+	setFailpoint(func(point string) error {
+		if point != name {
+			return nil
+		}
+		calls++
+		if calls == n {
+			return errCrash
+		}
+		return nil
+	})
+}
+
+// applySamples returns the expected content of a metric with "last"
+// duplicate policy.
+func applySamples(samples []Sample) []Sample {
+	stored := []Sample{}
+	for _, sample := range samples {
+		if n := len(stored); n > 0 && stored[n-1].ts == sample.ts {
+			stored[n-1] = sample
+			continue
+		}
+		stored = append(stored, sample)
+	}
+	return stored
+}
+
+func readTestSamples(storage *perfDB) ([]Sample, error) {
+	samples := []Sample{}
+	err := storage.streamRawValues("database", "cpu", time.Millisecond, func(sample Sample) error {
+		samples = append(samples, sample)
+		return nil
+	})
+	return samples, err
+}
+
+func TestCrashRecovery(t *testing.T) {
+	defer func() {
+		setFailpoint(func(string) error { return nil })
+	}()
+
+	samples := []Sample{
+		{1411940889515, 80},
+		{1411940890515, 75},
+		{1411940891515, 70},
+		{1411940891515, 71}, // Replaces the previous value
+		{1411940893015, 65},
+	}
+
+	for _, point := range []string{"write", "torn write", "sync", "rename"} {
+		for crash := range samples {
+			// Commits include up to 3 renames
+			for n := 1; n <= 3; n++ {
+				name := fmt.Sprintf("%s %d at sample %d", point, n, crash)
+
+				tmpDir, err := ioutil.TempDir("", "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(tmpDir)
+
+				storage, _ := newPerfDB(tmpDir)
+				storage.setSettings("database", DatabaseSettings{OutOfOrder: acceptOutOfOrder, Duplicates: lastDuplicate, Precision: "ms"})
+
+				acknowledged := []Sample{}
+				for i, sample := range samples {
+					if i == crash {
+						crashAt(point, n)
+						if err := storage.addSample("database", "cpu", sample); err == nil {
+							acknowledged = append(acknowledged, sample)
+						}
+
+						// Restart
+						setFailpoint(func(string) error { return nil })
+						storage, _ = newPerfDB(tmpDir)
+						continue
+					}
+					if err := storage.addSample("database", "cpu", sample); err != nil {
+						t.Fatalf("%s: %s", name, err)
+					}
+					acknowledged = append(acknowledged, sample)
+				}
+
+				stored, err := readTestSamples(storage)
+				if err != nil {
+					t.Fatalf("%s: %s", name, err)
+				}
+				// The crashed sample may or may not be stored
+				expected := applySamples(acknowledged)
+				if !reflect.DeepEqual(expected, stored) {
+					expected = applySamples(samples)
+				}
+				// A crash while replacing a value loses the previous one too
+				if !reflect.DeepEqual(expected, stored) && crash > 0 && samples[crash].ts == samples[crash-1].ts {
+					lost := append(append([]Sample{}, samples[:crash-1]...), samples[crash+1:]...)
+					expected = applySamples(lost)
+				}
+				assert.Equal(t, expected, stored, name)
+
+				report, err := storage.fsck(false)
+				if err != nil {
+					t.Fatalf("%s: %s", name, err)
+				}
+				assert.Equal(t, []FsckProblem{}, report.Problems, name)
+			}
+		}
+	}
+}
+
+func TestTornAnnotation(t *testing.T) {
+	storage, err := newTmpStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage.addAnnotation("database", Annotation{Timestamp: 1411940889515, Text: "start"})
+	file, _ := os.OpenFile(filepath.Join(storage.getDirPath("database"), annotationsFile), os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString("{\"ts\":14119408")
+	file.Close()
+
+	annotations, err := storage.getAnnotations("database", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(annotations))
+
+	storage.addAnnotation("database", Annotation{Timestamp: 1411940890515, Text: "stop"})
+	annotations, err = storage.getAnnotations("database", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Annotation{{Timestamp: 1411940889515, Text: "start"}, {Timestamp: 1411940890515, Text: "stop"}}, annotations)
+}
+
+func TestFsyncPolicy(t *testing.T) {
+	for _, policy := range []string{fsyncAlways, fsyncInterval, fsyncNever} {
+		assert.Nil(t, validateFsyncPolicy(policy))
+	}
+	assert.NotNil(t, validateFsyncPolicy("sometimes"))
+
+	defer func() {
+		fsyncPolicy = fsyncInterval
+		setFailpoint(func(string) error { return nil })
+	}()
+
+	storage := newTestStorage(t)
+	dataFile := storage.getFilePath("database", "cpu")
+	assert.Nil(t, storage.addSample("database", "cpu", Sample{1411940888515, 0}))
+	flushDirtyFiles()
+
+	var fsyncs int64
+	setFailpoint(func(name string) error {
+		if name != "fsync" {
+			return nil
+		}
+		atomic.AddInt64(&fsyncs, 1)
+		return errCrash
+	})
+
+	// The commit doesn't wait for the disk
+	fsyncPolicy = fsyncNever
+	assert.Nil(t, storage.addSample("database", "cpu", Sample{1411940889515, 1}))
+	dirtyFiles.Lock()
+	assert.False(t, dirtyFiles.files[dataFile])
+	dirtyFiles.Unlock()
+
+	// Every commit is synced
+	fsyncPolicy = fsyncAlways
+	assert.Equal(t, errCrash, storage.addSample("database", "cpu", Sample{1411940890515, 2}))
+
+	// The commit is synced later by the flusher
+	fsyncPolicy = fsyncInterval
+	before := atomic.LoadInt64(&fsyncs)
+	assert.Nil(t, storage.addSample("database", "cpu", Sample{1411940891515, 3}))
+	flushDirtyFiles()
+	assert.True(t, atomic.LoadInt64(&fsyncs) > before)
+	dirtyFiles.Lock()
+	assert.False(t, dirtyFiles.files[dataFile])
+	dirtyFiles.Unlock()
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Queries are a small subset of SQL:
+//
+//	SELECT avg(value), p99(value) FROM read_latency
+//	WHERE db = 'run-*' AND build = '1.0' AND time >= now() - 1h
+//	GROUP BY time(1m)
+//
+// Every database that matches the conditions is a separate series for every
+// aggregation. Conditions on "db" and on metadata keys (tags) are glob
+// patterns, several patterns can be listed with IN ('a', 'b'). Conditions on
+// "time" compare with RFC 3339 strings, timestamps in milliseconds or now()
+// plus or minus a duration. Without GROUP BY, the whole range is a single
+// bucket.
+
+type queryError string
+
+func (e queryError) Error() string {
+	return "invalid query: " + string(e)
+}
+
+type queryToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+const (
+	queryEnd = iota
+	queryWord
+	queryName   // Double-quoted
+	queryString // Single-quoted
+	queryPunct
+)
+
+// queryFilter matches a database name or a metadata value.
+type queryFilter struct {
+	key      string
+	patterns []string
+	negate   bool
+}
+
+type queryPlan struct {
+	aggregations []string
+	metric       string
+	filters      []queryFilter
+	from, to     int64 // Nanoseconds, to is exclusive
+	interval     time.Duration
+}
+
+// QuerySeries is a series in the format of Grafana JSON datasources:
+// datapoints are [value, timestamp in milliseconds].
+type QuerySeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+var queryPuncts = map[string]bool{
+	"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"(": true, ")": true, ",": true, "*": true, "+": true, "-": true,
+}
+
+func tokenizeQuery(input string) ([]queryToken, error) {
+	tokens := []queryToken{}
+	for pos := 0; pos < len(input); {
+		r, size := utf8.DecodeRuneInString(input[pos:])
+		switch {
+		case unicode.IsSpace(r):
+			pos += size
+		case r == '\'' || r == '"':
+			// Backslash escapes the next character
+			var text []byte
+			end := pos + 1
+			for ; end < len(input) && input[end] != byte(r); end++ {
+				if input[end] == '\\' && end+1 < len(input) {
+					end++
+				}
+				text = append(text, input[end])
+			}
+			if end == len(input) {
+				return nil, queryError(fmt.Sprintf("unterminated string at position %d", pos+1))
+			}
+			kind := queryString
+			if r == '"' {
+				kind = queryName
+			}
+			tokens = append(tokens, queryToken{kind, string(text), pos})
+			pos = end + 1
+		case isNameRune(r):
+			end := strings.IndexFunc(input[pos:], func(r rune) bool { return !isNameRune(r) })
+			if end < 0 {
+				end = len(input) - pos
+			}
+			tokens = append(tokens, queryToken{queryWord, input[pos : pos+end], pos})
+			pos += end
+		default:
+			text := input[pos : pos+size]
+			if pos+1 < len(input) && queryPuncts[input[pos:pos+2]] {
+				text = input[pos : pos+2]
+			} else if !queryPuncts[text] {
+				return nil, queryError(fmt.Sprintf("unexpected %q at position %d", text, pos+1))
+			}
+			tokens = append(tokens, queryToken{queryPunct, text, pos})
+			pos += len(text)
+		}
+	}
+	return append(tokens, queryToken{queryEnd, "", len(input)}), nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	now    time.Time
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[0]
+}
+
+func (p *queryParser) next() queryToken {
+	token := p.tokens[0]
+	if token.kind != queryEnd {
+		p.tokens = p.tokens[1:]
+	}
+	return token
+}
+
+func (p *queryParser) errorf(token queryToken, format string, args ...interface{}) error {
+	if token.kind == queryEnd {
+		return queryError(fmt.Sprintf("%s at the end", fmt.Sprintf(format, args...)))
+	}
+	return queryError(fmt.Sprintf("%s at position %d", fmt.Sprintf(format, args...), token.pos+1))
+}
+
+// isKeyword reports whether the token is the keyword, keywords are case
+// insensitive.
+func (t queryToken) isKeyword(keyword string) bool {
+	return t.kind == queryWord && strings.EqualFold(t.text, keyword)
+}
+
+func (t queryToken) isPunct(punct string) bool {
+	return t.kind == queryPunct && t.text == punct
+}
+
+func (p *queryParser) expectKeyword(keyword string) error {
+	if token := p.next(); !token.isKeyword(keyword) {
+		return p.errorf(token, "expected %s", keyword)
+	}
+	return nil
+}
+
+func (p *queryParser) expectPunct(punct string) error {
+	if token := p.next(); !token.isPunct(punct) {
+		return p.errorf(token, "expected %q", punct)
+	}
+	return nil
+}
+
+// parseQuery parses the query, see above. Relative times are relative to now.
+func parseQuery(input string, now time.Time) (*queryPlan, error) {
+	tokens, err := tokenizeQuery(input)
+	if err != nil {
+		return nil, err
+	}
+	p := queryParser{tokens: tokens, now: now}
+	plan := queryPlan{from: math.MinInt64, to: math.MaxInt64}
+
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	for {
+		aggregation, err := p.parseAggregation()
+		if err != nil {
+			return nil, err
+		}
+		plan.aggregations = append(plan.aggregations, aggregation)
+		if !p.peek().isPunct(",") {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	token := p.next()
+	if token.kind != queryWord && token.kind != queryName {
+		return nil, p.errorf(token, "expected metric name")
+	}
+	if err := validateName(token.text); err != nil {
+		return nil, p.errorf(token, "invalid metric name %q: %s", token.text, err)
+	}
+	plan.metric = token.text
+
+	if p.peek().isKeyword("WHERE") {
+		p.next()
+		for {
+			if err := p.parseCondition(&plan); err != nil {
+				return nil, err
+			}
+			if !p.peek().isKeyword("AND") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if p.peek().isKeyword("GROUP") {
+		p.next()
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("time"); err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct("("); err != nil {
+			return nil, err
+		}
+		token := p.next()
+		interval, err := time.ParseDuration(token.text)
+		if token.kind != queryWord || err != nil || interval <= 0 {
+			return nil, p.errorf(token, "expected positive duration")
+		}
+		plan.interval = interval
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if token := p.next(); token.kind != queryEnd {
+		return nil, p.errorf(token, "unexpected %q", token.text)
+	}
+	return &plan, nil
+}
+
+// parseAggregation parses count(*), avg(value), p99(value), etc.
+func (p *queryParser) parseAggregation() (string, error) {
+	token := p.next()
+	name := strings.ToLower(token.text)
+	if token.kind != queryWord || !isAggregation(name) {
+		return "", p.errorf(token, "expected aggregation")
+	}
+	if err := p.expectPunct("("); err != nil {
+		return "", err
+	}
+	if arg := p.next(); !arg.isKeyword("value") && !(arg.isPunct("*") && name == "count") {
+		return "", p.errorf(arg, "expected value")
+	}
+	return name, p.expectPunct(")")
+}
+
+func (p *queryParser) parseCondition(plan *queryPlan) error {
+	token := p.next()
+	if token.kind != queryWord && token.kind != queryName {
+		return p.errorf(token, "expected condition")
+	}
+	if token.kind == queryWord && strings.EqualFold(token.text, "time") {
+		return p.parseTimeCondition(plan)
+	}
+
+	filter := queryFilter{key: token.text}
+	if token.kind == queryWord && strings.EqualFold(token.text, "db") {
+		filter.key = ""
+	}
+	switch op := p.next(); {
+	case op.isPunct("="):
+	case op.isPunct("!="):
+		filter.negate = true
+	case op.isKeyword("IN"):
+		if err := p.expectPunct("("); err != nil {
+			return err
+		}
+		for {
+			value := p.next()
+			if value.kind != queryString {
+				return p.errorf(value, "expected string")
+			}
+			if _, err := filepath.Match(value.text, ""); err != nil {
+				return p.errorf(value, "malformed pattern %q", value.text)
+			}
+			filter.patterns = append(filter.patterns, value.text)
+			if !p.peek().isPunct(",") {
+				break
+			}
+			p.next()
+		}
+		plan.filters = append(plan.filters, filter)
+		return p.expectPunct(")")
+	default:
+		return p.errorf(op, "expected =, != or IN")
+	}
+
+	value := p.next()
+	if value.kind != queryString {
+		return p.errorf(value, "expected string")
+	}
+	if _, err := filepath.Match(value.text, ""); err != nil {
+		return p.errorf(value, "malformed pattern %q", value.text)
+	}
+	filter.patterns = []string{value.text}
+	plan.filters = append(plan.filters, filter)
+	return nil
+}
+
+func (p *queryParser) parseTimeCondition(plan *queryPlan) error {
+	op := p.next()
+	if !op.isPunct("<") && !op.isPunct("<=") && !op.isPunct(">") && !op.isPunct(">=") {
+		return p.errorf(op, "expected <, <=, > or >=")
+	}
+	ts, err := p.parseTime()
+	if err != nil {
+		return err
+	}
+
+	switch op.text {
+	case ">":
+		ts++
+		fallthrough
+	case ">=":
+		if ts > plan.from {
+			plan.from = ts
+		}
+	case "<=":
+		ts++
+		fallthrough
+	case "<":
+		if ts < plan.to {
+			plan.to = ts
+		}
+	}
+	return nil
+}
+
+// parseTime returns the time in nanoseconds.
+func (p *queryParser) parseTime() (int64, error) {
+	token := p.next()
+	switch {
+	case token.kind == queryString:
+		t, err := time.Parse(time.RFC3339Nano, token.text)
+		if err != nil {
+			return 0, p.errorf(token, "malformed time %q", token.text)
+		}
+		return t.UnixNano(), nil
+	case token.kind == queryWord && unicode.IsDigit(rune(token.text[0])):
+		ms, err := strconv.ParseInt(token.text, 10, 64)
+		if err != nil {
+			return 0, p.errorf(token, "malformed timestamp %q", token.text)
+		}
+		return convertPrecision(ms, time.Millisecond, time.Nanosecond), nil
+	case token.isKeyword("now"):
+		if err := p.expectPunct("("); err != nil {
+			return 0, err
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return 0, err
+		}
+		ts := p.now.UnixNano()
+		if op := p.peek(); op.isPunct("+") || op.isPunct("-") {
+			p.next()
+			token := p.next()
+			d, err := time.ParseDuration(token.text)
+			if token.kind != queryWord || err != nil {
+				return 0, p.errorf(token, "expected duration")
+			}
+			if op.text == "-" {
+				d = -d
+			}
+			ts += int64(d)
+		}
+		return ts, nil
+	default:
+		return 0, p.errorf(token, "expected time")
+	}
+}
+
+func isAggregation(name string) bool {
+	switch name {
+	case "count", "sum", "min", "max", "avg":
+		return true
+	}
+	if strings.HasPrefix(name, "p") {
+		p, err := strconv.ParseFloat(name[1:], 64)
+		return err == nil && p > 0 && p <= 100
+	}
+	return false
+}
+
+// aggregateValues computes the aggregation of the sorted values.
+func aggregateValues(name string, sorted []float64) float64 {
+	switch name {
+	case "count":
+		return float64(len(sorted))
+	case "min":
+		return sorted[0]
+	case "max":
+		return sorted[len(sorted)-1]
+	}
+
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	switch name {
+	case "sum":
+		return sum
+	case "avg":
+		return sum / float64(len(sorted))
+	}
+	p, _ := strconv.ParseFloat(name[1:], 64)
+	return percentile(sorted, p/100)
+}
+
+// match reports whether the database satisfies the filter.
+func (f *queryFilter) match(dbname string, meta map[string]interface{}) bool {
+	value := dbname
+	if f.key != "" {
+		v, ok := meta[f.key]
+		if !ok {
+			return f.negate
+		}
+		value = fmt.Sprint(v)
+	}
+	for _, pattern := range f.patterns {
+		if ok, _ := filepath.Match(pattern, value); ok {
+			return !f.negate
+		}
+	}
+	return f.negate
+}
+
+// selectDatabases returns databases that satisfy all filters.
+func (plan *queryPlan) selectDatabases(storage Storage) ([]string, error) {
+	databases, err := storage.listDatabases()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := []string{}
+	for _, dbname := range databases {
+		var meta map[string]interface{}
+		matched := true
+		for i := range plan.filters {
+			if plan.filters[i].key != "" && meta == nil {
+				if meta, err = storage.getMeta(dbname); err != nil {
+					return nil, err
+				}
+			}
+			if !plan.filters[i].match(dbname, meta) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			selected = append(selected, dbname)
+		}
+	}
+	sort.Strings(selected)
+	return selected, nil
+}
+
+// execute runs the query against every selected database that has the
+// metric. Samples are streamed from the storage, only those in the time range
+// are kept in their buckets.
+func (plan *queryPlan) execute(storage Storage) ([]QuerySeries, error) {
+	databases, err := plan.selectDatabases(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []QuerySeries{}
+	for _, dbname := range databases {
+		if err := storage.checkMetricExists(dbname, plan.metric); err != nil {
+			continue
+		}
+
+		buckets := map[int64][]float64{}
+		var first int64 = math.MaxInt64
+		err := storage.streamRawValues(dbname, plan.metric, time.Nanosecond, func(sample Sample) error {
+			if sample.ts < plan.from || sample.ts >= plan.to {
+				return nil
+			}
+			var bucket int64
+			if plan.interval > 0 {
+				bucket = sample.ts - sample.ts%int64(plan.interval)
+				if sample.ts < 0 && sample.ts%int64(plan.interval) != 0 {
+					bucket -= int64(plan.interval)
+				}
+			}
+			buckets[bucket] = append(buckets[bucket], sample.v)
+			if sample.ts < first {
+				first = sample.ts
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		starts := make([]int64, 0, len(buckets))
+		for start := range buckets {
+			starts = append(starts, start)
+			sort.Float64s(buckets[start])
+		}
+		sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+		for _, aggregation := range plan.aggregations {
+			series := QuerySeries{
+				Target:     fmt.Sprintf("%s %s %s", dbname, plan.metric, aggregation),
+				Datapoints: [][2]float64{},
+			}
+			for _, start := range starts {
+				ts := start
+				if plan.interval == 0 {
+					ts = first
+				}
+				ms := float64(convertPrecision(ts, time.Nanosecond, time.Millisecond))
+				series.Datapoints = append(series.Datapoints, [2]float64{aggregateValues(aggregation, buckets[start]), ms})
+			}
+			result = append(result, series)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newQueryTestStorage returns two runs with a sample every 20 seconds.
+func newQueryTestStorage(t *testing.T) Storage {
+	storage := newMemStorage()
+	for i := 0; i < 6; i++ {
+		ts := int64(1411940880000 + i*20000)
+		storage.addSample("run-1", "latency", Sample{ts, float64(i + 1)})
+		storage.addSample("run-2", "latency", Sample{ts, float64(10 * (i + 1))})
+	}
+	storage.addSample("other", "cpu", Sample{1411940880000, 1})
+
+	storage.setMeta("run-1", map[string]interface{}{"build": "1.0"})
+	storage.setMeta("run-2", map[string]interface{}{"build": "1.1"})
+	return storage
+}
+
+func TestQuery(t *testing.T) {
+	storage := newQueryTestStorage(t)
+	now := time.Unix(1411940980, 0) // The last sample
+
+	for query, expected := range map[string][]QuerySeries{
+		"SELECT count(*), avg(value), p50(value) FROM latency WHERE db = 'run-1'": {
+			{"run-1 latency count", [][2]float64{{6, 1411940880000}}},
+			{"run-1 latency avg", [][2]float64{{3.5, 1411940880000}}},
+			{"run-1 latency p50", [][2]float64{{3, 1411940880000}}},
+		},
+		"select max(value) from latency group by time(1m)": {
+			{"run-1 latency max", [][2]float64{{3, 1411940880000}, {6, 1411940940000}}},
+			{"run-2 latency max", [][2]float64{{30, 1411940880000}, {60, 1411940940000}}},
+		},
+		"SELECT sum(value) FROM latency WHERE build = '1.1' AND time >= 1411940900000 AND time < '2014-09-28T21:49:20Z'": {
+			{"run-2 latency sum", [][2]float64{{20 + 30 + 40, 1411940900000}}},
+		},
+		"SELECT min(value) FROM \"latency\" WHERE db IN ('run-2', 'other') AND time > now() - 40s": {
+			{"run-2 latency min", [][2]float64{{50, 1411940960000}}},
+		},
+		"SELECT min(value) FROM latency WHERE db != 'run-*'": {},
+		"SELECT avg(value) FROM missing":                     {},
+	} {
+		plan, err := parseQuery(query, now)
+		if !assert.Nil(t, err, query) {
+			continue
+		}
+		result, err := plan.execute(storage)
+		assert.Nil(t, err, query)
+		assert.Equal(t, expected, result, query)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	for query, expected := range map[string]string{
+		"":                                                         "expected SELECT at the end",
+		"SELECT value FROM latency":                                "expected aggregation at position 8",
+		"SELECT p0(value) FROM latency":                            "expected aggregation at position 8",
+		"SELECT avg(*) FROM latency":                               "expected value at position 12",
+		"SELECT avg(value) latency":                                "expected FROM at position 19",
+		"SELECT avg(value) FROM 'latency'":                         "expected metric name at position 24",
+		"SELECT avg(value) FROM latency WHERE db ~ 'a'":            "unexpected \"~\" at position 41",
+		"SELECT avg(value) FROM latency WHERE db = a":              "expected string at position 43",
+		"SELECT avg(value) FROM latency WHERE db = '['":            "malformed pattern \"[\" at position 43",
+		"SELECT avg(value) FROM latency WHERE time = 1":            "expected <, <=, > or >= at position 43",
+		"SELECT avg(value) FROM latency WHERE time < 'yesterday'":  "malformed time \"yesterday\" at position 45",
+		"SELECT avg(value) FROM latency WHERE time < now() - week": "expected duration at position 53",
+		"SELECT avg(value) FROM latency GROUP BY db":               "expected time at position 41",
+		"SELECT avg(value) FROM latency GROUP BY time(0s)":         "expected positive duration at position 46",
+		"SELECT avg(value) FROM latency LIMIT 1":                   "unexpected \"LIMIT\" at position 32",
+		"SELECT avg(value) FROM latency WHERE db = 'run-1":         "unterminated string at position 43",
+	} {
+		_, err := parseQuery(query, time.Now())
+		assert.Equal(t, queryError(expected), err, query)
+	}
+}
+
+func TestQueryEndpoint(t *testing.T) {
+	controller := newController(newQueryTestStorage(t))
+	query := "SELECT avg(value) FROM latency WHERE db = 'run-2'"
+
+	req, _ := http.NewRequest("GET", "/_query?q="+url.QueryEscape(query), nil)
+	rw := httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "[{\"target\":\"run-2 latency avg\",\"datapoints\":[[35,1411940880000]]}]", rw.Body.String())
+
+	req, _ = http.NewRequest("POST", "/_query", bytes.NewBufferString(query))
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	var result []QuerySeries
+	json.Unmarshal(rw.Body.Bytes(), &result)
+	assert.Equal(t, []QuerySeries{{"run-2 latency avg", [][2]float64{{35, 1411940880000}}}}, result)
+
+	req, _ = http.NewRequest("GET", "/_query?q=SELECT", nil)
+	rw = httptest.NewRecorder()
+	newRouter(controller).ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	assert.Equal(t, "{\"error\":\"invalid query: expected aggregation at the end\"}", rw.Body.String())
+}
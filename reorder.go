@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errOutOfOrder = errors.New("sample is older than the latest stored sample")
+
+// reorderBuffer keeps recent samples of a metric in memory, so that they are
+// written in timestamp order. See DatabaseSettings.
+type reorderBuffer struct {
+	dbname   string
+	settings DatabaseSettings
+	samples  []Sample // Sorted by timestamp
+	maxTS    int64
+	updated  time.Time
+}
+
+const flushInterval = time.Second
+
+func latestTimestamp(dataFile string) (int64, bool, error) {
+	info, err := readCachedDataInfo(dataFile)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return info.last.ts, true, nil
+}
+
+// replaceLastSample truncates the data file before the last record and appends
+// it again with the new value, so only the tail of the file is touched. A crash
+// in between loses the previous value too.
+func replaceLastSample(dataFile string, info *dataInfo, sample Sample) error {
+	record, err := readLastRecord(dataFile, info.size)
+	if err != nil {
+		return err
+	}
+	offset := info.size - int64(len(record)) - 1
+	if offset == 0 {
+		// Only the header, e.g. after fsck removed all records
+		return appendSample(dataFile, info, sample)
+	}
+
+	// The delta (or the checkpoint) stays the same, only the value changes
+	delta := strings.Fields(record)[0]
+	replaced := fmt.Sprintf("%s %v\n", delta, sample.v)
+	if err := os.Truncate(dataFile, offset); err != nil {
+		return err
+	}
+	if err := storeRecord(dataFile, replaced); err != nil {
+		return err
+	}
+
+	updated := *info
+	updated.size = offset + int64(len(replaced))
+	updated.rawSize = updated.size
+	updated.last.v = sample.v
+	cacheDataInfo(dataFile, &updated)
+	return nil
+}
+
+// writeSample persists the sample according to the out-of-order and duplicate
+// policies. The caller must hold pdb.mu.
+func writeSample(dataFile string, sample Sample, settings DatabaseSettings) error {
+	info, err := readCachedDataInfo(dataFile)
+	if os.IsNotExist(err) {
+		return initStore(dataFile, sample)
+	} else if err != nil {
+		return err
+	}
+
+	if info.legacy || info.compressed {
+		convert := convertLegacy
+		if info.compressed {
+			convert = decompressData
+		}
+		if err := convert(dataFile); err != nil {
+			return err
+		}
+		if info, err = readDataInfo(dataFile); err != nil {
+			return err
+		}
+	}
+
+	last := info.last.ts
+	switch {
+	case sample.ts < last && settings.OutOfOrder == rejectOutOfOrder:
+		return errOutOfOrder
+	case sample.ts == last && settings.Duplicates == firstDuplicate:
+		return nil
+	case sample.ts == last && settings.Duplicates == lastDuplicate:
+		return replaceLastSample(dataFile, info, sample)
+	}
+	return appendSample(dataFile, info, sample)
+}
+
+// bufferSample adds the sample to the reorder buffer and writes samples that
+// left the reorder window. The caller must hold pdb.mu.
+func (pdb *perfDB) bufferSample(dbname, dataFile string, sample Sample, settings DatabaseSettings) error {
+	// Samples older than the stored ones cannot be reordered anymore
+	last, exists, err := latestTimestamp(dataFile)
+	if err != nil {
+		return err
+	}
+	if exists && sample.ts < last {
+		return writeSample(dataFile, sample, settings)
+	}
+
+	buf, ok := pdb.buffers[dataFile]
+	if !ok {
+		buf = &reorderBuffer{dbname: dbname}
+		pdb.buffers[dataFile] = buf
+		pdb.flusher.Do(func() { go pdb.flushIdleBuffers() })
+	}
+	return buf.flush(dataFile, buf.insert(sample, settings))
+}
+
+// insert adds the sample to the buffer according to the duplicate policy and
+// returns the number of samples that left the reorder window.
+func (buf *reorderBuffer) insert(sample Sample, settings DatabaseSettings) int {
+	buf.settings = settings
+	buf.updated = time.Now()
+
+	i := sort.Search(len(buf.samples), func(i int) bool {
+		return buf.samples[i].ts > sample.ts
+	})
+	if i > 0 && buf.samples[i-1].ts == sample.ts {
+		switch settings.Duplicates {
+		case firstDuplicate:
+			return 0
+		case lastDuplicate:
+			buf.samples[i-1] = sample
+			return 0
+		}
+	}
+	buf.samples = append(buf.samples, Sample{})
+	copy(buf.samples[i+1:], buf.samples[i:])
+	buf.samples[i] = sample
+
+	if sample.ts > buf.maxTS {
+		buf.maxTS = sample.ts
+	}
+
+	return sort.Search(len(buf.samples), func(i int) bool {
+		return buf.samples[i].ts > buf.maxTS-settings.window()
+	})
+}
+
+// flush writes the first n buffered samples.
+func (buf *reorderBuffer) flush(dataFile string, n int) error {
+	return buf.flushTo(func(sample Sample) error {
+		return writeSample(dataFile, sample, buf.settings)
+	}, n)
+}
+
+// flushTo passes the first n buffered samples to write, which stores them
+// according to buf.settings.
+func (buf *reorderBuffer) flushTo(write func(Sample) error, n int) error {
+	for i := 0; i < n; i++ {
+		if err := write(buf.samples[i]); err != nil {
+			buf.samples = buf.samples[i:]
+			return err
+		}
+	}
+	buf.samples = buf.samples[n:]
+	return nil
+}
+
+// flushMetric writes all buffered samples of the metric, so that readers
+// see every acknowledged sample.
+func (pdb *perfDB) flushMetric(dataFile string) error {
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+
+	if err := pdb.recoverMetric(dataFile); err != nil {
+		return err
+	}
+
+	if buf, ok := pdb.buffers[dataFile]; ok {
+		return pdb.flushBuffer(dataFile, buf)
+	}
+	return nil
+}
+
+// flushBuffer writes all samples of the buffer and forgets it. The caller
+// must hold pdb.mu.
+func (pdb *perfDB) flushBuffer(dataFile string, buf *reorderBuffer) error {
+	if err := buf.flush(dataFile, len(buf.samples)); err != nil {
+		pdb.uncommitted(dataFile, err)
+		return err
+	}
+	delete(pdb.buffers, dataFile)
+	return nil
+}
+
+// flushDatabase writes all buffered samples of the database. The caller must
+// hold pdb.mu.
+func (pdb *perfDB) flushDatabase(dbname string) error {
+	for dataFile, buf := range pdb.buffers {
+		if buf.dbname == dbname {
+			if err := pdb.flushBuffer(dataFile, buf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flushAll writes all buffered samples. The caller must hold pdb.mu.
+func (pdb *perfDB) flushAll() error {
+	for dataFile, buf := range pdb.buffers {
+		if err := pdb.flushBuffer(dataFile, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushIdleBuffers periodically writes samples of metrics that haven't been
+// updated for longer than their reorder window.
+func (pdb *perfDB) flushIdleBuffers() {
+	for range time.Tick(flushInterval) {
+		pdb.mu.Lock()
+		for dataFile, buf := range pdb.buffers {
+			window := time.Duration(buf.settings.ReorderWindow) * time.Millisecond
+			if time.Since(buf.updated) < window {
+				continue
+			}
+			if err := pdb.flushBuffer(dataFile, buf); err != nil {
+				logger.Errorf("Failed to flush %s: %s", dataFile, err)
+			}
+		}
+		pdb.mu.Unlock()
+	}
+}
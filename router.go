@@ -1,23 +1,93 @@
 package main
 
 import (
+	"net/http"
+	"strings"
+
 	"github.com/gin-gonic/gin"
 )
 
-func newRouter(controller *Controller) *gin.Engine {
+// Paths starting with systemPrefix belong to perfdb itself rather than to a
+// database. They are served by a separate engine so that they don't clash
+// with the "/:db" wildcard. For the same reason, resources of a database as a
+// whole live under "/_db/:db/" since "/:db/:name" is always a metric.
+const systemPrefix = "/_"
+
+type router struct {
+	data   *gin.Engine
+	system *gin.Engine
+}
+
+func (r *router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if strings.HasPrefix(req.URL.Path, systemPrefix) {
+		r.system.ServeHTTP(rw, req)
+	} else {
+		r.data.ServeHTTP(rw, req)
+	}
+}
+
+func newRouter(controller *Controller) http.Handler {
 	gin.SetMode(gin.ReleaseMode)
 
-	router := gin.Default()
+	data := gin.Default()
+	// Names may contain encoded slashes
+	data.UseRawPath = true
 
-	rg := router.Group("/")
+	rg := data.Group("/", controller.validateNames)
 
 	rg.GET("/", controller.listDatabases)
 	rg.GET("/:db", controller.listMetrics)
 	rg.GET("/:db/:metric", controller.getRawValues)
 	rg.GET("/:db/:metric/summary", controller.getSummary)
 	rg.GET("/:db/:metric/heatmap", controller.getHeatMapSVG)
+	rg.GET("/:db/:metric/meta", controller.getMetricMeta)
 
 	rg.POST("/:db", controller.addSamples)
 
-	return router
+	rg.PUT("/:db/:metric", controller.setMetaByPath)
+	rg.PUT("/:db/:metric/meta", controller.setMetricMeta)
+
+	system := gin.Default()
+	system.UseRawPath = true
+
+	sg := system.Group("/", controller.validateNames)
+
+	sg.GET("/_ui", controller.getUI)
+
+	sg.POST("/_import", controller.importDatabase)
+
+	sg.GET("/_snapshots", controller.listSnapshots)
+	sg.POST("/_snapshots", controller.createSnapshot)
+
+	sg.GET("/_cache", controller.getCacheStats)
+
+	sg.GET("/_query", controller.runQuery)
+	sg.POST("/_query", controller.runQuery)
+
+	sg.GET("/_grafana/", controller.checkGrafana)
+	sg.POST("/_grafana/search", controller.searchGrafana)
+	sg.POST("/_grafana/query", controller.queryGrafana)
+	sg.POST("/_grafana/annotations", controller.getGrafanaAnnotations)
+
+	sg.GET("/_aggregate", controller.getAggregate)
+	sg.GET("/_aggregate/heatmap", controller.getAggregateHeatMapSVG)
+
+	sg.GET("/_fsck", controller.checkStorage)
+	sg.POST("/_fsck", controller.repairStorage)
+
+	sg.GET("/_db/:db/meta", controller.getMeta)
+	sg.PUT("/_db/:db/meta", controller.setMeta)
+	sg.GET("/_db/:db/summary", controller.getSummaries)
+	sg.GET("/_db/:db/expr", controller.getExprValues)
+	sg.GET("/_db/:db/expr/summary", controller.getExprSummary)
+	sg.GET("/_db/:db/expr/heatmap", controller.getExprHeatMapSVG)
+	sg.GET("/_db/:db/settings", controller.getSettings)
+	sg.PUT("/_db/:db/settings", controller.setSettings)
+	sg.GET("/_db/:db/annotations", controller.getAnnotations)
+	sg.POST("/_db/:db/annotations", controller.addAnnotation)
+	sg.GET("/_db/:db/export", controller.exportDatabase)
+	sg.GET("/_db/:db/compaction", controller.getCompression)
+	sg.POST("/_db/:db/compaction", controller.compactDatabase)
+
+	return &router{data, system}
 }
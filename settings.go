@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pmylund/go-cache"
+)
+
+const settingsFile = "settings.json"
+
+const (
+	acceptOutOfOrder = "accept"
+	rejectOutOfOrder = "reject"
+
+	keepDuplicates = "keep"
+	firstDuplicate = "first"
+	lastDuplicate  = "last"
+)
+
+// DatabaseSettings control how samples are stored.
+//
+// Samples that arrive within ReorderWindow milliseconds of the newest sample
+// are buffered in memory and written in timestamp order. Older samples are
+// either stored as is ("accept") or rejected ("reject") depending on
+// OutOfOrder.
+//
+// Duplicates defines what happens to a sample with the same timestamp as a
+// buffered or the latest stored sample: both are kept ("keep"), the new one
+// is dropped ("first") or replaces the existing one ("last").
+//
+// Precision is the unit of stored timestamps (see precisionUnits). It cannot
+// be changed once the database has samples.
+type DatabaseSettings struct {
+	ReorderWindow int64  `json:"reorderWindow"`
+	OutOfOrder    string `json:"outOfOrder"`
+	Duplicates    string `json:"duplicates"`
+	Precision     string `json:"precision"`
+}
+
+var defaultSettings = DatabaseSettings{
+	OutOfOrder: acceptOutOfOrder,
+	Duplicates: keepDuplicates,
+	Precision:  "ms",
+}
+
+var errPrecisionChange = errors.New("precision cannot be changed once samples are stored")
+
+var settingsCache *cache.Cache
+
+// unit returns the duration of a single timestamp unit.
+func (settings DatabaseSettings) unit() time.Duration {
+	return precisionUnits[settings.Precision]
+}
+
+// window returns the reorder window in timestamp units.
+func (settings DatabaseSettings) window() int64 {
+	return convertPrecision(settings.ReorderWindow, time.Millisecond, settings.unit())
+}
+
+func (settings *DatabaseSettings) validate() error {
+	if settings.ReorderWindow < 0 {
+		return fmt.Errorf("reorderWindow must not be negative")
+	}
+	switch settings.OutOfOrder {
+	case acceptOutOfOrder, rejectOutOfOrder:
+	default:
+		return fmt.Errorf("outOfOrder must be %q or %q", acceptOutOfOrder, rejectOutOfOrder)
+	}
+	switch settings.Duplicates {
+	case keepDuplicates, firstDuplicate, lastDuplicate:
+	default:
+		return fmt.Errorf("duplicates must be %q, %q or %q", keepDuplicates, firstDuplicate, lastDuplicate)
+	}
+	_, err := parsePrecision(settings.Precision)
+	return err
+}
+
+func (pdb *perfDB) getSettings(dbname string) (DatabaseSettings, error) {
+	settingsPath := filepath.Join(pdb.getDirPath(dbname), settingsFile)
+
+	if cachedData, found := settingsCache.Get(settingsPath); found {
+		return cachedData.(DatabaseSettings), nil
+	}
+
+	settings := defaultSettings
+
+	data, err := ioutil.ReadFile(settingsPath)
+	if err == nil {
+		err = json.Unmarshal(data, &settings)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return settings, err
+	}
+
+	settingsCache.Set(settingsPath, settings, cache.DefaultExpiration)
+	return settings, nil
+}
+
+func (pdb *perfDB) setSettings(dbname string, settings DatabaseSettings) error {
+	dataDir := pdb.getDirPath(dbname)
+	if err := os.MkdirAll(dataDir, 0775); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	current, err := pdb.getSettings(dbname)
+	if err != nil {
+		return err
+	}
+
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+
+	// Buffered samples follow the settings they were acknowledged with
+	if err := pdb.flushDatabase(dbname); err != nil {
+		return err
+	}
+
+	if current.unit() != settings.unit() {
+		files, err := ioutil.ReadDir(dataDir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if filepath.Ext(f.Name()) == dataFileExt {
+				return errPrecisionChange
+			}
+		}
+	}
+
+	settingsPath := filepath.Join(dataDir, settingsFile)
+	if err := writeFileAtomic(settingsPath, data); err != nil {
+		return err
+	}
+	settingsCache.Set(settingsPath, settings, cache.DefaultExpiration)
+	return nil
+}
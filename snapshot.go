@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshots are point-in-time copies of all databases. Each snapshot is a
+// directory named after its creation time, with the same layout as the data
+// directory. Files that haven't changed since the previous snapshot are
+// hardlinked rather than copied, so that regular backups of a large store are
+// cheap. Snapshots are built in a temporary directory and renamed when
+// complete.
+
+const snapshotTimeFormat = "20060102T150405.000Z"
+
+type Snapshot struct {
+	Name        string `json:"name"`
+	Created     int64  `json:"created"`
+	Files       int    `json:"files"`
+	Linked      int    `json:"linked"`
+	CopiedBytes int64  `json:"copiedBytes"`
+}
+
+// listSnapshots returns names of complete snapshots, oldest first.
+func listSnapshots(snapshotDir string) ([]string, error) {
+	files, err := ioutil.ReadDir(snapshotDir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	snapshots := []string{}
+	for _, f := range files {
+		if f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+			snapshots = append(snapshots, f.Name())
+		}
+	}
+	// Names are timestamps, so lexical order is chronological
+	sort.Strings(snapshots)
+	return snapshots, nil
+}
+
+func copyFileTimes(src, dst string, info os.FileInfo) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+	// The modification time tells the next snapshot whether the file changed
+	return n, os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// isUnchanged reports whether the file in the previous snapshot is the same
+// as the current one.
+func isUnchanged(info os.FileInfo, prevFile string) bool {
+	prev, err := os.Stat(prevFile)
+	return err == nil && prev.Size() == info.Size() && prev.ModTime().Equal(info.ModTime())
+}
+
+func (pdb *perfDB) snapshotDatabase(dataDir, dstDir, prevDir string, snapshot *Snapshot) error {
+	if err := os.Mkdir(dstDir, 0775); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if !f.Mode().IsRegular() || filepath.Ext(f.Name()) == ".tmp" {
+			continue
+		}
+		src := filepath.Join(dataDir, f.Name())
+		dst := filepath.Join(dstDir, f.Name())
+		snapshot.Files++
+
+		if prevDir != "" {
+			prevFile := filepath.Join(prevDir, f.Name())
+			// Snapshots may be on another file system, copy in that case
+			if isUnchanged(f, prevFile) && os.Link(prevFile, dst) == nil {
+				snapshot.Linked++
+				continue
+			}
+		}
+
+		n, err := copyFileTimes(src, dst, f)
+		snapshot.CopiedBytes += n
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot copies all databases into a new snapshot. Writes are blocked
+// while files are copied, unchanged files only take a hardlink.
+func (pdb *perfDB) snapshot(snapshotDir string) (*Snapshot, error) {
+	if err := os.MkdirAll(snapshotDir, 0775); err != nil {
+		return nil, err
+	}
+
+	snapshots, err := listSnapshots(snapshotDir)
+	if err != nil {
+		return nil, err
+	}
+	var prevDir string
+	if len(snapshots) > 0 {
+		prevDir = filepath.Join(snapshotDir, snapshots[len(snapshots)-1])
+	}
+
+	pdb.mu.Lock()
+	defer pdb.mu.Unlock()
+
+	// Acknowledged samples must be in the snapshot
+	if err := pdb.flushAll(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	snapshot := Snapshot{
+		Name:    now.UTC().Format(snapshotTimeFormat),
+		Created: now.UnixNano() / 1e6,
+	}
+	if _, err := os.Stat(filepath.Join(snapshotDir, snapshot.Name)); err == nil {
+		return nil, fmt.Errorf("snapshot %s already exists", snapshot.Name)
+	}
+
+	tmpDir := filepath.Join(snapshotDir, "."+snapshot.Name)
+	if err := os.Mkdir(tmpDir, 0775); err != nil {
+		return nil, err
+	}
+
+	databases, err := pdb.listDatabases()
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	for _, dbname := range databases {
+		dirName := escapeName(dbname)
+		var prevDbDir string
+		if prevDir != "" {
+			prevDbDir = filepath.Join(prevDir, dirName)
+		}
+		err := pdb.snapshotDatabase(pdb.getDirPath(dbname), filepath.Join(tmpDir, dirName), prevDbDir, &snapshot)
+		if err != nil {
+			os.RemoveAll(tmpDir)
+			return nil, err
+		}
+	}
+
+	if err := os.Rename(tmpDir, filepath.Join(snapshotDir, snapshot.Name)); err != nil {
+		os.RemoveAll(tmpDir)
+		return nil, err
+	}
+	return &snapshot, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Storage is what the controller needs from a storage backend. perfDB keeps
+// databases in a directory (see datafile.go), kvStorage in a single
+// key-value file (see kv.go) and memStorage in memory until the process
+// exits.
+//
+// Operations that only make sense for files (export and import, snapshots,
+// fsck and compaction) are separate interfaces. Backends that don't
+// implement them return errUnsupported to the client.
+type Storage interface {
+	addSample(dbname, metric string, sample Sample) error
+	checkOrder(dbname, metric string, ts int64) error
+
+	checkDbExists(dbname string) error
+	checkMetricExists(dbname, metric string) error
+
+	listDatabases() ([]string, error)
+	getDatabaseInfo(dbname string) (*DatabaseInfo, error)
+	listMetrics(dbname string) ([]string, error)
+	listMetricStats(dbname string) ([]*MetricStats, error)
+	getMetricStats(dbname, metric string) (*MetricStats, error)
+
+	streamRawValues(dbname, metric string, unit time.Duration, fn func(Sample) error) error
+	getSummary(dbname, metric string) (map[string]interface{}, error)
+	getHeatMap(dbname, metric string) (*heatMap, error)
+
+	getSettings(dbname string) (DatabaseSettings, error)
+	setSettings(dbname string, settings DatabaseSettings) error
+	getMeta(dbname string) (map[string]interface{}, error)
+	setMeta(dbname string, meta map[string]interface{}) error
+	getMetricMeta(dbname, metric string) (MetricMeta, error)
+	setMetricMeta(dbname, metric string, meta MetricMeta) error
+	addAnnotation(dbname string, annotation Annotation) error
+	getAnnotations(dbname string, from, to int64) ([]Annotation, error)
+}
+
+type archiver interface {
+	exportDatabase(dbname string, w io.Writer) error
+	importDatabase(r io.Reader, name string, rename bool) (string, error)
+}
+
+type snapshotter interface {
+	snapshot(snapshotDir string) (*Snapshot, error)
+}
+
+type checker interface {
+	fsck(repair bool) (*FsckReport, error)
+}
+
+type compactor interface {
+	getCompression(dbname string) (*CompressionReport, error)
+	compactDatabase(dbname string) error
+}
+
+var errUnsupported = errors.New("not supported by the storage backend")
+
+const (
+	fsBackend     = "fs"
+	kvBackend     = "kv"
+	memoryBackend = "memory"
+)
+
+func validateBackend(backend string) error {
+	switch backend {
+	case fsBackend, kvBackend, memoryBackend:
+		return nil
+	default:
+		return fmt.Errorf("backend must be %q, %q or %q, got %q", fsBackend, kvBackend, memoryBackend, backend)
+	}
+}
+
+// openStorage opens databases in the directory using the backend, the
+// in-memory backend starts empty.
+func openStorage(backend, dir string) (Storage, error) {
+	switch backend {
+	case fsBackend:
+		pdb, err := newPerfDB(dir)
+		if err != nil {
+			return nil, err
+		}
+		return pdb, nil
+	case kvBackend:
+		ks, err := newKVStorage(dir)
+		if err != nil {
+			return nil, err
+		}
+		return ks, nil
+	case memoryBackend:
+		return newMemStorage(), nil
+	default:
+		return nil, validateBackend(backend)
+	}
+}
@@ -30,15 +30,18 @@ func drawCanvas(canvas *svg.SVG, canvasSize size) {
 		"fill:white;stroke:none")
 }
 
-func drawXTitle(canvas *svg.SVG, canvasSize, chartInnerSize size, chartMargin margin, timeElapsed time.Duration) {
-	var title string
+func drawXTitle(canvas *svg.SVG, canvasSize, chartInnerSize size, chartMargin margin, timeElapsed time.Duration, runs bool) {
+	title := "Time elapsed"
+	if runs {
+		title = "Time since start of run"
+	}
 
 	if timeElapsed.Hours() > 1 {
-		title = "Time elapsed, h"
+		title += ", h"
 	} else if timeElapsed.Minutes() > 1 {
-		title = "Time elapsed, m"
+		title += ", m"
 	} else {
-		title = "Time elapsed, s"
+		title += ", s"
 	}
 
 	canvas.Text(chartMargin.left+chartInnerSize.width/2, canvasSize.height-6,
@@ -89,9 +92,9 @@ func tickFormatter(maxValue float64) string {
 }
 
 func drawYAxis(canvas *svg.SVG, canvasSize, chartInnerSize size, chartMargin margin, hm *heatMap) {
-	tickFmt := tickFormatter(hm.MaxValue)
+	tickFmt := tickFormatter(math.Max(hm.MaxValue, -hm.MinValue))
 	for i := 0; i <= gridSize.height; i++ {
-		tickValue := float64(i) * float64(hm.MaxValue) / float64(gridSize.height)
+		tickValue := hm.MinValue + float64(i)*(hm.MaxValue-hm.MinValue)/float64(gridSize.height)
 		tick := fmt.Sprintf(tickFmt, tickValue)
 		canvas.Text(chartMargin.left-5,
 			canvasSize.height-chartMargin.bottom-i*chartInnerSize.height/gridSize.height,
@@ -170,6 +173,23 @@ func drawHeatMap(canvas *svg.SVG, canvasSize, chartInnerSize size, chartMargin m
 	}
 }
 
+func drawAnnotations(canvas *svg.SVG, chartInnerSize size, chartMargin margin, hm *heatMap) {
+	const lineStyle = "stroke:#1F77B4;stroke-width:1;shape-rendering:crispEdges"
+	const textStyle = "text-anchor:start;font-size:11px;font-family:Arial,Helvetica;fill:#1F77B4"
+
+	for _, annotation := range hm.Annotations {
+		x := chartMargin.left
+		if hm.MaxTS > hm.MinTS {
+			x += int(int64(chartInnerSize.width) * (annotation.Timestamp - hm.MinTS) / (hm.MaxTS - hm.MinTS))
+		}
+		canvas.Line(x, chartMargin.top, x, chartMargin.top+chartInnerSize.height, lineStyle)
+
+		canvas.Gtransform(fmt.Sprintf("translate(%d,%d) rotate(90)", x+3, chartMargin.top+5))
+		canvas.Text(0, 0, annotation.Text, textStyle)
+		canvas.Gend()
+	}
+}
+
 func generateSVG(output io.Writer, hm *heatMap, title string) {
 	// Sizes and margins
 	var canvasSize = size{1040, 520}
@@ -205,8 +225,8 @@ func generateSVG(output io.Writer, hm *heatMap, title string) {
 
 	drawHeatMap(canvas, canvasSize, chartInnerSize, chartMargin, hm)
 
-	timeElapsed := time.Duration(hm.MaxTS-hm.MinTS) * 1e6
-	drawXTitle(canvas, canvasSize, chartInnerSize, chartMargin, timeElapsed)
+	timeElapsed := time.Duration(hm.MaxTS-hm.MinTS) * hm.unit
+	drawXTitle(canvas, canvasSize, chartInnerSize, chartMargin, timeElapsed, hm.runs)
 	drawXAxis(canvas, canvasSize, chartInnerSize, chartMargin, timeElapsed)
 
 	drawYAxis(canvas, canvasSize, chartInnerSize, chartMargin, hm)
@@ -214,6 +234,8 @@ func generateSVG(output io.Writer, hm *heatMap, title string) {
 
 	drawGrid(canvas, chartInnerSize, chartMargin)
 
+	drawAnnotations(canvas, chartInnerSize, chartMargin, hm)
+
 	drawHeatBar(canvas, chartInnerSize, chartOuterSize, heatBarInnerSize, heatBarMargin, hm)
 
 	canvas.End()
@@ -1,27 +1,71 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"strconv"
 	"time"
 )
 
-func parseTimestamp(ts string) int64 {
+var errTimestampRange = errors.New("timestamp is out of range, expected seconds, milliseconds, microseconds or nanoseconds since the epoch")
+
+// Timestamps are stored as integers in the precision of the database.
+var precisionUnits = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"µs": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+func parsePrecision(precision string) (time.Duration, error) {
+	if unit, ok := precisionUnits[precision]; ok {
+		return unit, nil
+	}
+	return 0, fmt.Errorf("precision must be \"s\", \"ms\", \"us\" or \"ns\", got %q", precision)
+}
+
+// convertPrecision converts a timestamp from one unit to another. Conversion
+// to a coarser unit truncates the timestamp.
+func convertPrecision(ts int64, from, to time.Duration) int64 {
+	if from >= to {
+		return ts * int64(from/to)
+	}
+	return ts / int64(to/from)
+}
+
+// now returns the current time in the given unit.
+func now(unit time.Duration) int64 {
+	return time.Now().UnixNano() / int64(unit)
+}
+
+// convertTimestamp converts a timestamp in seconds, milliseconds,
+// microseconds or nanoseconds to the given unit.
+func convertTimestamp(ts string, unit time.Duration) (int64, error) {
 	tsInt, err := strconv.ParseInt(ts, 10, 64)
 	if err != nil {
-		logger.Warning("Invalid timestamp, using current time instead.")
-		return time.Now().UnixNano() / 1e6
+		return 0, errors.New("timestamp must be an integer")
 	}
 
 	switch {
 	case tsInt > 1e18: // nanosecond timestamps
-		return time.Unix(tsInt/1e9, tsInt%1e9).UnixNano() / 1e6
+		return convertPrecision(tsInt, time.Nanosecond, unit), nil
 	case tsInt > 1e15: // microseconds timestamps
-		return time.Unix(tsInt/1e6, (tsInt*1e3)%1e9).UnixNano() / 1e6
+		return convertPrecision(tsInt, time.Microsecond, unit), nil
 	case tsInt > 1e12: // millisecond timestamps
-		return time.Unix(tsInt/1e3, (tsInt*1e6)%1e9).UnixNano() / 1e6
+		return convertPrecision(tsInt, time.Millisecond, unit), nil
 	case tsInt > 1e9: // second timestamps
-		return time.Unix(tsInt, 0).UnixNano() / 1e6
+		return convertPrecision(tsInt, time.Second, unit), nil
 	default:
-		return time.Now().UnixNano() / 1e6
+		return 0, errTimestampRange
+	}
+}
+
+func parseTimestamp(ts string, unit time.Duration) int64 {
+	tsInt, err := convertTimestamp(ts, unit)
+	if err != nil {
+		logger.Warning("Invalid timestamp, using current time instead.")
+		return now(unit)
 	}
+	return tsInt
 }
@@ -8,23 +8,23 @@ import (
 )
 
 func TestTimestampParser(t *testing.T) {
-	timestamp := parseTimestamp("1411534805453497432")
+	timestamp := parseTimestamp("1411534805453497432", time.Millisecond)
 	assert.Equal(t, timestamp, int64(1411534805453), "Invalid ns")
 
-	timestamp = parseTimestamp("1411534805453497")
+	timestamp = parseTimestamp("1411534805453497", time.Millisecond)
 	assert.Equal(t, timestamp, int64(1411534805453), "Invalid us")
 
-	timestamp = parseTimestamp("1411534805453")
+	timestamp = parseTimestamp("1411534805453", time.Millisecond)
 	assert.Equal(t, timestamp, int64(1411534805453), "Invalid ms")
 
-	timestamp = parseTimestamp("1411534805")
+	timestamp = parseTimestamp("1411534805", time.Millisecond)
 	assert.Equal(t, timestamp, int64(1411534805000), "Invalid s")
 }
 
 func TestBadTimestampParser(t *testing.T) {
 	timeNow := time.Now().UnixNano() / 1e6
 
-	timestamp := parseTimestamp("1411534805.453")
+	timestamp := parseTimestamp("1411534805.453", time.Millisecond)
 
 	if timestamp < timeNow || timestamp > (timeNow+1e3) {
 		t.Fatalf("Bad (not current) time: %v, expected ~%v", timestamp, timeNow)
@@ -34,8 +34,47 @@ func TestBadTimestampParser(t *testing.T) {
 func TestSmallTimestampParser(t *testing.T) {
 	timeNow := time.Now().UnixNano() / 1e6
 
-	timestamp := parseTimestamp("123456")
+	timestamp := parseTimestamp("123456", time.Millisecond)
 	if timestamp < timeNow || timestamp > (timeNow+1e3) {
 		t.Fatalf("Bad (not current) time: %v, expected ~%v", timestamp, timeNow)
 	}
 }
+
+func TestConvertBadTimestamp(t *testing.T) {
+	_, err := convertTimestamp("1411534805.453", time.Millisecond)
+	assert.NotNil(t, err)
+
+	_, err = convertTimestamp("123456", time.Millisecond)
+	assert.Equal(t, errTimestampRange, err)
+
+	timestamp, err := convertTimestamp("1411534805453", time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1411534805453), timestamp)
+}
+
+func TestConvertTimestampPrecision(t *testing.T) {
+	timestamp, err := convertTimestamp("1411534805453497432", time.Nanosecond)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1411534805453497432), timestamp)
+
+	timestamp, err = convertTimestamp("1411534805453497432", time.Microsecond)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1411534805453497), timestamp)
+
+	timestamp, err = convertTimestamp("1411534805453", time.Nanosecond)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1411534805453000000), timestamp)
+
+	timestamp, err = convertTimestamp("1411534805", time.Microsecond)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1411534805000000), timestamp)
+}
+
+func TestParsePrecision(t *testing.T) {
+	unit, err := parsePrecision("µs")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Microsecond, unit)
+
+	_, err = parsePrecision("ps")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (c *Controller) getUI(context *gin.Context) {
+	context.Data(http.StatusOK, "text/html; charset=utf-8", []byte(uiPage))
+}
+
+// uiPage is a single self-contained page, so the binary doesn't need any
+// static files. It only talks to the public HTTP API.
+const uiPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>perfdb</title>
+<style>
+body { margin: 0; font: 13px Arial, Helvetica, sans-serif; color: #222; }
+a { color: #D74701; text-decoration: none; cursor: pointer; }
+a:hover { text-decoration: underline; }
+#sidebar { position: fixed; top: 0; bottom: 0; left: 0; width: 260px; overflow-y: auto; border-right: 1px solid #ddd; background: #FFF5EB; }
+#main { margin-left: 261px; padding: 16px 24px; }
+h1 { font-size: 18px; margin: 12px; }
+h2 { font-size: 16px; margin: 0 0 12px 0; }
+h3 { font-size: 14px; margin: 20px 0 8px 0; }
+input[type=search] { box-sizing: border-box; width: 100%; padding: 4px; }
+.search { padding: 0 12px 8px 12px; }
+ul { list-style: none; margin: 0; padding: 0; }
+#databases li { padding: 2px 12px; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; }
+#databases li.selected { background: #FDCFA1; }
+table { border-collapse: collapse; }
+th, td { padding: 3px 8px; border-bottom: 1px solid #eee; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+.toolbar { margin: 8px 0; }
+.toolbar button { margin-right: 4px; }
+.error { color: #B00; }
+.muted { color: #888; }
+canvas { border: 1px solid #ddd; }
+.heatmaps img { max-width: 100%; border: 1px solid #ddd; margin-bottom: 8px; }
+.legend span { display: inline-block; margin-right: 12px; }
+.legend i { display: inline-block; width: 12px; height: 3px; margin-right: 4px; vertical-align: middle; }
+</style>
+</head>
+<body>
+<div id="sidebar">
+	<h1><a href="#/">perfdb</a></h1>
+	<div class="search"><input id="dbSearch" type="search" placeholder="Search databases"></div>
+	<div class="search"><button id="compare" disabled>Compare selected</button></div>
+	<ul id="databases"></ul>
+</div>
+<div id="main"></div>
+<script>
+(function() {
+	"use strict";
+
+	var percentiles = ["p50", "p80", "p90", "p95", "p99", "p99.9"];
+	var colors = ["#D74701", "#1F77B4", "#2CA02C", "#9467BD", "#8C564B", "#E377C2", "#7F7F7F", "#BCBD22", "#17BECF"];
+	var ranges = [["All", 0], ["Last 1m", 60], ["Last 5m", 300], ["Last 15m", 900], ["Last 1h", 3600]];
+
+	var databases = [];
+	var infos = {};
+	var selected = {};
+
+	function $(id) { return document.getElementById(id); }
+
+	function esc(s) {
+		return String(s).replace(/[&<>"']/g, function(c) {
+			return {"&": "&amp;", "<": "&lt;", ">": "&gt;", "\"": "&quot;", "'": "&#39;"}[c];
+		});
+	}
+
+	function path() {
+		var parts = [];
+		for (var i = 0; i < arguments.length; i++) {
+			parts.push(encodeURIComponent(arguments[i]));
+		}
+		return "/" + parts.join("/");
+	}
+
+	function getJSON(url) {
+		return fetch(url).then(function(resp) {
+			if (!resp.ok) {
+				throw new Error(url + ": " + resp.status + " " + resp.statusText);
+			}
+			return resp.json();
+		});
+	}
+
+	function fmt(v) {
+		if (typeof v !== "number") {
+			return esc(v);
+		}
+		return Number.isInteger(v) ? String(v) : v.toPrecision(6).replace(/\.?0+$/, "");
+	}
+
+	function showError(err) {
+		$("main").innerHTML = "<p class=\"error\">" + esc(err.message) + "</p>";
+	}
+
+	// Sidebar
+
+	function renderDatabases() {
+		var query = $("dbSearch").value.toLowerCase();
+		var current = decodeURIComponent((location.hash.split("/")[1] || ""));
+		var html = "";
+		databases.forEach(function(db) {
+			if (db.toLowerCase().indexOf(query) < 0) {
+				return;
+			}
+			html += "<li" + (db === current ? " class=\"selected\"" : "") + ">" +
+				"<input type=\"checkbox\" data-db=\"" + esc(db) + "\"" + (selected[db] ? " checked" : "") + "> " +
+				"<a href=\"#" + esc(path(db)) + "\">" + esc(db) + "</a></li>";
+		});
+		$("databases").innerHTML = html || "<li class=\"muted\">No databases</li>";
+	}
+
+	function selectedDatabases() {
+		return databases.filter(function(db) { return selected[db]; });
+	}
+
+	$("dbSearch").addEventListener("input", function() {
+		renderDatabases();
+		if (location.hash.replace(/^#\/?/, "") === "") {
+			home();
+		}
+	});
+
+	$("databases").addEventListener("change", function(e) {
+		var db = e.target.getAttribute("data-db");
+		if (db !== null) {
+			selected[db] = e.target.checked;
+			$("compare").disabled = selectedDatabases().length < 2;
+		}
+	});
+
+	$("compare").addEventListener("click", function() {
+		location.hash = "#/_compare/" + selectedDatabases().map(encodeURIComponent).join(",");
+	});
+
+	// Views
+
+	function size(bytes) {
+		var units = ["B", "KB", "MB", "GB", "TB"];
+		var i = 0;
+		for (; bytes >= 1024 && i < units.length - 1; i++) {
+			bytes /= 1024;
+		}
+		return (i ? bytes.toFixed(1) : bytes) + " " + units[i];
+	}
+
+	function date(ts) {
+		return ts ? new Date(ts).toISOString().replace("T", " ").replace(/\.\d+Z$/, "") : "";
+	}
+
+	function home() {
+		var query = $("dbSearch").value.toLowerCase();
+		var html = "<h2>Databases</h2><p>" + databases.length +
+			" database(s). Pick one on the left, or tick several and compare them.</p>" +
+			"<table><tr><th>database</th><th>metrics</th><th>size</th><th>created</th><th>first sample</th><th>last sample</th></tr>";
+		databases.forEach(function(db) {
+			var info = infos[db];
+			if (db.toLowerCase().indexOf(query) < 0) {
+				return;
+			}
+			html += "<tr><td><a href=\"#" + esc(path(db)) + "\">" + esc(db) + "</a></td><td>" + info.metrics + "</td><td>" +
+				size(info.size) + "</td><td>" + date(info.created) + "</td><td>" + date(info.firstTimestamp) + "</td><td>" +
+				date(info.lastTimestamp) + "</td></tr>";
+		});
+		$("main").innerHTML = html + "</table>";
+	}
+
+	function summaryRow(name, link, summary) {
+		var html = "<tr><td>" + link + "</td>";
+		if (summary instanceof Error) {
+			return html + "<td colspan=\"" + (4 + percentiles.length) + "\" class=\"error\">" + esc(summary.message) + "</td></tr>";
+		}
+		["count", "min", "avg", "max"].concat(percentiles).forEach(function(key) {
+			html += "<td>" + fmt(summary[key]) + "</td>";
+		});
+		return html + "</tr>";
+	}
+
+	function summaryHeader(first) {
+		return "<tr><th>" + esc(first) + "</th><th>count</th><th>min</th><th>avg</th><th>max</th><th>" +
+			percentiles.join("</th><th>") + "</th></tr>";
+	}
+
+	function fetchSummary(db, metric) {
+		return getJSON(path(db, metric, "summary")).catch(function(err) { return err; });
+	}
+
+	function database(db) {
+		getJSON(path(db) + "?stats=true").then(function(stats) {
+			var units = {};
+			var metrics = stats.map(function(m) {
+				units[m.name] = m.unit;
+				return m.name;
+			}).sort();
+			$("main").innerHTML = "<h2>" + esc(db) + "</h2>" +
+				"<div id=\"meta\"></div>" +
+				"<input id=\"metricSearch\" type=\"search\" placeholder=\"Search metrics\" style=\"width:300px\"> " +
+				"<form id=\"exprForm\" style=\"display:inline\"><input id=\"expr\" placeholder=\"Expression, e.g. rate(ops_total)\" style=\"width:300px\"> " +
+				"<button>Evaluate</button></form>" +
+				"<h3>Summary</h3><table id=\"summary\"></table>";
+			$("exprForm").addEventListener("submit", function(e) {
+				e.preventDefault();
+				location.hash = "#" + path(db, "_expr", $("expr").value);
+			});
+
+			getJSON("/_db" + path(db, "meta")).then(function(meta) {
+				var keys = Object.keys(meta).sort();
+				if (keys.length) {
+					$("meta").innerHTML = "<h3>Metadata</h3><table>" + keys.map(function(key) {
+						return "<tr><td>" + esc(key) + "</td><td>" + esc(JSON.stringify(meta[key])) + "</td></tr>";
+					}).join("") + "</table><h3>Metrics</h3>";
+				}
+			});
+
+			var summaries = {};
+			var render = function() {
+				var query = $("metricSearch").value.toLowerCase();
+				var html = summaryHeader("metric");
+				metrics.forEach(function(metric) {
+					if (metric.toLowerCase().indexOf(query) < 0) {
+						return;
+					}
+					var link = "<a href=\"#" + esc(path(db, metric)) + "\">" + esc(metric) + "</a>" +
+						(units[metric] ? " <span class=\"muted\">" + esc(units[metric]) + "</span>" : "");
+					if (summaries[metric]) {
+						html += summaryRow(metric, link, summaries[metric]);
+					} else {
+						html += "<tr><td>" + link + "</td><td class=\"muted\">loading...</td></tr>";
+					}
+				});
+				$("summary").innerHTML = html;
+			};
+			$("metricSearch").addEventListener("input", render);
+			render();
+
+			// Summaries rescan whole files, so don't fire all of them at once.
+			var queue = metrics.slice();
+			var next = function() {
+				var metric = queue.shift();
+				if (metric === undefined || location.hash !== "#" + path(db)) {
+					return;
+				}
+				fetchSummary(db, metric).then(function(summary) {
+					summaries[metric] = summary;
+					render();
+					next();
+				});
+			};
+			for (var i = 0; i < 4; i++) {
+				next();
+			}
+		}).catch(showError);
+	}
+
+	function rangeToolbar() {
+		var html = "<div class=\"toolbar\">Time range: ";
+		ranges.forEach(function(r, i) {
+			html += "<button data-range=\"" + i + "\">" + r[0] + "</button>";
+		});
+		return html + " from <input id=\"from\" size=\"6\"> s to <input id=\"to\" size=\"6\"> s " +
+			"<button id=\"apply\">Apply</button> <span class=\"muted\">(seconds elapsed since the first sample)</span></div>";
+	}
+
+	// Wires the range toolbar to update(from, to) with offsets in milliseconds.
+	function bindRange(duration, update) {
+		var apply = function(from, to) {
+			$("from").value = (from / 1000).toFixed(1);
+			$("to").value = (to / 1000).toFixed(1);
+			update(from, to);
+		};
+		Array.prototype.forEach.call(document.querySelectorAll("[data-range]"), function(button) {
+			button.addEventListener("click", function() {
+				var seconds = ranges[button.getAttribute("data-range")][1];
+				apply(seconds ? Math.max(0, duration - seconds * 1000) : 0, duration);
+			});
+		});
+		$("apply").addEventListener("click", function() {
+			apply(parseFloat($("from").value) * 1000 || 0, parseFloat($("to").value) * 1000 || duration);
+		});
+		apply(0, duration);
+	}
+
+	function summarize(values) {
+		var sorted = values.map(function(v) { return v[1]; }).sort(function(a, b) { return a - b; });
+		var count = sorted.length;
+		if (!count) {
+			return new Error("no samples in the selected range");
+		}
+		var sum = sorted.reduce(function(a, b) { return a + b; }, 0);
+		var summary = {count: count, min: sorted[0], max: sorted[count - 1], avg: sum / count};
+		[0.5, 0.8, 0.9, 0.95, 0.99, 0.999].forEach(function(p, i) {
+			summary[percentiles[i]] = sorted[count > 1 ? Math.floor(count * p) - 1 : 0];
+		});
+		return summary;
+	}
+
+	function inRange(values, start, from, to) {
+		return values.filter(function(v) {
+			return v[0] - start >= from && v[0] - start <= to;
+		});
+	}
+
+	function drawChart(canvas, series, from, to) {
+		var ctx = canvas.getContext("2d");
+		var margin = {top: 10, right: 10, bottom: 30, left: 70};
+		var width = canvas.width - margin.left - margin.right;
+		var height = canvas.height - margin.top - margin.bottom;
+		ctx.clearRect(0, 0, canvas.width, canvas.height);
+
+		var maxValue = 0;
+		series.forEach(function(s) {
+			s.points.forEach(function(v) { maxValue = Math.max(maxValue, v[1]); });
+		});
+		maxValue = maxValue || 1;
+		var span = Math.max(to - from, 1);
+
+		ctx.font = "11px Arial";
+		ctx.strokeStyle = "#ddd";
+		ctx.fillStyle = "#222";
+		ctx.textAlign = "right";
+		for (var i = 0; i <= 5; i++) {
+			var y = margin.top + height - i * height / 5;
+			ctx.beginPath();
+			ctx.moveTo(margin.left, y);
+			ctx.lineTo(margin.left + width, y);
+			ctx.stroke();
+			ctx.fillText(fmt(maxValue * i / 5), margin.left - 5, y + 4);
+		}
+		ctx.textAlign = "center";
+		for (i = 0; i <= 6; i++) {
+			var x = margin.left + i * width / 6;
+			ctx.fillText(((from + span * i / 6) / 1000).toFixed(1) + "s", x, margin.top + height + 18);
+		}
+
+		series.forEach(function(s) {
+			ctx.strokeStyle = s.color;
+			ctx.beginPath();
+			s.points.forEach(function(v, j) {
+				var x = margin.left + width * (v[0] - s.start - from) / span;
+				var y = margin.top + height - height * v[1] / maxValue;
+				if (j === 0) {
+					ctx.moveTo(x, y);
+				} else {
+					ctx.lineTo(x, y);
+				}
+			});
+			ctx.stroke();
+		});
+	}
+
+	// Derived series are shown the same way as metrics.
+	function expression(db, expr) {
+		var query = "?q=" + encodeURIComponent(expr);
+		metric(db, expr, "/_db" + path(db, "expr") + query + "&precision=ms", "/_db" + path(db, "expr", "heatmap") + query);
+	}
+
+	function metric(db, name, valuesURL, heatmapURL) {
+		$("main").innerHTML = "<h2><a href=\"#" + esc(path(db)) + "\">" + esc(db) + "</a> / " + esc(name) + "</h2>" +
+			"<p class=\"muted\">loading...</p>";
+		getJSON(valuesURL).then(function(values) {
+			if (!values.length) {
+				throw new Error("no samples");
+			}
+			var start = values[0][0];
+			var duration = values[values.length - 1][0] - start;
+			$("main").innerHTML = "<h2><a href=\"#" + esc(path(db)) + "\">" + esc(db) + "</a> / " + esc(name) + "</h2>" +
+				rangeToolbar() +
+				"<h3>Summary</h3><table id=\"summary\"></table>" +
+				"<h3>Chart</h3><canvas id=\"chart\" width=\"1040\" height=\"320\"></canvas>" +
+				"<h3>Heat map</h3><div class=\"heatmaps\"><img src=\"" + esc(heatmapURL) + "\"></div>";
+			bindRange(duration, function(from, to) {
+				var points = inRange(values, start, from, to);
+				$("summary").innerHTML = summaryHeader("range") + summaryRow("", esc($("from").value + "s - " + $("to").value + "s"), summarize(points));
+				drawChart($("chart"), [{points: points, start: start, color: colors[0]}], from, to);
+			});
+		}).catch(showError);
+	}
+
+	function compare(dbs, name) {
+		var html = "<h2>Compare " + dbs.map(esc).join(", ") + "</h2>";
+		Promise.all(dbs.map(function(db) {
+			return getJSON(path(db)).catch(function() { return []; });
+		})).then(function(lists) {
+			// Only metrics present in every database can be compared.
+			var common = lists.reduce(function(acc, metrics) {
+				return acc.filter(function(m) { return metrics.indexOf(m) >= 0; });
+			}).sort();
+			html += "<div class=\"toolbar\">Metric: <select id=\"metric\"><option value=\"\">-</option>";
+			common.forEach(function(m) {
+				html += "<option" + (m === name ? " selected" : "") + ">" + esc(m) + "</option>";
+			});
+			$("main").innerHTML = html + "</select></div><div id=\"comparison\"></div>";
+			$("metric").addEventListener("change", function() {
+				location.hash = "#/_compare/" + dbs.map(encodeURIComponent).join(",") + "/" + encodeURIComponent(this.value);
+			});
+			if (name) {
+				compareMetric(dbs, name);
+			}
+		}).catch(showError);
+	}
+
+	function compareMetric(dbs, name) {
+		Promise.all(dbs.map(function(db) { return getJSON(path(db, name) + "?precision=ms"); })).then(function(all) {
+			var series = all.map(function(values, i) {
+				return {db: dbs[i], points: values, start: values.length ? values[0][0] : 0, color: colors[i % colors.length]};
+			});
+			var duration = 0;
+			series.forEach(function(s) {
+				if (s.points.length) {
+					duration = Math.max(duration, s.points[s.points.length - 1][0] - s.start);
+				}
+			});
+
+			var html = rangeToolbar() + "<h3>Summary</h3><table id=\"summary\"></table>" +
+				"<h3>Chart</h3><div class=\"legend\">";
+			series.forEach(function(s) {
+				html += "<span><i style=\"background:" + s.color + "\"></i>" + esc(s.db) + "</span>";
+			});
+			html += "</div><canvas id=\"chart\" width=\"1040\" height=\"320\"></canvas><h3>Heat maps</h3><div class=\"heatmaps\">";
+			dbs.forEach(function(db) {
+				html += "<div>" + esc(db) + "</div><img src=\"" + esc(path(db, name, "heatmap")) + "\">";
+			});
+			$("comparison").innerHTML = html + "</div>";
+
+			bindRange(duration, function(from, to) {
+				var rows = summaryHeader("database");
+				var visible = series.map(function(s) {
+					var points = inRange(s.points, s.start, from, to);
+					rows += summaryRow(s.db, esc(s.db), summarize(points));
+					return {points: points, start: s.start, color: s.color};
+				});
+				$("summary").innerHTML = rows;
+				drawChart($("chart"), visible, from, to);
+			});
+		}).catch(function(err) {
+			$("comparison").innerHTML = "<p class=\"error\">" + esc(err.message) + "</p>";
+		});
+	}
+
+	function route() {
+		var raw = location.hash.replace(/^#\/?/, "").split("/").filter(Boolean);
+		var parts = raw.map(decodeURIComponent);
+		renderDatabases();
+		if (parts[0] === "_compare" && parts.length > 1) {
+			compare(raw[1].split(",").map(decodeURIComponent), parts[2]);
+		} else if (parts.length === 1) {
+			database(parts[0]);
+		} else if (parts.length === 2) {
+			metric(parts[0], parts[1], path(parts[0], parts[1]) + "?precision=ms", path(parts[0], parts[1], "heatmap"));
+		} else if (parts.length === 3 && parts[1] === "_expr") {
+			expression(parts[0], parts[2]);
+		} else {
+			home();
+		}
+	}
+
+	window.addEventListener("hashchange", route);
+
+	getJSON("/").then(function(list) {
+		list.forEach(function(info) {
+			databases.push(info.name);
+			infos[info.name] = info;
+		});
+		route();
+	}).catch(showError);
+})();
+</script>
+</body>
+</html>
+`